@@ -9,8 +9,9 @@ echo "pwd is: " $PWD
 echo "List whats in the current directory"
 ls -lat
 
-# Setup the gopath based on current directory.
+# Setup the gopath based on current directory. The dependencies are vendored, so modules are not used.
 export GOPATH=$PWD
+export GO111MODULE=off
 
 # Now we must move our code from the current directory ./hello-go to $GOPATH/src/github.com/JeffDeCola/hello-go
 mkdir -p src/github.com/jwenz723/
@@ -1,20 +1,87 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
+	"time"
 	"gopkg.in/yaml.v2"
 	"github.com/sirupsen/logrus"
+	"github.com/jwenz723/telchat/tcp"
+)
+
+// Types of message stores that can be selected with Config.StoreType
+const (
+	StoreTypeLog    = "log"
+	StoreTypeMemory = "memory"
+)
+
+// Types of user stores that can be selected with Config.UserStoreType
+const (
+	UserStoreTypeFile   = "file"
+	UserStoreTypeMemory = "memory"
 )
 
 // Config defines a struct to match a configuration yaml file.
 type Config struct {
+	AccountsOnly 		bool 		`yaml:"AccountsOnly"`
+	Admins 				[]string 	`yaml:"Admins"`
+	BanFile 			string 		`yaml:"BanFile"`
+	FloodBurst 			int 		`yaml:"FloodBurst"`
+	FloodMuteDuration 	time.Duration `yaml:"FloodMuteDuration"`
+	FloodMutes 			int 		`yaml:"FloodMutes"`
+	FloodRate 			float64 	`yaml:"FloodRate"`
+	FloodWarnings 		int 		`yaml:"FloodWarnings"`
+	HistorySize 		int 		`yaml:"HistorySize"`
 	HTTPAddress 		string 		`yaml:"HTTPAddress"`
 	HTTPPort 			int 		`yaml:"HTTPPort"`
+	HTTPRateBurst 		int 		`yaml:"HTTPRateBurst"`
+	HTTPRateLimit 		float64 	`yaml:"HTTPRateLimit"`
+	HTTPRequireTokens 	bool 		`yaml:"HTTPRequireTokens"`
+	HTTPTokens 			[]TokenConfig `yaml:"HTTPTokens"`
+	HTTPTokensFile 		string 		`yaml:"HTTPTokensFile"`
+	IdleTimeout 		time.Duration `yaml:"IdleTimeout"`
+	IRCAddress 			string 		`yaml:"IRCAddress"`
+	IRCPort 			int 		`yaml:"IRCPort"`
 	LogDirectory 		string 		`yaml:"LogDirectory"`
 	LogJSON 			bool		`yaml:"LogJSON"`
 	LogLevel 			string 		`yaml:"LogLevel"`
+	MaxConnections 		int 		`yaml:"MaxConnections"`
+	MaxConnectionsPerIP int 		`yaml:"MaxConnectionsPerIP"`
+	MaxLineLength 		int 		`yaml:"MaxLineLength"`
+	MaxNickLength 		int 		`yaml:"MaxNickLength"`
+	NameTimeout 		time.Duration `yaml:"NameTimeout"`
+	PingInterval 		time.Duration `yaml:"PingInterval"`
+	PingTimeout 		time.Duration `yaml:"PingTimeout"`
+	QueueOverflow 		string 		`yaml:"QueueOverflow"`
+	QueueSize 			int 		`yaml:"QueueSize"`
+	SanitizePolicy 		string 		`yaml:"SanitizePolicy"`
+	SSHAddress 			string 		`yaml:"SSHAddress"`
+	SSHAuthorizedKeysFile string 	`yaml:"SSHAuthorizedKeysFile"`
+	SSHHostKeyFile 		string 		`yaml:"SSHHostKeyFile"`
+	SSHPasswordAuth 	bool 		`yaml:"SSHPasswordAuth"`
+	SSHPort 			int 		`yaml:"SSHPort"`
+	StoreDirectory 		string 		`yaml:"StoreDirectory"`
+	StoreMemoryLimit 	int 		`yaml:"StoreMemoryLimit"`
+	StoreSegmentSize 	int64 		`yaml:"StoreSegmentSize"`
+	StoreType 			string 		`yaml:"StoreType"`
 	TCPAddress 			string 		`yaml:"TCPAddress"`
+	TCPKeepAlive 		time.Duration `yaml:"TCPKeepAlive"`
 	TCPPort 			int 		`yaml:"TCPPort"`
+	TCPRaw 				bool 		`yaml:"TCPRaw"`
+	TLSCertFile 		string 		`yaml:"TLSCertFile"`
+	TLSClientCAFile 	string 		`yaml:"TLSClientCAFile"`
+	TLSKeyFile 			string 		`yaml:"TLSKeyFile"`
+	TLSMinVersion 		string 		`yaml:"TLSMinVersion"`
+	UserStoreFile 		string 		`yaml:"UserStoreFile"`
+	UserStoreType 		string 		`yaml:"UserStoreType"`
+	WriteTimeout 		time.Duration `yaml:"WriteTimeout"`
+}
+
+// TokenConfig defines an API token of the HTTP listener
+type TokenConfig struct {
+	Scopes 				[]string 	`yaml:"Scopes"`
+	Sender 				string 		`yaml:"Sender"`
+	Token 				string 		`yaml:"Token"`
 }
 
 // NewConfig will create a new Config instance from the specified yaml file
@@ -30,6 +97,32 @@ func NewConfig(yamlFile string) (*Config, error) {
 		return nil, err
 	}
 
+	// Set a default file for the ban list
+	if config.BanFile == "" {
+		config.BanFile = "bans.json"
+	}
+
+	// Set default flood control limits for connected clients
+	if config.FloodBurst == 0 {
+		config.FloodBurst = 10
+	}
+	if config.FloodMuteDuration == 0 {
+		config.FloodMuteDuration = time.Minute
+	}
+	if config.FloodMutes == 0 {
+		config.FloodMutes = 2
+	} else if config.FloodMutes < 0 {
+		config.FloodMutes = 0
+	}
+	if config.FloodRate == 0 {
+		config.FloodRate = 2
+	}
+	if config.FloodWarnings == 0 {
+		config.FloodWarnings = 3
+	} else if config.FloodWarnings < 0 {
+		config.FloodWarnings = 0
+	}
+
 	// Ensure a proper LogLevel was provided
 	if config.LogLevel == "" {
 		config.LogLevel = "info"
@@ -40,15 +133,172 @@ func NewConfig(yamlFile string) (*Config, error) {
 		}
 	}
 
+	// Set a default number of messages to replay to clients joining a room
+	if config.HistorySize == 0 {
+		config.HistorySize = 20
+	}
+
 	// Set a default port for the HTTP listener
 	if config.HTTPPort == 0 {
 		config.HTTPPort = 8080
 	}
 
+	// Set a default rate limit for messages sent via HTTP
+	if config.HTTPRateBurst == 0 {
+		config.HTTPRateBurst = 10
+	}
+	if config.HTTPRateLimit == 0 {
+		config.HTTPRateLimit = 1
+	}
+
+	// Set a default file for the API tokens issued through the HTTP listener
+	if config.HTTPTokensFile == "" {
+		config.HTTPTokensFile = "tokens.json"
+	}
+
+	// Set a default authorized keys file for the SSH listener
+	if config.SSHAuthorizedKeysFile == "" {
+		config.SSHAuthorizedKeysFile = "authorized_keys"
+	}
+
+	// Set a default host key file for the SSH listener
+	if config.SSHHostKeyFile == "" {
+		config.SSHHostKeyFile = "ssh_host_key"
+	}
+
+	// Ensure a valid outbound queue was configured for slow clients
+	if config.QueueSize == 0 {
+		config.QueueSize = tcp.DefaultQueueSize
+	} else if config.QueueSize < 0 {
+		return nil, fmt.Errorf("invalid QueueSize %d, must be greater than 0", config.QueueSize)
+	}
+	switch config.QueueOverflow {
+	case "":
+		config.QueueOverflow = tcp.OverflowDropOldest
+	case tcp.OverflowDropOldest, tcp.OverflowDisconnect:
+	default:
+		return nil, fmt.Errorf("invalid QueueOverflow %q, must be one of: %s, %s", config.QueueOverflow, tcp.OverflowDropOldest, tcp.OverflowDisconnect)
+	}
+
+	// Ensure a valid policy for control characters in the text sent by clients was selected
+	switch config.SanitizePolicy {
+	case "":
+		config.SanitizePolicy = tcp.SanitizeEscape
+	case tcp.SanitizeEscape, tcp.SanitizeReject, tcp.SanitizeStrip:
+	default:
+		return nil, fmt.Errorf("invalid SanitizePolicy %q, must be one of: %s, %s, %s", config.SanitizePolicy, tcp.SanitizeEscape, tcp.SanitizeReject, tcp.SanitizeStrip)
+	}
+
+	// Ensure a valid message store was selected
+	switch config.StoreType {
+	case "":
+		config.StoreType = StoreTypeMemory
+	case StoreTypeMemory, StoreTypeLog:
+	default:
+		return nil, fmt.Errorf("invalid StoreType %q, must be one of: %s, %s", config.StoreType, StoreTypeMemory, StoreTypeLog)
+	}
+
+	// Set a default directory for the log message store
+	if config.StoreDirectory == "" {
+		config.StoreDirectory = "data"
+	}
+
+	// Set a default number of messages to keep in the memory message store
+	if config.StoreMemoryLimit == 0 {
+		config.StoreMemoryLimit = tcp.DefaultMemoryStoreLimit
+	}
+
+	// Set a default size for the segments of the log message store
+	if config.StoreSegmentSize == 0 {
+		config.StoreSegmentSize = tcp.DefaultSegmentSize
+	}
+
 	// Set a default port for the TCP listener
 	if config.TCPPort == 0 {
 		config.TCPPort = 6000
 	}
 
+	// Ensure that TLS is either fully configured or not at all
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLSCertFile and TLSKeyFile must be set together")
+	} else if config.TLSClientCAFile != "" && config.TLSCertFile == "" {
+		return nil, fmt.Errorf("TLSClientCAFile requires TLSCertFile and TLSKeyFile to be set")
+	}
+
+	// Ensure a valid minimum TLS version was selected
+	if config.TLSMinVersion == "" {
+		config.TLSMinVersion = "1.2"
+	} else if _, ok := tlsVersions[config.TLSMinVersion]; !ok {
+		return nil, fmt.Errorf("invalid TLSMinVersion %q, must be one of: 1.0, 1.1, 1.2, 1.3", config.TLSMinVersion)
+	}
+
+	// Ensure a valid user store was selected
+	switch config.UserStoreType {
+	case "":
+		config.UserStoreType = UserStoreTypeFile
+	case UserStoreTypeFile, UserStoreTypeMemory:
+	default:
+		return nil, fmt.Errorf("invalid UserStoreType %q, must be one of: %s, %s", config.UserStoreType, UserStoreTypeFile, UserStoreTypeMemory)
+	}
+
+	// Set a default file for the file user store
+	if config.UserStoreFile == "" {
+		config.UserStoreFile = "users.json"
+	}
+
+	// Idle clients are only disconnected if IdleTimeout is set, a negative value is the same as leaving it unset
+	if config.IdleTimeout < 0 {
+		config.IdleTimeout = 0
+	}
+
+	// Set default limits for clients of the TCP listener, a negative value disables a limit
+	if config.MaxConnections == 0 {
+		config.MaxConnections = tcp.DefaultMaxConnections
+	} else if config.MaxConnections < 0 {
+		config.MaxConnections = 0
+	}
+	if config.MaxConnectionsPerIP == 0 {
+		config.MaxConnectionsPerIP = tcp.DefaultMaxConnectionsPerIP
+	} else if config.MaxConnectionsPerIP < 0 {
+		config.MaxConnectionsPerIP = 0
+	}
+	if config.MaxLineLength == 0 {
+		config.MaxLineLength = tcp.DefaultMaxLineLength
+	} else if config.MaxLineLength < 0 {
+		config.MaxLineLength = 0
+	}
+	if config.MaxNickLength == 0 {
+		config.MaxNickLength = tcp.MaxNickLength
+	} else if config.MaxNickLength < 0 || config.MaxNickLength > tcp.MaxNickLength {
+		return nil, fmt.Errorf("invalid MaxNickLength %d, must be between 1 and %d", config.MaxNickLength, tcp.MaxNickLength)
+	}
+	if config.NameTimeout == 0 {
+		config.NameTimeout = tcp.DefaultNameTimeout
+	} else if config.NameTimeout < 0 {
+		config.NameTimeout = 0
+	}
+
+	// Set defaults for detecting dead TCP clients. Negative values disable TCP keepalive and the pings.
+	if config.TCPKeepAlive == 0 {
+		config.TCPKeepAlive = tcp.DefaultKeepAlive
+	} else if config.TCPKeepAlive < 0 {
+		config.TCPKeepAlive = -1
+	}
+	if config.PingInterval == 0 {
+		config.PingInterval = tcp.DefaultPingInterval
+	} else if config.PingInterval < 0 {
+		config.PingInterval = 0
+	}
+	if config.PingTimeout <= 0 {
+		config.PingTimeout = tcp.DefaultPingTimeout
+	}
+
+	// Set a default time limit for writes to clients, a negative value disables it
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = tcp.DefaultWriteTimeout
+	} else if config.WriteTimeout < 0 {
+		config.WriteTimeout = 0
+	}
+
 	return &config, nil
 }
\ No newline at end of file
@@ -5,10 +5,14 @@ import (
 	"io/ioutil"
 	"fmt"
 	"os"
+	"reflect"
+	"time"
+	"github.com/jwenz723/telchat/tcp"
 )
 
 func TestNewConfig(t *testing.T) {
 	testCases := map[string]struct{
+		eHistorySize int
 		eHTTPAddress string
 		eHTTPPort int
 		eLogDirectory string
@@ -18,21 +22,22 @@ func TestNewConfig(t *testing.T) {
 		eTCPAddress string
 		eTCPPort int
 	} {
-		"default values": {"", 8080, "logs", false, "info", "", "", 6000},
-		"bad log level": {"", 8080, "logs", false, "bad level", "not a valid logrus Level: \"bad level\"", "", 6000},
-		"custom values": {"myhttp", 123, "mylogs", true, "debug", "", "mytcp", 2000},
+		"default values": {20, "", 8080, "logs", false, "info", "", "", 6000},
+		"bad log level": {20, "", 8080, "logs", false, "bad level", "not a valid logrus Level: \"bad level\"", "", 6000},
+		"custom values": {5, "myhttp", 123, "mylogs", true, "debug", "", "mytcp", 2000},
 	}
 
 	for k, v := range testCases {
 		file := "test.yml"
 
-		yml := fmt.Sprintf(`HTTPAddress: %s
+		yml := fmt.Sprintf(`HistorySize: %d
+HTTPAddress: %s
 HTTPPort: %d
 LogDirectory: %s
 LogJSON: %v
 LogLevel: %s
 TCPAddress: %s
-TCPPort: %d`, v.eHTTPAddress, v.eHTTPPort, v.eLogDirectory, v.eLogJSON, v.eLogLevel, v.eTCPAddress, v.eTCPPort)
+TCPPort: %d`, v.eHistorySize, v.eHTTPAddress, v.eHTTPPort, v.eLogDirectory, v.eLogJSON, v.eLogLevel, v.eTCPAddress, v.eTCPPort)
 		ioutil.WriteFile(file, []byte(yml), 0777)
 
 		con, err := NewConfig(file)
@@ -49,6 +54,10 @@ TCPPort: %d`, v.eHTTPAddress, v.eHTTPPort, v.eLogDirectory, v.eLogJSON, v.eLogLe
 		}
 
 		if v.eLogLevelError == "" {
+			if con.HistorySize != v.eHistorySize {
+				t.Errorf("%s: HistorySize expected (%d) differed from actual (%d)", k, v.eHistorySize, con.HistorySize)
+			}
+
 			if con.HTTPAddress != v.eHTTPAddress {
 				t.Errorf("%s: HTTPAddress expected (%s) differed from actual (%s)", k, v.eHTTPAddress, con.HTTPAddress)
 			}
@@ -80,4 +89,339 @@ TCPPort: %d`, v.eHTTPAddress, v.eHTTPPort, v.eLogDirectory, v.eLogJSON, v.eLogLe
 
 		os.Remove(file)
 	}
-}
\ No newline at end of file
+}
+func TestNewConfig_Store(t *testing.T) {
+	testCases := map[string]struct{
+		yml string
+		eStoreType string
+		eStoreDirectory string
+		eStoreMemoryLimit int
+		eError string
+	} {
+		"default values": {"", StoreTypeMemory, "data", tcp.DefaultMemoryStoreLimit, ""},
+		"custom values": {"StoreType: log\nStoreDirectory: mydata\nStoreMemoryLimit: 5", StoreTypeLog, "mydata", 5, ""},
+		"bad store type": {"StoreType: sql", "", "", 0, "invalid StoreType \"sql\", must be one of: memory, log"},
+	}
+
+	for k, v := range testCases {
+		file := "test.yml"
+		ioutil.WriteFile(file, []byte(v.yml), 0777)
+
+		con, err := NewConfig(file)
+		os.Remove(file)
+		if v.eError != "" {
+			if err == nil || err.Error() != v.eError {
+				t.Errorf("%s: NewConfig expected error does not match actual error.\n\tExpected: %s\n\tActual: %v", k, v.eError, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: NewConfig failed to process file %s -> %s", k, file, err)
+			continue
+		}
+
+		if con.StoreType != v.eStoreType {
+			t.Errorf("%s: StoreType expected (%s) differed from actual (%s)", k, v.eStoreType, con.StoreType)
+		}
+
+		if con.StoreDirectory != v.eStoreDirectory {
+			t.Errorf("%s: StoreDirectory expected (%s) differed from actual (%s)", k, v.eStoreDirectory, con.StoreDirectory)
+		}
+
+		if con.StoreMemoryLimit != v.eStoreMemoryLimit {
+			t.Errorf("%s: StoreMemoryLimit expected (%d) differed from actual (%d)", k, v.eStoreMemoryLimit, con.StoreMemoryLimit)
+		}
+	}
+}
+
+func TestNewConfig_HTTPTokens(t *testing.T) {
+	file := "test.yml"
+	yml := "HTTPRequireTokens: true\nHTTPTokens:\n  - Token: 0123456789abcdef\n    Sender: ci\n    Scopes: [post, read]\n"
+	ioutil.WriteFile(file, []byte(yml), 0777)
+	defer os.Remove(file)
+
+	con, err := NewConfig(file)
+	if err != nil {
+		t.Fatalf("NewConfig failed to process file %s -> %s", file, err)
+	}
+	if !con.HTTPRequireTokens {
+		t.Errorf("HTTPRequireTokens expected (true) differed from actual (false)")
+	}
+	if con.HTTPTokensFile != "tokens.json" {
+		t.Errorf("HTTPTokensFile expected (tokens.json) differed from actual (%s)", con.HTTPTokensFile)
+	}
+	e := []TokenConfig{{Scopes: []string{"post", "read"}, Sender: "ci", Token: "0123456789abcdef"}}
+	if !reflect.DeepEqual(con.HTTPTokens, e) {
+		t.Errorf("HTTPTokens expected (%#v) differed from actual (%#v)", e, con.HTTPTokens)
+	}
+}
+
+func TestNewConfig_Moderation(t *testing.T) {
+	file := "test.yml"
+	yml := "Admins: [alice, bob]\n"
+	ioutil.WriteFile(file, []byte(yml), 0777)
+	defer os.Remove(file)
+
+	con, err := NewConfig(file)
+	if err != nil {
+		t.Fatalf("NewConfig failed to process file %s -> %s", file, err)
+	}
+	if e := []string{"alice", "bob"}; !reflect.DeepEqual(con.Admins, e) {
+		t.Errorf("Admins expected (%v) differed from actual (%v)", e, con.Admins)
+	}
+	if con.BanFile != "bans.json" {
+		t.Errorf("BanFile expected (bans.json) differed from actual (%s)", con.BanFile)
+	}
+}
+
+func TestNewConfig_Flood(t *testing.T) {
+	testCases := map[string]struct{
+		yml string
+		eFloodControl [5]interface{} // FloodRate, FloodBurst, FloodWarnings, FloodMuteDuration, FloodMutes
+		eHTTPRateLimit float64
+		eHTTPRateBurst int
+	} {
+		"default values": {"", [5]interface{}{2.0, 10, 3, time.Minute, 2}, 1, 10},
+		"custom values": {"FloodRate: 0.5\nFloodBurst: 3\nFloodWarnings: 1\nFloodMuteDuration: 5m\nFloodMutes: 4\nHTTPRateLimit: 10\nHTTPRateBurst: 20", [5]interface{}{0.5, 3, 1, 5 * time.Minute, 4}, 10, 20},
+		"disabled": {"FloodRate: -1\nFloodWarnings: -1\nFloodMutes: -1\nHTTPRateLimit: -1", [5]interface{}{-1.0, 10, 0, time.Minute, 0}, -1, 10},
+	}
+
+	for k, v := range testCases {
+		file := "test.yml"
+		ioutil.WriteFile(file, []byte(v.yml), 0777)
+
+		con, err := NewConfig(file)
+		os.Remove(file)
+		if err != nil {
+			t.Errorf("%s: NewConfig failed to process file %s -> %s", k, file, err)
+			continue
+		}
+
+		a := [5]interface{}{con.FloodRate, con.FloodBurst, con.FloodWarnings, con.FloodMuteDuration, con.FloodMutes}
+		if a != v.eFloodControl {
+			t.Errorf("%s: flood control expected (%v) differed from actual (%v)", k, v.eFloodControl, a)
+		}
+
+		if con.HTTPRateLimit != v.eHTTPRateLimit || con.HTTPRateBurst != v.eHTTPRateBurst {
+			t.Errorf("%s: HTTP rate limit expected (%v, %d) differed from actual (%v, %d)", k, v.eHTTPRateLimit, v.eHTTPRateBurst, con.HTTPRateLimit, con.HTTPRateBurst)
+		}
+	}
+}
+
+func TestNewConfig_Queue(t *testing.T) {
+	testCases := map[string]struct{
+		yml string
+		eQueueSize int
+		eQueueOverflow string
+		eWriteTimeout time.Duration
+		eError string
+	} {
+		"default values": {"", 256, "drop-oldest", 10 * time.Second, ""},
+		"custom values": {"QueueSize: 16\nQueueOverflow: disconnect\nWriteTimeout: 30s", 16, "disconnect", 30 * time.Second, ""},
+		"no write timeout": {"WriteTimeout: -1s", 256, "drop-oldest", 0, ""},
+		"bad queue size": {"QueueSize: -1", 0, "", 0, "invalid QueueSize -1, must be greater than 0"},
+		"bad overflow policy": {"QueueOverflow: block", 0, "", 0, "invalid QueueOverflow \"block\", must be one of: drop-oldest, disconnect"},
+	}
+
+	for k, v := range testCases {
+		file := "test.yml"
+		ioutil.WriteFile(file, []byte(v.yml), 0777)
+
+		con, err := NewConfig(file)
+		os.Remove(file)
+		if v.eError != "" {
+			if err == nil || err.Error() != v.eError {
+				t.Errorf("%s: NewConfig expected error does not match actual error.\n\tExpected: %s\n\tActual: %v", k, v.eError, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: NewConfig failed to process file %s -> %s", k, file, err)
+			continue
+		}
+
+		if con.QueueSize != v.eQueueSize || con.QueueOverflow != v.eQueueOverflow || con.WriteTimeout != v.eWriteTimeout {
+			t.Errorf("%s: queue expected (%d, %s, %v) differed from actual (%d, %s, %v)", k, v.eQueueSize, v.eQueueOverflow, v.eWriteTimeout, con.QueueSize, con.QueueOverflow, con.WriteTimeout)
+		}
+	}
+}
+
+func TestNewConfig_SanitizePolicy(t *testing.T) {
+	testCases := map[string]struct{
+		yml string
+		eSanitizePolicy string
+		eError string
+	} {
+		"default value": {"", "escape", ""},
+		"custom value": {"SanitizePolicy: reject", "reject", ""},
+		"bad policy": {"SanitizePolicy: allow", "", "invalid SanitizePolicy \"allow\", must be one of: escape, reject, strip"},
+	}
+
+	for k, v := range testCases {
+		file := "test.yml"
+		ioutil.WriteFile(file, []byte(v.yml), 0777)
+
+		con, err := NewConfig(file)
+		os.Remove(file)
+		if v.eError != "" {
+			if err == nil || err.Error() != v.eError {
+				t.Errorf("%s: NewConfig expected error does not match actual error.\n\tExpected: %s\n\tActual: %v", k, v.eError, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: NewConfig failed to process file %s -> %s", k, file, err)
+			continue
+		}
+
+		if con.SanitizePolicy != v.eSanitizePolicy {
+			t.Errorf("%s: SanitizePolicy expected (%s) differed from actual (%s)", k, v.eSanitizePolicy, con.SanitizePolicy)
+		}
+	}
+}
+
+func TestNewConfig_Limits(t *testing.T) {
+	testCases := map[string]struct{
+		yml string
+		eIdleTimeout time.Duration
+		eMaxConnections int
+		eMaxConnectionsPerIP int
+		eMaxLineLength int
+		eMaxNickLength int
+		eNameTimeout time.Duration
+		eError string
+	} {
+		"default values": {"", 0, 1024, 16, 4096, 32, time.Minute, ""},
+		"custom values": {"IdleTimeout: 1h\nMaxConnections: 100\nMaxConnectionsPerIP: 2\nMaxLineLength: 512\nMaxNickLength: 16\nNameTimeout: 10s", time.Hour, 100, 2, 512, 16, 10 * time.Second, ""},
+		"disabled": {"IdleTimeout: -1s\nMaxConnections: -1\nMaxConnectionsPerIP: -1\nMaxLineLength: -1\nNameTimeout: -1s", 0, 0, 0, 0, 32, 0, ""},
+		"bad nick length": {"MaxNickLength: 64", 0, 0, 0, 0, 0, 0, "invalid MaxNickLength 64, must be between 1 and 32"},
+	}
+
+	for k, v := range testCases {
+		file := "test.yml"
+		ioutil.WriteFile(file, []byte(v.yml), 0777)
+
+		con, err := NewConfig(file)
+		os.Remove(file)
+		if v.eError != "" {
+			if err == nil || err.Error() != v.eError {
+				t.Errorf("%s: NewConfig expected error does not match actual error.\n\tExpected: %s\n\tActual: %v", k, v.eError, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: NewConfig failed to process file %s -> %s", k, file, err)
+			continue
+		}
+
+		if con.IdleTimeout != v.eIdleTimeout || con.MaxConnections != v.eMaxConnections || con.MaxConnectionsPerIP != v.eMaxConnectionsPerIP {
+			t.Errorf("%s: connection limits expected (%v, %d, %d) differed from actual (%v, %d, %d)", k, v.eIdleTimeout, v.eMaxConnections, v.eMaxConnectionsPerIP, con.IdleTimeout, con.MaxConnections, con.MaxConnectionsPerIP)
+		}
+		if con.MaxLineLength != v.eMaxLineLength || con.MaxNickLength != v.eMaxNickLength || con.NameTimeout != v.eNameTimeout {
+			t.Errorf("%s: input limits expected (%d, %d, %v) differed from actual (%d, %d, %v)", k, v.eMaxLineLength, v.eMaxNickLength, v.eNameTimeout, con.MaxLineLength, con.MaxNickLength, con.NameTimeout)
+		}
+	}
+}
+
+func TestNewConfig_KeepAlive(t *testing.T) {
+	testCases := map[string]struct{
+		yml string
+		eTCPKeepAlive time.Duration
+		ePingInterval time.Duration
+		ePingTimeout time.Duration
+	} {
+		"default values": {"", 30 * time.Second, time.Minute, 30 * time.Second},
+		"custom values": {"TCPKeepAlive: 10s\nPingInterval: 5m\nPingTimeout: 1m", 10 * time.Second, 5 * time.Minute, time.Minute},
+		"disabled": {"TCPKeepAlive: -1s\nPingInterval: -1s\nPingTimeout: -1s", -1, 0, 30 * time.Second},
+	}
+
+	for k, v := range testCases {
+		file := "test.yml"
+		ioutil.WriteFile(file, []byte(v.yml), 0777)
+
+		con, err := NewConfig(file)
+		os.Remove(file)
+		if err != nil {
+			t.Errorf("%s: NewConfig failed to process file %s -> %s", k, file, err)
+			continue
+		}
+
+		if con.TCPKeepAlive != v.eTCPKeepAlive || con.PingInterval != v.ePingInterval || con.PingTimeout != v.ePingTimeout {
+			t.Errorf("%s: keepalive expected (%v, %v, %v) differed from actual (%v, %v, %v)", k, v.eTCPKeepAlive, v.ePingInterval, v.ePingTimeout, con.TCPKeepAlive, con.PingInterval, con.PingTimeout)
+		}
+	}
+}
+
+func TestNewConfig_Users(t *testing.T) {
+	testCases := map[string]struct{
+		yml string
+		eAccountsOnly bool
+		eUserStoreType string
+		eUserStoreFile string
+		eError string
+	} {
+		"default values": {"", false, UserStoreTypeFile, "users.json", ""},
+		"custom values": {"AccountsOnly: true\nUserStoreType: memory\nUserStoreFile: accounts.json", true, UserStoreTypeMemory, "accounts.json", ""},
+		"bad store type": {"UserStoreType: ldap", false, "", "", "invalid UserStoreType \"ldap\", must be one of: file, memory"},
+	}
+
+	for k, v := range testCases {
+		file := "test.yml"
+		ioutil.WriteFile(file, []byte(v.yml), 0777)
+
+		con, err := NewConfig(file)
+		os.Remove(file)
+		if v.eError != "" {
+			if err == nil || err.Error() != v.eError {
+				t.Errorf("%s: NewConfig expected error does not match actual error.\n\tExpected: %s\n\tActual: %v", k, v.eError, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: NewConfig failed to process file %s -> %s", k, file, err)
+			continue
+		}
+
+		if con.AccountsOnly != v.eAccountsOnly {
+			t.Errorf("%s: AccountsOnly expected (%v) differed from actual (%v)", k, v.eAccountsOnly, con.AccountsOnly)
+		}
+
+		if con.UserStoreType != v.eUserStoreType {
+			t.Errorf("%s: UserStoreType expected (%s) differed from actual (%s)", k, v.eUserStoreType, con.UserStoreType)
+		}
+
+		if con.UserStoreFile != v.eUserStoreFile {
+			t.Errorf("%s: UserStoreFile expected (%s) differed from actual (%s)", k, v.eUserStoreFile, con.UserStoreFile)
+		}
+	}
+}
+
+func TestNewConfig_TLS(t *testing.T) {
+	testCases := map[string]struct{
+		yml string
+		eTLSMinVersion string
+		eError string
+	} {
+		"default values": {"", "1.2", ""},
+		"custom values": {"TLSCertFile: cert.pem\nTLSKeyFile: key.pem\nTLSClientCAFile: ca.pem\nTLSMinVersion: \"1.3\"", "1.3", ""},
+		"missing key": {"TLSCertFile: cert.pem", "", "TLSCertFile and TLSKeyFile must be set together"},
+		"client CA without cert": {"TLSClientCAFile: ca.pem", "", "TLSClientCAFile requires TLSCertFile and TLSKeyFile to be set"},
+		"bad min version": {"TLSMinVersion: \"2.0\"", "", "invalid TLSMinVersion \"2.0\", must be one of: 1.0, 1.1, 1.2, 1.3"},
+	}
+
+	for k, v := range testCases {
+		file := "test.yml"
+		ioutil.WriteFile(file, []byte(v.yml), 0777)
+
+		con, err := NewConfig(file)
+		os.Remove(file)
+		if v.eError != "" {
+			if err == nil || err.Error() != v.eError {
+				t.Errorf("%s: NewConfig expected error does not match actual error.\n\tExpected: %s\n\tActual: %v", k, v.eError, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: NewConfig failed to process file %s -> %s", k, file, err)
+			continue
+		}
+
+		if con.TLSMinVersion != v.eTLSMinVersion {
+			t.Errorf("%s: TLSMinVersion expected (%s) differed from actual (%s)", k, v.eTLSMinVersion, con.TLSMinVersion)
+		}
+	}
+}
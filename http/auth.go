@@ -0,0 +1,86 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// authenticateName will check whether the request r may use name. Requests may log into the account of name using
+// HTTP basic authentication, which is required if name is registered or if the hub only accepts accounts. account
+// reports whether the request is logged into the account. If err is set, status is the HTTP status code to reply with.
+func (h *Handler) authenticateName(r *http.Request, name string) (account bool, status int, err error) {
+	user, password, ok := r.BasicAuth()
+	if ok {
+		if !strings.EqualFold(user, name) {
+			return false, http.StatusForbidden, fmt.Errorf("logged in as %s, which can't send as %s", user, name)
+		} else if err := h.hub.Authenticate(name, password); err != nil {
+			return false, http.StatusUnauthorized, fmt.Errorf("invalid credentials for %s", name)
+		}
+		return true, 0, nil
+	}
+
+	if h.hub.IsRegistered(name) {
+		return false, http.StatusUnauthorized, fmt.Errorf("the name %s is registered, log in with its password", name)
+	} else if h.hub.AccountsOnly {
+		return false, http.StatusUnauthorized, fmt.Errorf("only registered accounts are accepted, log in with your password")
+	}
+	return false, 0, nil
+}
+
+// bearerToken returns the API token sent with r. Clients that can't set headers (e.g. EventSource in browsers) can
+// send the token using the access_token query parameter.
+func bearerToken(r *http.Request) (string, bool) {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:]), true
+	} else if token := r.URL.Query().Get("access_token"); token != "" {
+		return token, true
+	}
+	return "", false
+}
+
+// authorize will check that the API token sent with r grants scope. A token is always required for the admin scope,
+// and for every scope if h.RequireTokens is set. token is nil if no token was sent. If ok is false a 401 or 403 has
+// been sent to the client.
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request, scope string) (token *Token, ok bool) {
+	secret, found := bearerToken(r)
+	if !found {
+		if h.RequireTokens || scope == ScopeAdmin {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="telchat"`)
+			http.Error(w, "an API token is required", http.StatusUnauthorized)
+			return nil, false
+		}
+		return nil, true
+	}
+
+	token = h.Tokens.Lookup(secret)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="telchat", error="invalid_token"`)
+		http.Error(w, "invalid API token", http.StatusUnauthorized)
+		h.logger.WithField("address.remote", r.RemoteAddr).Warn("request with invalid API token")
+		return nil, false
+	} else if !token.HasScope(scope) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="telchat", error="insufficient_scope", scope=%q`, scope))
+		http.Error(w, fmt.Sprintf("the API token doesn't grant the %s scope", scope), http.StatusForbidden)
+		return nil, false
+	}
+	return token, true
+}
+
+// requestIP returns the IP address that r was sent from, or nil if it is unknown
+func requestIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// unauthorized replies to a request that failed authenticateName
+func unauthorized(w http.ResponseWriter, status int, err error) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="telchat"`)
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -1,39 +1,63 @@
 package http
 
 import (
+	"crypto/tls"
+	"errors"
 	"github.com/sirupsen/logrus"
 	"net/http"
 	"github.com/julienschmidt/httprouter"
 	"encoding/json"
 	"fmt"
 	"net"
+	"strings"
+	"time"
 	"github.com/jwenz723/telchat/tcp"
 )
 
 // Handler serves the HTTP endpoints of the listener
 type Handler struct {
 	address        string
+	closed         chan struct{} // closed once the listener has stopped, which ends all long running requests
 	done           chan struct{}
+	heartbeatInterval time.Duration // how often a heartbeat is sent to idle GET /stream clients
+	hub            *tcp.Handler
 	logger         *logrus.Logger
 	messages       chan tcp.Message
 	port           int
+	RateLimiter    *tcp.RateLimiter // limits POST /message per API token, or per IP address without a token. nil disables the limit
 	Ready          bool // Indicates that the http listener is ready to accept connections
+	RequireTokens  bool // require an API token for sending and reading messages, not only for the admin endpoints
 	router         *httprouter.Router
 	startDone	   func() // a callback that can be defined to do something once Start() has done all its work
+	TLSConfig      *tls.Config // serve HTTPS instead of HTTP when set
+	Tokens         *TokenStore // the API tokens that are accepted
 }
 
-// New initializes a new http Handler
-func New(address string, port int, messages chan tcp.Message, logger *logrus.Logger) *Handler {
+// New initializes a new http Handler that delivers messages to the clients of hub
+func New(address string, port int, hub *tcp.Handler, logger *logrus.Logger) *Handler {
 	h := &Handler{
 		address:		address,
+		closed:			make(chan struct{}),
 		done:			make(chan struct{}),
+		heartbeatInterval: DefaultHeartbeatInterval,
+		hub:			hub,
 		logger:      	logger,
-		messages: 	 	messages,
+		messages: 	 	hub.Messages(),
 		port:			port,
 		router: 		httprouter.New(),
+		Tokens:			NewTokenStore(),
 	}
 
+	h.router.GET("/", h.index)
 	h.router.POST("/message", h.message)
+	h.router.GET("/messages", h.listMessages)
+	h.router.GET("/rooms", h.listRooms)
+	h.router.GET("/stats", h.stats)
+	h.router.GET("/stream", h.stream)
+	h.router.GET("/tokens", h.listTokens)
+	h.router.POST("/tokens", h.issueToken)
+	h.router.DELETE("/tokens/:id", h.revokeToken)
+	h.router.GET("/ws", h.websocketChat)
 
 	return h
 }
@@ -42,12 +66,16 @@ func New(address string, port int, messages chan tcp.Message, logger *logrus.Log
 func (h *Handler) Start() error {
 	defer func() {
 		h.Ready = false
+		close(h.closed)
 		close(h.done)
 	}()
 	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", h.address, h.port))
 	if err != nil {
 		return err
 	}
+	if h.TLSConfig != nil {
+		listener = tls.NewListener(listener, h.TLSConfig)
+	}
 
 	errCh := make(chan error)
 	go func() {
@@ -57,6 +85,7 @@ func (h *Handler) Start() error {
 	h.Ready = true
 	h.logger.WithFields(logrus.Fields{
 		"address": listener.Addr(),
+		"tls": h.TLSConfig != nil,
 	}).Info("HTTP listener accepting connections")
 
 	if h.startDone != nil {
@@ -86,19 +115,102 @@ func (h *Handler) Stop() {
 	}
 }
 
+// messageBodyLimit is the maximum size in bytes of a POST /message body in addition to the maximum length of its
+// message, larger bodies are refused
+const messageBodyLimit = 64 * 1024
+
 // message is a handler for the /messages endpoint used to send all incoming messages to the h.messages channel
 func (h *Handler) message(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	dec := json.NewDecoder(r.Body)
+	// the API token is always checked, basic authentication only logs into the account of the sender
+	token, ok := h.authorize(w, r, ScopePost)
+	if !ok {
+		return
+	}
+	if !h.allow(w, r, token) {
+		return
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, messageBodyLimit + int64(h.hub.MaxLineLength)))
 	var m tcp.Message
-	err := dec.Decode(&m)
-	if err != nil {
-		panic(err)
+	if err := dec.Decode(&m); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("the request body can't be larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+		}
+		return
+	} else if err := h.hub.CheckLength(m.Message); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// HTTP senders can't use the name of a connected client, and their messages are tagged as coming from HTTP so
+	// that they can't impersonate anyone
+	m.Source = tcp.SourceHTTP
+	m.Kind = ""
+	m.Replay = false
+	if token != nil {
+		// a token is bound to its sender
+		if m.Sender != "" && !strings.EqualFold(m.Sender, token.Sender) {
+			http.Error(w, fmt.Sprintf("the API token can only send as %s", token.Sender), http.StatusForbidden)
+			return
+		}
+		m.Sender = token.Sender
+	}
+	if err := tcp.ValidateNick(m.Sender); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err := tcp.ValidateMeta(m.Meta); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err := h.hub.CheckText(m.Message); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if h.hub.IsOnline(m.Sender) {
+		http.Error(w, fmt.Sprintf("the name %s is in use by a connected client", m.Sender), http.StatusConflict)
+		return
+	}
+	loggedIn, status, err := h.authenticateName(r, m.Sender)
+	if token == nil && err != nil {
+		unauthorized(w, status, err)
+		return
+	}
+
+	// banned and muted senders can't post either
+	account := ""
+	if loggedIn {
+		account = m.Sender
+	}
+	if err := h.hub.CheckBan(m.Sender, account, requestIP(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err := h.hub.CheckMute(m.Sender); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if m.Recipient != "" {
+		if !h.hub.IsOnline(m.Recipient) {
+			http.Error(w, fmt.Sprintf("%s is not online", m.Recipient), http.StatusNotFound)
+			return
+		}
+		m.Room = ""
+	} else if m.Room != "" {
+		room, err := tcp.NormalizeRoom(m.Room)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.Room = room
 	}
 
 	h.messages <- m
 	fmt.Fprintln(w, "sent")
 	h.logger.WithFields(logrus.Fields{
 		"message": m.Message,
+		"recipient": m.Recipient,
+		"room": m.Room,
 		"sender": m.Sender,
 	}).Info("received message via http POST")
 }
@@ -11,6 +11,10 @@ import (
 	"encoding/json"
 	"net"
 	"github.com/jwenz723/telchat/tcp"
+	"strconv"
+	"net/http/httptest"
+	"strings"
+	"reflect"
 )
 
 func TestNew(t *testing.T) {
@@ -19,7 +23,7 @@ func TestNew(t *testing.T) {
 	logger, _ := test.NewNullLogger()
 
 	th := tcp.New("", 6000, logger)
-	h := New(address, port, th.Messages(), logger)
+	h := New(address, port, th, logger)
 
 	if h == nil {
 		t.Errorf("received null handler from New()")
@@ -31,8 +35,8 @@ func TestHandler_Start(t *testing.T) {
 	port := 8080
 	logger, _ := test.NewNullLogger()
 	th := tcp.New("", 6000, logger)
-	h := New(address, port, th.Messages(), logger)
-	mes := tcp.Message{"in TestHandler_Start()","my name"}
+	h := New(address, port, th, logger)
+	mes := tcp.Message{Message: "in TestHandler_Start()", Sender: "my name"}
 	j, err := json.Marshal(mes)
 	if err != nil {
 		t.Errorf("failed to marshal Message (%#v) to JSON -> %s", mes, err)
@@ -53,14 +57,14 @@ func TestHandler_Start(t *testing.T) {
 		err = h.Start()
 		if err != nil {
 			eCh <- struct{}{}
-			t.Fatalf("failed to start HTTP listener at %s:%d -> %s", address, port, err)
+			t.Errorf("failed to start HTTP listener at %s:%d -> %s", address, port, err)
 		}
 	}()
 
 	// wait until h.Start() has completed or experienced an error
 	select {
 	case <-done:
-		conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", address, port))
+		conn, err := net.Dial("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
 		if err == nil {
 			conn.Close()
 			if !h.Ready {
@@ -117,8 +121,8 @@ func TestHandler_Stop(t *testing.T) {
 	port := 8081
 	logger, _ := test.NewNullLogger()
 	th := tcp.New("", 6000, logger)
-	h := New(address, port, th.Messages(), logger)
-	mes := tcp.Message{"in TestHandler_Stop()","my name"}
+	h := New(address, port, th, logger)
+	mes := tcp.Message{Message: "in TestHandler_Stop()", Sender: "my name"}
 	j, err := json.Marshal(mes)
 	if err != nil {
 		t.Errorf("failed to marshal Message (%#v) to JSON -> %s", mes, err)
@@ -138,7 +142,7 @@ func TestHandler_Stop(t *testing.T) {
 		err = h.Start()
 		if err != nil {
 			close(eCh)
-			t.Fatalf("failed to start HTTP listener at %s:%d -> %s", address, port, err)
+			t.Errorf("failed to start HTTP listener at %s:%d -> %s", address, port, err)
 		}
 	}()
 
@@ -167,4 +171,74 @@ func TestHandler_Stop(t *testing.T) {
 		}
 	case <-eCh:
 	}
-}
\ No newline at end of file
+}
+func TestHandler_message(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	th := tcp.New("", 6000, logger)
+	th.MaxLineLength = 100
+	h := New("", 8080, th, logger)
+	if err := th.Register("ci", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	th.Bans.Add(tcp.Ban{Kind: tcp.BanNick, Value: "spammer"})
+	th.Mute("troll", time.Time{})
+
+	testCases := map[string]struct {
+		body     string
+		user     string // logs in using basic authentication when set
+		password string
+		eCode    int
+		eMessage *tcp.Message
+	}{
+		"lobby":             {`{"sender":"bot","message":"hi"}`, "", "", http.StatusOK, &tcp.Message{Message: "hi", Sender: "bot", Source: tcp.SourceHTTP}},
+		"room":              {`{"sender":"bot","message":"hi","room":"#Ops"}`, "", "", http.StatusOK, &tcp.Message{Message: "hi", Room: "ops", Sender: "bot", Source: tcp.SourceHTTP}},
+		"spoofed source":    {`{"sender":"bot","message":"hi","source":"tcp"}`, "", "", http.StatusOK, &tcp.Message{Message: "hi", Sender: "bot", Source: tcp.SourceHTTP}},
+		"invalid sender":    {`{"sender":"bot (via http)","message":"hi"}`, "", "", http.StatusBadRequest, nil},
+		"invalid room":      {`{"sender":"bot","message":"hi","room":"on call"}`, "", "", http.StatusBadRequest, nil},
+		"offline recipient": {`{"sender":"bot","message":"hi","recipient":"bob"}`, "", "", http.StatusNotFound, nil},
+		"registered sender": {`{"sender":"CI","message":"hi"}`, "", "", http.StatusUnauthorized, nil},
+		"account":           {`{"sender":"ci","message":"hi"}`, "ci", "correct horse", http.StatusOK, &tcp.Message{Message: "hi", Sender: "ci", Source: tcp.SourceHTTP}},
+		"wrong password":    {`{"sender":"ci","message":"hi"}`, "ci", "wrong", http.StatusUnauthorized, nil},
+		"other account":     {`{"sender":"bot","message":"hi"}`, "ci", "correct horse", http.StatusForbidden, nil},
+		"banned sender":     {`{"sender":"Spammer","message":"hi"}`, "", "", http.StatusForbidden, nil},
+		"muted sender":      {`{"sender":"troll","message":"hi"}`, "", "", http.StatusForbidden, nil},
+		"metadata":          {`{"sender":"bot","message":"hi","meta":{"build":"42"}}`, "", "", http.StatusOK, &tcp.Message{Message: "hi", Meta: map[string]string{"build": "42"}, Sender: "bot", Source: tcp.SourceHTTP}},
+		"invalid metadata":  {`{"sender":"bot","message":"hi","meta":{"":"42"}}`, "", "", http.StatusBadRequest, nil},
+		"escape sequence":   {`{"sender":"bot","message":"\u001b[2Jhi"}`, "", "", http.StatusOK, &tcp.Message{Message: "\x1b[2Jhi", Sender: "bot", Source: tcp.SourceHTTP}},
+		"invalid json":      {`{"sender":"bot","message":`, "", "", http.StatusBadRequest, nil},
+		"long message":      {`{"sender":"bot","message":"` + strings.Repeat("a", 101) + `"}`, "", "", http.StatusRequestEntityTooLarge, nil},
+		"large body":        {`{"sender":"bot","message":"hi","meta":{"padding":"` + strings.Repeat("a", 70*1024) + `"}}`, "", "", http.StatusRequestEntityTooLarge, nil},
+	}
+
+	for k, v := range testCases {
+		// h.messages is buffered, so the handler doesn't block while sending a single Message
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/message", strings.NewReader(v.body))
+		if v.user != "" {
+			r.SetBasicAuth(v.user, v.password)
+		}
+		h.router.ServeHTTP(w, r)
+		if w.Code != v.eCode {
+			t.Errorf("%s: expected status code (%d) did not match actual status code (%d)", k, v.eCode, w.Code)
+		}
+
+		if v.eMessage != nil {
+			select {
+			case m := <-h.messages:
+				if !reflect.DeepEqual(m, *v.eMessage) {
+					t.Errorf("%s: expected Message (%#v) did not match actual Message (%#v)", k, *v.eMessage, m)
+				}
+			case <-time.After(1 * time.Second):
+				t.Errorf("%s: failed to receive Message from messages channel", k)
+			}
+		}
+	}
+
+	// control characters are escaped by the hub before the message is broadcast, unless they are rejected
+	th.SanitizePolicy = tcp.SanitizeReject
+	w := httptest.NewRecorder()
+	h.router.ServeHTTP(w, httptest.NewRequest("POST", "/message", strings.NewReader(`{"sender":"bot","message":"\u001b[2Jhi"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code (%d) did not match actual status code (%d)", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,113 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultPageSize is the number of messages returned by GET /messages when no limit is specified
+	DefaultPageSize = 50
+
+	// MaxPageSize is the maximum number of messages that can be returned by a single GET /messages request
+	MaxPageSize = 1000
+)
+
+// messagePage is the response body of GET /messages
+type messagePage struct {
+	Messages []tcp.Message `json:"messages"`
+
+	// More indicates that more messages are available in the direction that was paged, i.e. newer messages when
+	// since was provided and older messages otherwise
+	More bool `json:"more"`
+
+	// NextBefore can be provided as the before parameter to retrieve the page of messages preceding this one
+	NextBefore uint64 `json:"next_before,omitempty"`
+
+	// NextSince can be provided as the since parameter to retrieve the messages following this page
+	NextSince uint64 `json:"next_since"`
+}
+
+// listMessages is a handler for the GET /messages endpoint used to read the message history. The query parameters
+// since and before are message IDs that restrict the result to newer or older messages, limit sets the page size and
+// room restricts the result to a single room. The oldest messages following since are returned when since is
+// provided, otherwise the newest messages are returned.
+func (h *Handler) listMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if _, ok := h.authorize(w, r, ScopeRead); !ok {
+		return
+	}
+
+	params := r.URL.Query()
+	q := tcp.Query{Limit: DefaultPageSize}
+
+	var err error
+	if v := params.Get("since"); v != "" {
+		q.Oldest = true
+		if q.After, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid since %q: must be a message ID", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("before"); v != "" {
+		if q.Before, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid before %q: must be a message ID", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > MaxPageSize {
+			http.Error(w, fmt.Sprintf("invalid limit %q: must be between 1 and %d", v, MaxPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("room"); v != "" {
+		if q.Room, err = tcp.NormalizeRoom(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// one additional message is requested to find out whether there are more messages than fit on the page
+	limit := q.Limit
+	q.Limit++
+	messages, err := h.hub.Store.Query(q)
+	if err != nil {
+		h.logger.WithField("error", err).Error("error querying message store")
+		http.Error(w, "error reading messages", http.StatusInternalServerError)
+		return
+	}
+
+	page := messagePage{Messages: messages, NextSince: q.After}
+	if len(messages) > limit {
+		page.More = true
+		if !q.Oldest {
+			page.Messages = messages[1:]
+		} else {
+			page.Messages = messages[:limit]
+		}
+	}
+	if page.Messages == nil {
+		page.Messages = []tcp.Message{}
+	}
+	if n := len(page.Messages); n > 0 {
+		page.NextBefore = page.Messages[0].ID
+		page.NextSince = page.Messages[n-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		h.logger.WithField("error", err).Debug("error writing messages response")
+	}
+	h.logger.WithFields(logrus.Fields{
+		"before": q.Before,
+		"count":  len(page.Messages),
+		"room":   q.Room,
+		"since":  q.After,
+	}).Debug("listed messages via http GET")
+}
@@ -0,0 +1,83 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestHandler_listMessages(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	th := tcp.New("", 6000, logger)
+	h := New("", 8080, th, logger)
+	for _, m := range []tcp.Message{
+		{Message: "one", Room: "lobby", Sender: "alice"},
+		{Message: "two", Room: "ops", Sender: "alice"},
+		{Message: "secret", Recipient: "bob", Sender: "alice"},
+		{Message: "three", Room: "lobby", Sender: "bob"},
+		{Message: "four", Room: "lobby", Sender: "carol"},
+	} {
+		th.Store.Append(m)
+	}
+
+	testCases := map[string]struct {
+		query       string
+		eCode       int
+		eIDs        []uint64
+		eMore       bool
+		eNextBefore uint64
+		eNextSince  uint64
+	}{
+		"newest":          {"", http.StatusOK, []uint64{1, 2, 4, 5}, false, 1, 5},
+		"room":            {"?room=%23Ops", http.StatusOK, []uint64{2}, false, 2, 2},
+		"newest page":     {"?limit=2", http.StatusOK, []uint64{4, 5}, true, 4, 5},
+		"older page":      {"?limit=2&before=4", http.StatusOK, []uint64{1, 2}, false, 1, 2},
+		"since":           {"?since=1&limit=2", http.StatusOK, []uint64{2, 4}, true, 2, 4},
+		"since start":     {"?since=0&limit=1", http.StatusOK, []uint64{1}, true, 1, 1},
+		"nothing new":     {"?since=5", http.StatusOK, []uint64{}, false, 0, 5},
+		"invalid since":   {"?since=abc", http.StatusBadRequest, nil, false, 0, 0},
+		"invalid before":  {"?before=-1", http.StatusBadRequest, nil, false, 0, 0},
+		"invalid limit":   {"?limit=0", http.StatusBadRequest, nil, false, 0, 0},
+		"limit too large": {"?limit=1001", http.StatusBadRequest, nil, false, 0, 0},
+		"invalid room":    {"?room=on+call", http.StatusBadRequest, nil, false, 0, 0},
+	}
+
+	for k, v := range testCases {
+		w := httptest.NewRecorder()
+		h.router.ServeHTTP(w, httptest.NewRequest("GET", "/messages"+v.query, nil))
+		if w.Code != v.eCode {
+			t.Errorf("%s: expected status code (%d) did not match actual status code (%d)", k, v.eCode, w.Code)
+			continue
+		} else if w.Code != http.StatusOK {
+			continue
+		}
+
+		var page messagePage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Errorf("%s: failed to unmarshal response (%s) -> %s", k, w.Body.String(), err)
+			continue
+		}
+
+		ids := []uint64{}
+		for _, m := range page.Messages {
+			ids = append(ids, m.ID)
+		}
+		if !reflect.DeepEqual(ids, v.eIDs) {
+			t.Errorf("%s: expected IDs (%v) did not match actual IDs (%v)", k, v.eIDs, ids)
+		}
+		if page.More != v.eMore {
+			t.Errorf("%s: expected more (%v) did not match actual more (%v)", k, v.eMore, page.More)
+		}
+		if page.NextBefore != v.eNextBefore {
+			t.Errorf("%s: expected next_before (%d) did not match actual next_before (%d)", k, v.eNextBefore, page.NextBefore)
+		}
+		if page.NextSince != v.eNextSince {
+			t.Errorf("%s: expected next_since (%d) did not match actual next_since (%d)", k, v.eNextSince, page.NextSince)
+		}
+	}
+}
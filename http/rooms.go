@@ -0,0 +1,38 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// room is an element of the response body of GET /rooms
+type room struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+	Seq     uint64   `json:"seq"` // the sequence number of the last message of the room
+}
+
+// listRooms is a handler for the GET /rooms endpoint, which lists all rooms along with the names of their members and
+// the sequence number of their last message
+func (h *Handler) listRooms(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if _, ok := h.authorize(w, r, ScopeRead); !ok {
+		return
+	}
+
+	rooms := []room{}
+	for _, name := range h.hub.Rooms() {
+		members := h.hub.Members(name)
+		if members == nil {
+			// the last member left the room in the meantime
+			continue
+		}
+		rooms = append(rooms, room{Name: name, Members: members, Seq: h.hub.LastSeq(name)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rooms); err != nil {
+		h.logger.WithField("error", err).Debug("error writing rooms response")
+	}
+}
@@ -0,0 +1,80 @@
+package http
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestHandler_listRooms(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	th := tcp.New("", 6016, logger)
+	go th.Start()
+	<-th.Listening()
+	defer th.Stop()
+	h := New("", 8084, th, logger)
+
+	for _, name := range []string{"bob", "alice"} {
+		conn, peer := net.Pipe()
+		defer conn.Close()
+		go io.Copy(ioutil.Discard, peer)
+		if err := th.Connect(conn, name, tcp.SourceWebSocket, tcp.TextEncoder); err != nil {
+			t.Fatal(err)
+		}
+		if name == "alice" {
+			th.Input(conn, "/join ops")
+		}
+	}
+
+	// wait for the join messages to be numbered
+	for i := 0; (th.LastSeq("lobby") < 2 || th.LastSeq("ops") < 1) && i < 1000; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	r, _ := http.NewRequest("GET", "/rooms", nil)
+	w := httptest.NewRecorder()
+	h.router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code (%d) differed from actual status code (%d)", http.StatusOK, w.Code)
+	}
+
+	var rooms []room
+	if err := json.NewDecoder(w.Body).Decode(&rooms); err != nil {
+		t.Fatal(err)
+	}
+	e := []room{
+		{Name: "lobby", Members: []string{"alice", "bob"}, Seq: 2},
+		{Name: "ops", Members: []string{"alice"}, Seq: 1},
+	}
+	if !reflect.DeepEqual(rooms, e) {
+		t.Errorf("expected rooms (%#v) differed from actual rooms (%#v)", e, rooms)
+	}
+}
+
+func TestHandler_index(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	h := New("", 8084, tcp.New("", 6016, logger), logger)
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	h.router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code (%d) differed from actual status code (%d)", http.StatusOK, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("expected an HTML Content-Type, got %s", ct)
+	}
+	if !strings.Contains(w.Body.String(), `new EventSource(`) {
+		t.Errorf("expected the web client to be served")
+	}
+}
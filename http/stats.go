@@ -0,0 +1,70 @@
+package http
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus"
+)
+
+// statsResponse is the response body of GET /stats
+type statsResponse struct {
+	Clients       []tcp.QueueStats `json:"clients"`        // the outbound queues of the connected clients
+	Flood         tcp.FloodStats   `json:"flood"`          // what was done about connected clients that sent too fast
+	HTTPThrottled uint64           `json:"http_throttled"` // the number of POST /message requests rejected with a 429
+}
+
+// allow will apply h.RateLimiter to r, which is keyed by the API token (if any) or the IP address of the client. If
+// false is returned a 429 has been sent to the client.
+func (h *Handler) allow(w http.ResponseWriter, r *http.Request, token *Token) bool {
+	ok, wait := h.limit(r, token)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "too many requests, slow down", http.StatusTooManyRequests)
+	}
+	return ok
+}
+
+// limit will apply h.RateLimiter to a request or WebSocket frame sent by r. If ok is false the client has to wait
+// before sending again.
+func (h *Handler) limit(r *http.Request, token *Token) (ok bool, wait time.Duration) {
+	if h.RateLimiter == nil {
+		return true, 0
+	}
+
+	key := "ip:" + requestIP(r).String()
+	if token != nil {
+		key = "token:" + token.ID
+	}
+	ok, wait = h.RateLimiter.Allow(key)
+	if !ok {
+		h.logger.WithFields(logrus.Fields{
+			"address.remote": r.RemoteAddr,
+			"key":            key,
+			"throttled":      h.RateLimiter.Throttled(),
+		}).Warn("throttled HTTP client")
+	}
+	return ok, wait
+}
+
+// stats is a handler for the GET /stats endpoint, which reports how many messages were throttled and how far behind
+// the connected clients are
+func (h *Handler) stats(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if _, ok := h.authorize(w, r, ScopeAdmin); !ok {
+		return
+	}
+
+	s := statsResponse{Clients: h.hub.QueueStats(), Flood: h.hub.FloodStats()}
+	if h.RateLimiter != nil {
+		s.HTTPThrottled = h.RateLimiter.Throttled()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		h.logger.WithField("error", err).Debug("error writing stats response")
+	}
+}
@@ -0,0 +1,68 @@
+package http
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestHandler_rateLimit(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	th := tcp.New("", 6000, logger)
+	h := New("", 8080, th, logger)
+	h.RateLimiter = tcp.NewRateLimiter(tcp.RateLimit{Burst: 1, Rate: 0.001})
+	h.Tokens.Add("admin-0123456789", "root", []string{ScopeAdmin})
+	go func() {
+		for range h.messages {
+		}
+	}()
+
+	serve := func(method, url, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.router.ServeHTTP(w, r)
+		return w
+	}
+
+	// requests without a token are limited per IP address, requests with a token per token
+	if w := serve("POST", "/message", "", `{"sender":"bot","message":"hi"}`); w.Code != http.StatusOK {
+		t.Errorf("expected status code (%d) did not match actual status code (%d)", http.StatusOK, w.Code)
+	}
+	w := serve("POST", "/message", "", `{"sender":"bot","message":"hi"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected status code (%d) did not match actual status code (%d)", http.StatusTooManyRequests, w.Code)
+	}
+	if w := serve("POST", "/message", "admin-0123456789", `{"message":"hi"}`); w.Code != http.StatusOK {
+		t.Errorf("expected status code (%d) did not match actual status code (%d)", http.StatusOK, w.Code)
+	}
+
+	// throttled requests are counted, and the outbound queue of every connected client is reported
+	server, client := net.Pipe()
+	defer client.Close()
+	if err := th.Connect(server, "alice", tcp.SourceWebSocket, tcp.TextEncoder); err != nil {
+		t.Fatal(err)
+	}
+	w = serve("GET", "/stats", "admin-0123456789", "")
+	var s statsResponse
+	if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.HTTPThrottled != 1 {
+		t.Errorf("expected http_throttled (1) differed from actual http_throttled (%d)", s.HTTPThrottled)
+	}
+	if len(s.Clients) != 1 || s.Clients[0].Name != "alice" {
+		t.Errorf("expected clients ([alice]) differed from actual clients (%v)", s.Clients)
+	}
+	if w := serve("GET", "/stats", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status code (%d) did not match actual status code (%d)", http.StatusUnauthorized, w.Code)
+	}
+}
@@ -0,0 +1,146 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultHeartbeatInterval is how often a comment is sent to idle GET /stream clients to keep the connection open
+	DefaultHeartbeatInterval = 15 * time.Second
+
+	// streamBufferSize is the number of messages that can be queued for a GET /stream client before it is disconnected
+	streamBufferSize = 256
+)
+
+// stream is a handler for the GET /stream endpoint, which sends every broadcast message to the client as a
+// Server-Sent Event. The optional query parameter room restricts the stream to a single room. A client that
+// reconnects with the Last-Event-ID header (or the since query parameter) is first sent the messages that it missed.
+func (h *Handler) stream(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if _, ok := h.authorize(w, r, ScopeRead); !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	q := tcp.Query{Oldest: true}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("since")
+	}
+	if lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid Last-Event-ID %q: must be a message ID", lastEventID), http.StatusBadRequest)
+			return
+		}
+		q.After = id
+	}
+	if v := r.URL.Query().Get("room"); v != "" {
+		room, err := tcp.NormalizeRoom(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q.Room = room
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", 3*time.Second/time.Millisecond)
+
+	logger := h.logger.WithFields(logrus.Fields{
+		"address.remote": r.RemoteAddr,
+		"room":           q.Room,
+	})
+	logger.Info("client connected to http stream")
+	defer logger.Info("client disconnected from http stream")
+
+	// the missed messages are read from the store in pages, so that the store isn't locked for the whole replay. The
+	// client subscribes once it has almost caught up, and the store is read once more afterwards so that no message
+	// can slip through in between, without filling the buffer of the subscription during the replay.
+	var sub *tcp.Subscription
+	page := q
+	page.Limit = MaxPageSize
+	for lastEventID != "" {
+		missed, err := h.hub.Store.Query(page)
+		if err != nil {
+			logger.WithField("error", err).Error("error querying message store")
+			return
+		}
+		for _, m := range missed {
+			if err := writeEvent(w, m); err != nil {
+				return
+			}
+			page.After = m.ID
+		}
+		flusher.Flush()
+		if len(missed) < page.Limit {
+			if sub != nil {
+				break
+			}
+			sub = h.hub.Subscribe(streamBufferSize)
+		}
+	}
+	if sub == nil {
+		sub = h.hub.Subscribe(streamBufferSize)
+	}
+	defer sub.Close()
+	q.After = page.After
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(h.heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case m, ok := <-sub.C:
+			if !ok {
+				// the client fell behind or the hub stopped, it can resume using Last-Event-ID
+				return
+			}
+			if !q.Matches(m) {
+				continue
+			}
+			if err := writeEvent(w, m); err != nil {
+				return
+			}
+			q.After = m.ID
+			flusher.Flush()
+
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+
+		case <-h.closed:
+			return
+		}
+	}
+}
+
+// writeEvent will write m to w as a Server-Sent Event
+func writeEvent(w http.ResponseWriter, m tcp.Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", m.ID, data)
+	return err
+}
@@ -0,0 +1,117 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestHandler_stream(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	th := tcp.New("", 6012, logger)
+	go th.Start()
+	<-th.Listening()
+	defer th.Stop()
+
+	h := New("", 8082, th, logger)
+	h.heartbeatInterval = 100 * time.Millisecond
+	server := httptest.NewServer(h.router)
+	defer server.Close()
+
+	th.Store.Append(tcp.Message{Message: "one", Room: "lobby", Sender: "alice"})
+	th.Store.Append(tcp.Message{Message: "two", Room: "lobby", Sender: "alice"})
+	th.Store.Append(tcp.Message{Message: "elsewhere", Room: "ops", Sender: "alice"})
+
+	req, _ := http.NewRequest("GET", server.URL+"/stream?room=lobby", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to GET /stream -> %s", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected Content-Type (text/event-stream) did not match actual Content-Type (%s)", ct)
+	}
+	reader := bufio.NewReader(resp.Body)
+
+	// messages missed since Last-Event-ID are sent first, then live messages, skipping other rooms
+	expectEvent(t, reader, 2, "two")
+	th.Messages() <- tcp.Message{Message: "live ops", Room: "ops", Sender: "bob"}
+	th.Messages() <- tcp.Message{Message: "live", Sender: "bob"}
+	expectEvent(t, reader, 5, "live")
+
+	// an idle stream receives heartbeats
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read heartbeat -> %s", err)
+		} else if line == ": heartbeat\n" {
+			break
+		}
+	}
+
+	// a replay that is longer than a page is sent completely and in order
+	var ids []uint64
+	for i := 0; i < MaxPageSize+10; i++ {
+		m, _ := th.Store.Append(tcp.Message{Message: strconv.Itoa(i), Room: "bulk", Sender: "alice"})
+		ids = append(ids, m.ID)
+	}
+	resp3, err := http.Get(server.URL + "/stream?room=bulk&since=0")
+	if err != nil {
+		t.Fatalf("failed to GET /stream -> %s", err)
+	}
+	defer resp3.Body.Close()
+	reader = bufio.NewReader(resp3.Body)
+	for i, id := range ids {
+		expectEvent(t, reader, id, strconv.Itoa(i))
+	}
+
+	// an invalid Last-Event-ID is rejected
+	req, _ = http.NewRequest("GET", server.URL+"/stream", nil)
+	req.Header.Set("Last-Event-ID", "abc")
+	resp2, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to GET /stream -> %s", err)
+	}
+	resp2.Body.Close()
+	if resp2.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status code (%d) did not match actual status code (%d)", http.StatusBadRequest, resp2.StatusCode)
+	}
+}
+
+// expectEvent will read the next message event from reader and ensure it has the expected id and text
+func expectEvent(t *testing.T, reader *bufio.Reader, id uint64, text string) {
+	t.Helper()
+	var eventID, data string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event -> %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && data != "" {
+			break
+		} else if strings.HasPrefix(line, "id: ") {
+			eventID = strings.TrimPrefix(line, "id: ")
+		} else if strings.HasPrefix(line, "data: ") {
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+
+	var m tcp.Message
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		t.Fatalf("failed to unmarshal event data (%s) -> %s", data, err)
+	}
+	if m.ID != id || eventID != strconv.FormatUint(id, 10) || m.Message != text {
+		t.Errorf("expected event (%d: %s) did not match actual event (%s: %s)", id, text, eventID, data)
+	}
+}
+
@@ -0,0 +1,313 @@
+package http
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus"
+)
+
+// Scopes that can be granted to an API token
+const (
+	ScopeAdmin = "admin" // issue, list and revoke tokens
+	ScopePost  = "post"  // send messages with POST /message
+	ScopeRead  = "read"  // read messages and rooms with GET /messages, GET /rooms and GET /stream
+)
+
+// MinTokenLength is the minimum length of the tokens defined in the configuration
+const MinTokenLength = 16
+
+// ErrTokenNotFound is returned when revoking a token that doesn't exist
+var ErrTokenNotFound = errors.New("token not found")
+
+// Token is an API token. Every request authenticated with the token acts as Sender, and may only use the endpoints
+// allowed by Scopes.
+type Token struct {
+	Created time.Time `json:"created"`
+	Fixed   bool      `json:"fixed,omitempty"` // indicates that the token is defined in the configuration and can't be revoked
+	Hash    string    `json:"hash,omitempty"`  // the hex encoded SHA-256 hash of the token, the token itself is never stored
+	ID      string    `json:"id"`
+	Scopes  []string  `json:"scopes"`
+	Sender  string    `json:"sender"`
+}
+
+// HasScope reports whether t grants scope. The admin scope grants every scope.
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateToken will return an error if sender and scopes can't be used for a token
+func ValidateToken(sender string, scopes []string) error {
+	if err := tcp.ValidateNick(sender); err != nil {
+		return err
+	} else if len(scopes) == 0 {
+		return errors.New("a token requires at least one scope")
+	}
+	for _, s := range scopes {
+		if s != ScopeAdmin && s != ScopePost && s != ScopeRead {
+			return fmt.Errorf("invalid scope %q, must be one of: %s, %s, %s", s, ScopeAdmin, ScopePost, ScopeRead)
+		}
+	}
+	return nil
+}
+
+// TokenStore holds the API tokens. Tokens defined in the configuration are added with Add, tokens issued through the
+// admin endpoints are persisted to a file.
+type TokenStore struct {
+	file   string
+	mutex  sync.RWMutex
+	tokens map[string]*Token // keyed by hash
+}
+
+// NewTokenStore will create an empty TokenStore that keeps issued tokens in memory
+func NewTokenStore() *TokenStore {
+	return &TokenStore{tokens: make(map[string]*Token)}
+}
+
+// OpenTokenStore will load the tokens previously issued through the admin endpoints from file. Newly issued tokens
+// are written to file, which is created if it doesn't exist yet.
+func OpenTokenStore(file string) (*TokenStore, error) {
+	s := NewTokenStore()
+	s.file = file
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var tokens []*Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid token store %s: %s", file, err)
+	}
+	for _, t := range tokens {
+		s.tokens[t.Hash] = t
+	}
+	return s, nil
+}
+
+// Add will make the fixed token secret available. It is used for tokens defined in the configuration.
+func (s *TokenStore) Add(secret, sender string, scopes []string) error {
+	if len(secret) < MinTokenLength {
+		return fmt.Errorf("tokens must be at least %d characters long", MinTokenLength)
+	} else if err := ValidateToken(sender, scopes); err != nil {
+		return err
+	}
+
+	hash := hashToken(secret)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.tokens[hash]; ok {
+		return errors.New("duplicate token")
+	}
+	s.tokens[hash] = &Token{Created: time.Now(), Fixed: true, Hash: hash, ID: hash[:12], Scopes: scopes, Sender: sender}
+	return nil
+}
+
+// Issue will create a new token for sender that grants scopes. The secret is returned along with the token and can't
+// be retrieved again.
+func (s *TokenStore) Issue(sender string, scopes []string) (secret string, t Token, err error) {
+	if err := ValidateToken(sender, scopes); err != nil {
+		return "", Token{}, err
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", Token{}, err
+	}
+	secret = "tc_" + hex.EncodeToString(b)
+	hash := hashToken(secret)
+	token := &Token{Created: time.Now(), Hash: hash, ID: hash[:12], Scopes: scopes, Sender: sender}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens[hash] = token
+	if err := s.save(); err != nil {
+		delete(s.tokens, hash)
+		return "", Token{}, err
+	}
+	return secret, *token, nil
+}
+
+// Lookup will return the token matching secret, or nil if there is none
+func (s *TokenStore) Lookup(secret string) *Token {
+	// tokens are looked up by their hash, so the time taken doesn't reveal anything about the secrets
+	hash := hashToken(secret)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.tokens[hash]
+}
+
+// List will return all tokens ordered by creation time
+func (s *TokenStore) List() []Token {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	tokens := make([]Token, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, *t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.Before(tokens[j].Created)
+	})
+	return tokens
+}
+
+// Revoke will delete the issued token identified by id
+func (s *TokenStore) Revoke(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for hash, t := range s.tokens {
+		if t.ID != id {
+			continue
+		} else if t.Fixed {
+			return errors.New("tokens defined in the configuration can't be revoked")
+		}
+		delete(s.tokens, hash)
+		if err := s.save(); err != nil {
+			s.tokens[hash] = t
+			return err
+		}
+		return nil
+	}
+	return ErrTokenNotFound
+}
+
+// save will write all issued tokens to s.file. The caller must hold s.mutex.
+func (s *TokenStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+
+	issued := []*Token{}
+	for _, t := range s.tokens {
+		if !t.Fixed {
+			issued = append(issued, t)
+		}
+	}
+	data, err := json.MarshalIndent(issued, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that a crash can't leave a truncated file behind
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), filepath.Base(s.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file)
+}
+
+// hashToken returns the hex encoded SHA-256 hash of secret
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenRequest is the request body of POST /tokens
+type tokenRequest struct {
+	Scopes []string `json:"scopes"`
+	Sender string   `json:"sender"`
+}
+
+// tokenResponse is the response body of POST /tokens
+type tokenResponse struct {
+	Token
+	Secret string `json:"token"`
+}
+
+// issueToken is a handler for the POST /tokens endpoint, which issues a new token. The token is only included in the
+// response, it can't be retrieved later.
+func (h *Handler) issueToken(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	admin, ok := h.authorize(w, r, ScopeAdmin)
+	if !ok {
+		return
+	}
+
+	var req tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	secret, t, err := h.Tokens.Issue(req.Sender, req.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"admin":  admin.Sender,
+		"id":     t.ID,
+		"scopes": strings.Join(t.Scopes, ","),
+		"sender": t.Sender,
+	}).Info("issued API token")
+
+	t.Hash = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tokenResponse{Token: t, Secret: secret})
+}
+
+// listTokens is a handler for the GET /tokens endpoint, which lists all tokens without their secrets
+func (h *Handler) listTokens(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if _, ok := h.authorize(w, r, ScopeAdmin); !ok {
+		return
+	}
+
+	tokens := h.Tokens.List()
+	for i := range tokens {
+		tokens[i].Hash = ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tokens); err != nil {
+		h.logger.WithField("error", err).Debug("error writing tokens response")
+	}
+}
+
+// revokeToken is a handler for the DELETE /tokens/:id endpoint, which revokes an issued token
+func (h *Handler) revokeToken(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	admin, ok := h.authorize(w, r, ScopeAdmin)
+	if !ok {
+		return
+	}
+
+	if err := h.Tokens.Revoke(ps.ByName("id")); err == ErrTokenNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"admin": admin.Sender,
+		"id":    ps.ByName("id"),
+	}).Info("revoked API token")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,196 @@
+package http
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestTokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "tokens.json")
+	s, err := OpenTokenStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		secret string
+		sender string
+		scopes []string
+		eErr   bool
+	}{
+		"valid":         {"0123456789abcdef", "ci", []string{ScopePost}, false},
+		"short":         {"0123", "ci", []string{ScopePost}, true},
+		"invalid name":  {"0123456789abcdeg", "c(i)", []string{ScopePost}, true},
+		"no scopes":     {"0123456789abcdeh", "ci", nil, true},
+		"invalid scope": {"0123456789abcdei", "ci", []string{"write"}, true},
+	}
+	for k, v := range testCases {
+		if err := s.Add(v.secret, v.sender, v.scopes); (err != nil) != v.eErr {
+			t.Errorf("%s: expected error (%v) differed from actual error (%v)", k, v.eErr, err)
+		}
+	}
+	if err := s.Add("0123456789abcdef", "ci", []string{ScopeRead}); err == nil {
+		t.Errorf("expected a duplicate token to be rejected")
+	}
+
+	secret, issued, err := s.Issue("deploys", []string{ScopePost, ScopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := s.Lookup(secret); token == nil || token.ID != issued.ID || token.Sender != "deploys" {
+		t.Errorf("expected to find the issued token, got %#v", token)
+	}
+	if s.Lookup("0123456789abcdef") == nil || s.Lookup("unknown") != nil {
+		t.Errorf("expected only the added and issued tokens to be found")
+	}
+	fixed := s.Lookup("0123456789abcdef")
+	if err := s.Revoke(fixed.ID); err == nil {
+		t.Errorf("expected tokens defined in the configuration to be irrevocable")
+	}
+
+	// only issued tokens are persisted, and the secrets are never written to the file
+	data, _ := ioutil.ReadFile(file)
+	if strings.Contains(string(data), secret) {
+		t.Errorf("expected the secret not to be stored")
+	}
+	s, err = OpenTokenStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens := s.List(); len(tokens) != 1 || tokens[0].ID != issued.ID {
+		t.Errorf("expected only the issued token after reopening the store, got %#v", tokens)
+	}
+	if err := s.Revoke(issued.ID); err != nil {
+		t.Errorf("failed to revoke token -> %s", err)
+	}
+	if err := s.Revoke(issued.ID); err != ErrTokenNotFound {
+		t.Errorf("expected error (%v) differed from actual error (%v)", ErrTokenNotFound, err)
+	}
+	if s.Lookup(secret) != nil {
+		t.Errorf("expected the revoked token not to be found")
+	}
+}
+
+func TestHandler_tokens(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	th := tcp.New("", 6000, logger)
+	h := New("", 8080, th, logger)
+	h.RequireTokens = true
+	h.Tokens.Add("admin-0123456789", "root", []string{ScopeAdmin})
+	h.Tokens.Add("reader-0123456789", "dashboard", []string{ScopeRead})
+
+	serve := func(method, url, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.router.ServeHTTP(w, r)
+		return w
+	}
+
+	// the admin endpoints require a token with the admin scope
+	if w := serve("POST", "/tokens", "", `{"sender":"ci","scopes":["post"]}`); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("expected status code (%d) did not match actual status code (%d)", http.StatusUnauthorized, w.Code)
+	}
+	if w := serve("POST", "/tokens", "reader-0123456789", `{"sender":"ci","scopes":["post"]}`); w.Code != http.StatusForbidden {
+		t.Errorf("expected status code (%d) did not match actual status code (%d)", http.StatusForbidden, w.Code)
+	}
+	if w := serve("POST", "/tokens", "admin-0123456789", `{"sender":"ci","scopes":["delete"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code (%d) did not match actual status code (%d)", http.StatusBadRequest, w.Code)
+	}
+	w := serve("POST", "/tokens", "admin-0123456789", `{"sender":"ci","scopes":["post"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status code (%d) did not match actual status code (%d)", http.StatusCreated, w.Code)
+	}
+	var issued tokenResponse
+	json.NewDecoder(w.Body).Decode(&issued)
+	if issued.Secret == "" || issued.Sender != "ci" || issued.Hash != "" {
+		t.Errorf("unexpected token response %#v", issued)
+	}
+
+	// messages are sent as the sender of the token
+	testCases := map[string]struct {
+		token string
+		body  string
+		eCode int
+	}{
+		"no token":      {"", `{"sender":"ci","message":"hi"}`, http.StatusUnauthorized},
+		"invalid token": {"wrong-0123456789", `{"sender":"ci","message":"hi"}`, http.StatusUnauthorized},
+		"wrong scope":   {"reader-0123456789", `{"sender":"dashboard","message":"hi"}`, http.StatusForbidden},
+		"other sender":  {issued.Secret, `{"sender":"bob","message":"hi"}`, http.StatusForbidden},
+		"token sender":  {issued.Secret, `{"message":"build passed"}`, http.StatusOK},
+	}
+	for k, v := range testCases {
+		if w := serve("POST", "/message", v.token, v.body); w.Code != v.eCode {
+			t.Errorf("%s: expected status code (%d) did not match actual status code (%d)", k, v.eCode, w.Code)
+		}
+	}
+	select {
+	case m := <-h.messages:
+		if m.Sender != "ci" || m.Message != "build passed" {
+			t.Errorf("expected message from ci, got %#v", m)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("failed to receive Message from messages channel")
+	}
+
+	// logging into an account doesn't replace the token
+	if err := th.Register("ci", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/message", strings.NewReader(`{"sender":"ci","message":"hi"}`))
+	r.SetBasicAuth("ci", "correct horse")
+	w = httptest.NewRecorder()
+	h.router.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status code (%d) did not match actual status code (%d)", http.StatusUnauthorized, w.Code)
+	}
+
+	// reading requires the read scope, which can also be sent as a query parameter
+	if w := serve("GET", "/rooms", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status code (%d) did not match actual status code (%d)", http.StatusUnauthorized, w.Code)
+	}
+	if w := serve("GET", "/rooms", issued.Secret, ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected status code (%d) did not match actual status code (%d)", http.StatusForbidden, w.Code)
+	}
+	if w := serve("GET", "/rooms?access_token=reader-0123456789", "", ""); w.Code != http.StatusOK {
+		t.Errorf("expected status code (%d) did not match actual status code (%d)", http.StatusOK, w.Code)
+	}
+
+	// tokens are listed without their secrets and can be revoked
+	w = serve("GET", "/tokens", "admin-0123456789", "")
+	if strings.Contains(w.Body.String(), issued.Secret) || strings.Contains(w.Body.String(), "hash") {
+		t.Errorf("expected the list of tokens not to contain secrets, got %s", w.Body.String())
+	}
+	var tokens []Token
+	json.NewDecoder(w.Body).Decode(&tokens)
+	if len(tokens) != 3 {
+		t.Errorf("expected 3 tokens, got %d", len(tokens))
+	}
+	if w := serve("DELETE", "/tokens/"+issued.ID, "admin-0123456789", ""); w.Code != http.StatusNoContent {
+		t.Errorf("expected status code (%d) did not match actual status code (%d)", http.StatusNoContent, w.Code)
+	}
+	if w := serve("DELETE", "/tokens/"+issued.ID, "admin-0123456789", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected status code (%d) did not match actual status code (%d)", http.StatusNotFound, w.Code)
+	}
+	if w := serve("POST", "/message", issued.Secret, `{"message":"hi"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a revoked token to be rejected, got status code %d", w.Code)
+	}
+}
@@ -0,0 +1,21 @@
+package http
+
+import (
+	_ "embed" // the web client is embedded into the binary
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// webClient is the browser chat client served at GET /. It receives messages from GET /stream, loads scrollback from
+// GET /messages and the room list from GET /rooms, and sends messages with POST /message.
+//
+//go:embed web/index.html
+var webClient []byte
+
+// index is a handler for the GET / endpoint, which serves the browser chat client
+func (h *Handler) index(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(webClient)
+}
@@ -0,0 +1,159 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// wsReadLimit is the maximum size in bytes of a frame sent by a WebSocket client in addition to the maximum length
+	// of its message, larger frames close the connection
+	wsReadLimit = 64 * 1024
+
+	// wsWriteTimeout is how long writing a single frame to a WebSocket client may take before the client is disconnected
+	wsWriteTimeout = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// websocketChat is a handler for the GET /ws endpoint, which connects a WebSocket client to the chat as a full
+// participant named after the nick query parameter. Registered names require the password of the account to be sent
+// using basic authentication. Connecting requires an API token with the read scope if h.RequireTokens is set, and
+// frames sent with a token are only accepted if it grants the post scope. Every frame sent in either direction is a
+// JSON encoded tcp.Message. A frame from the client without a room or recipient is handled like a line typed by a
+// telnet client, so it may also contain a command such as "/join ops".
+func (h *Handler) websocketChat(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	token, ok := h.authorize(w, r, ScopeRead)
+	if !ok {
+		return
+	} else if !h.allow(w, r, token) {
+		return
+	}
+	canPost := token == nil || token.HasScope(ScopePost)
+
+	// the name is checked before upgrading the connection so that the client receives a meaningful status code
+	nick := r.URL.Query().Get("nick")
+	if err := tcp.ValidateNick(nick); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if token != nil && !strings.EqualFold(nick, token.Sender) {
+		http.Error(w, fmt.Sprintf("the API token can only connect as %s", token.Sender), http.StatusForbidden)
+		return
+	} else if h.hub.IsOnline(nick) {
+		http.Error(w, fmt.Sprintf("the name %s is already in use", nick), http.StatusConflict)
+		return
+	}
+	account, status, err := h.authenticateName(r, nick)
+	if err != nil {
+		unauthorized(w, status, err)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied to the client
+		return
+	}
+	ws.SetReadLimit(wsReadLimit + int64(h.hub.MaxLineLength))
+
+	conn := &wsConn{ws: ws}
+	if err := h.hub.Admit(conn); err != nil {
+		h.logger.WithFields(logrus.Fields{
+			"address.remote": r.RemoteAddr,
+			"error":          err,
+		}).Warn("rejected websocket connection over the connection limit")
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()), time.Now().Add(wsWriteTimeout))
+		ws.Close()
+		return
+	}
+	defer h.hub.Release(conn)
+
+	connect := h.hub.Connect
+	if account {
+		connect = h.hub.ConnectAccount
+	}
+	if err := connect(conn, nick, tcp.SourceWebSocket, jsonEncoder); err != nil {
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()), time.Now().Add(wsWriteTimeout))
+		ws.Close()
+		return
+	}
+
+	for {
+		var m tcp.Message
+		if err := ws.ReadJSON(&m); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				h.hub.Notify(conn, "Invalid message, frames must be JSON encoded messages")
+				continue
+			}
+			break
+		}
+
+		if !canPost {
+			h.hub.Notify(conn, "Your API token doesn't grant the post scope, you can only read")
+			continue
+		} else if ok, _ := h.limit(r, token); !ok {
+			h.hub.Notify(conn, "Too many messages, slow down")
+			continue
+		}
+
+		if m.Room == "" && m.Recipient == "" && !m.Action {
+			h.hub.Input(conn, m.Message)
+		} else if err := h.hub.Send(conn, m); err != nil {
+			h.hub.Notify(conn, err.Error())
+		}
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"address.remote": r.RemoteAddr,
+		"name":           nick,
+	}).Debug("websocket closed")
+	h.hub.Disconnect(conn)
+}
+
+// jsonEncoder is a tcp.Encoder that encodes messages as JSON
+func jsonEncoder(m tcp.Message) []byte {
+	b, _ := json.Marshal(m)
+	return b
+}
+
+// wsConn adapts a WebSocket connection to a net.Conn so that it can be registered with the hub. Every Write is sent
+// as a single text frame. Reading is done directly on the WebSocket connection.
+type wsConn struct {
+	mutex sync.Mutex
+	ws    *websocket.Conn
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	return 0, errors.New("reading from a websocket is not supported")
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := c.ws.WriteMessage(websocket.TextMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) Close() error                       { return c.ws.Close() }
+func (c *wsConn) LocalAddr() net.Addr                { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr               { return c.ws.RemoteAddr() }
+func (c *wsConn) SetDeadline(t time.Time) error      { return c.ws.UnderlyingConn().SetDeadline(t) }
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
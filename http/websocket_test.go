@@ -0,0 +1,195 @@
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestHandler_websocketChat(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	th := tcp.New("", 6014, logger)
+	th.HistorySize = 0
+	th.MaxLineLength = 100
+	go th.Start()
+	<-th.Listening()
+	defer th.Stop()
+
+	h := New("", 8083, th, logger)
+	server := httptest.NewServer(h.router)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?nick="
+
+	// the nick is validated before the connection is upgraded
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL+"no%2Fslashes", nil); err == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an invalid nick to be rejected with %d, got %v", http.StatusBadRequest, resp)
+	}
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL+"alice", nil)
+	if err != nil {
+		t.Fatalf("failed to dial websocket -> %s", err)
+	}
+	defer alice.Close()
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	expectFrame(t, alice, tcp.Message{Kind: tcp.KindSystem, Message: "Welcome to telchat alice"})
+	expectFrame(t, alice, tcp.Message{Kind: tcp.KindJoin, Room: "lobby", Sender: "alice", Seq: 1})
+
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL+"ALICE", nil); err == nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected a nick in use to be rejected with %d, got %v", http.StatusConflict, resp)
+	}
+
+	// websocket clients and telnet clients talk to each other, every message of a room is numbered in order
+	bob, err := net.Dial("tcp", net.JoinHostPort("localhost", "6014"))
+	if err != nil {
+		t.Fatalf("failed to connect to tcp listener -> %s", err)
+	}
+	defer bob.Close()
+	bob.SetDeadline(time.Now().Add(5 * time.Second))
+	bobReader := bufio.NewReader(bob)
+	bobReader.ReadString('\n')
+	fmt.Fprintf(bob, "bob\r\n")
+	bobReader.ReadString('\n')
+	bobReader.ReadString('\n')
+	expectFrame(t, alice, tcp.Message{Kind: tcp.KindJoin, Room: "lobby", Sender: "bob", Seq: 2})
+
+	fmt.Fprintf(bob, "hi alice\r\n")
+	expectFrame(t, alice, tcp.Message{Kind: tcp.KindChat, Message: "hi alice", Room: "lobby", Sender: "bob", Seq: 3, Source: tcp.SourceTCP})
+	bobReader.ReadString('\n')
+
+	alice.WriteJSON(tcp.Message{Message: "hi bob"})
+	expectFrame(t, alice, tcp.Message{Kind: tcp.KindChat, Message: "hi bob", Room: "lobby", Sender: "alice", Seq: 4, Source: tcp.SourceWebSocket})
+	if line, _ := bobReader.ReadString('\n'); !strings.HasSuffix(line, " alice: hi bob\r\n") {
+		t.Errorf("expected bob to receive the message from alice, got %q", line)
+	}
+
+	// the sender can't be forged, and commands work like they do for telnet clients
+	alice.WriteJSON(tcp.Message{Message: "psst", Recipient: "bob", Sender: "mallory"})
+	expectFrame(t, alice, tcp.Message{Kind: tcp.KindPrivate, Message: "psst", Recipient: "bob", Sender: "alice", Source: tcp.SourceWebSocket})
+	alice.WriteJSON(tcp.Message{Message: "hello", Room: "ops"})
+	expectFrame(t, alice, tcp.Message{Kind: tcp.KindSystem, Message: "You are not in ops"})
+	alice.WriteJSON(tcp.Message{Message: "/who"})
+	expectFrame(t, alice, tcp.Message{Kind: tcp.KindSystem, Message: "Users in lobby (2): alice, bob"})
+	alice.WriteJSON(tcp.Message{Message: strings.Repeat("x", 200), Room: "lobby"})
+	expectFrame(t, alice, tcp.Message{Kind: tcp.KindSystem, Message: "Lines can't be longer than 100 bytes"})
+
+	fmt.Fprintf(bob, "/quit\r\n")
+	expectFrame(t, alice, tcp.Message{Kind: tcp.KindQuit, Room: "lobby", Sender: "bob", Seq: 5})
+}
+
+func TestHandler_websocketConnectionLimits(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	th := tcp.New("", 6068, logger)
+	th.MaxConnectionsPerIP = 1
+	go th.Start()
+	<-th.Listening()
+	defer th.Stop()
+
+	h := New("", 8083, th, logger)
+	server := httptest.NewServer(h.router)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?nick="
+
+	// the connections to the TCP listener count towards the limits of WebSocket clients
+	telnet, err := net.Dial("tcp", net.JoinHostPort("localhost", "6068"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer telnet.Close()
+	telnet.SetDeadline(time.Now().Add(5 * time.Second))
+	bufio.NewReader(telnet).ReadString('\n')
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL+"alice", nil)
+	if err != nil {
+		t.Fatalf("failed to dial websocket -> %s", err)
+	}
+	defer alice.Close()
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := alice.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Errorf("expected the connection to be closed with %d, got %v", websocket.CloseTryAgainLater, err)
+	}
+}
+
+func TestHandler_websocketTokens(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	th := tcp.New("", 6058, logger)
+	th.HistorySize = 0
+	go th.Start()
+	<-th.Listening()
+	defer th.Stop()
+
+	h := New("", 8083, th, logger)
+	h.RequireTokens = true
+	h.RateLimiter = tcp.NewRateLimiter(tcp.RateLimit{Burst: 2, Rate: 0.001})
+	h.Tokens.Add("reader-0123456789", "dashboard", []string{ScopeRead})
+	h.Tokens.Add("chatter-0123456789", "ci", []string{ScopeRead, ScopePost})
+	server := httptest.NewServer(h.router)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?nick="
+
+	// connecting requires a token with the read scope, which is bound to its sender
+	testCases := map[string]struct {
+		query string
+		eCode int
+	}{
+		"no token":      {"dashboard", http.StatusUnauthorized},
+		"invalid token": {"dashboard&access_token=wrong-0123456789", http.StatusUnauthorized},
+		"other sender":  {"bob&access_token=reader-0123456789", http.StatusForbidden},
+	}
+	for k, v := range testCases {
+		if _, resp, err := websocket.DefaultDialer.Dial(wsURL+v.query, nil); err == nil || resp.StatusCode != v.eCode {
+			t.Errorf("%s: expected the connection to be rejected with %d, got %v", k, v.eCode, resp)
+		}
+	}
+
+	// a token without the post scope can only read
+	dashboard, _, err := websocket.DefaultDialer.Dial(wsURL+"dashboard&access_token=reader-0123456789", nil)
+	if err != nil {
+		t.Fatalf("failed to dial websocket -> %s", err)
+	}
+	defer dashboard.Close()
+	dashboard.SetReadDeadline(time.Now().Add(5 * time.Second))
+	expectFrame(t, dashboard, tcp.Message{Kind: tcp.KindSystem, Message: "Welcome to telchat dashboard"})
+	expectFrame(t, dashboard, tcp.Message{Kind: tcp.KindJoin, Room: "lobby", Sender: "dashboard", Seq: 1})
+	dashboard.WriteJSON(tcp.Message{Message: "hi"})
+	expectFrame(t, dashboard, tcp.Message{Kind: tcp.KindSystem, Message: "Your API token doesn't grant the post scope, you can only read"})
+
+	// frames count against the rate limit of the token, like requests do
+	ci, _, err := websocket.DefaultDialer.Dial(wsURL+"ci&access_token=chatter-0123456789", nil)
+	if err != nil {
+		t.Fatalf("failed to dial websocket -> %s", err)
+	}
+	defer ci.Close()
+	ci.SetReadDeadline(time.Now().Add(5 * time.Second))
+	expectFrame(t, ci, tcp.Message{Kind: tcp.KindSystem, Message: "Welcome to telchat ci"})
+	expectFrame(t, ci, tcp.Message{Kind: tcp.KindJoin, Room: "lobby", Sender: "ci", Seq: 2})
+	ci.WriteJSON(tcp.Message{Message: "build passed"})
+	expectFrame(t, ci, tcp.Message{Kind: tcp.KindChat, Message: "build passed", Room: "lobby", Sender: "ci", Seq: 3, Source: tcp.SourceWebSocket})
+	ci.WriteJSON(tcp.Message{Message: "build passed again"})
+	expectFrame(t, ci, tcp.Message{Kind: tcp.KindSystem, Message: "Too many messages, slow down"})
+	expectFrame(t, dashboard, tcp.Message{Kind: tcp.KindJoin, Room: "lobby", Sender: "ci", Seq: 2})
+	expectFrame(t, dashboard, tcp.Message{Kind: tcp.KindChat, Message: "build passed", Room: "lobby", Sender: "ci", Seq: 3, Source: tcp.SourceWebSocket})
+}
+
+// expectFrame will read the next frame from ws and compare it to e, ignoring the ID and time of the message
+func expectFrame(t *testing.T, ws *websocket.Conn, e tcp.Message) {
+	t.Helper()
+	var m tcp.Message
+	if err := ws.ReadJSON(&m); err != nil {
+		t.Fatalf("failed to read frame -> %s", err)
+	}
+	m.ID = 0
+	m.Time = time.Time{}
+	if !reflect.DeepEqual(m, e) {
+		t.Errorf("expected message (%#v) differed from actual message (%#v)", e, m)
+	}
+}
@@ -0,0 +1,535 @@
+package irc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jwenz723/telchat/tcp"
+)
+
+// Numeric replies, see RFC 2812 section 5
+const (
+	rplWelcome          = "001"
+	rplYourHost         = "002"
+	rplCreated          = "003"
+	rplMyInfo           = "004"
+	rplUModeIs          = "221"
+	rplEndOfWho         = "315"
+	rplChannelModeIs    = "324"
+	rplNoTopic          = "331"
+	rplTopic            = "332"
+	rplWhoReply         = "352"
+	rplNamReply         = "353"
+	rplEndOfNames       = "366"
+	errNoSuchNick       = "401"
+	errNoSuchChannel    = "403"
+	errCannotSendToChan = "404"
+	errNoRecipient      = "411"
+	errNoTextToSend     = "412"
+	errUnknownCommand   = "421"
+	errInputTooLong     = "417"
+	errNoMotd           = "422"
+	errNoNicknameGiven  = "431"
+	errErroneusNick     = "432"
+	errNicknameInUse    = "433"
+	errNotOnChannel     = "442"
+	errNotRegistered    = "451"
+	errNeedMoreParams   = "461"
+	errAlreadyRegistred = "462"
+	errPasswdMismatch   = "464"
+	errYoureBannedCreep = "465"
+)
+
+// client is the state of a single IRC connection
+type client struct {
+	conn       net.Conn
+	hub        *tcp.Handler
+	lastEvent  string    // identifies the last nick or quit event sent, which the hub sends once for every shared room
+	lastTime   time.Time // the time of lastEvent
+	mutex      sync.Mutex
+	nick       string
+	pass       string // the password sent with PASS, which logs the client into the account of its nick
+	registered bool
+	user       string
+}
+
+// getNick returns the current nick of c
+func (c *client) getNick() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.nick
+}
+
+// setNick changes the nick of c
+func (c *client) setNick(nick string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.nick = nick
+}
+
+// isRegistered reports whether c has completed registration and is connected to the hub
+func (c *client) isRegistered() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.registered
+}
+
+// send writes a message from the server to c
+func (c *client) send(command string, params ...string) {
+	c.conn.Write([]byte(formatMessage(serverName, command, params...)))
+}
+
+// reply writes a numeric reply to c, which is addressed to the nick of c
+func (c *client) reply(numeric string, params ...string) {
+	nick := c.getNick()
+	if nick == "" {
+		nick = "*"
+	}
+	c.send(numeric, append([]string{nick}, params...)...)
+}
+
+// register handles the messages sent by c before registration is complete. Once both NICK and USER have been
+// received, c is connected to the hub. An error is returned if the connection should be closed.
+func (c *client) register(m message) error {
+	switch m.command {
+	case "NICK":
+		if len(m.params) == 0 {
+			c.reply(errNoNicknameGiven, "No nickname given")
+			return nil
+		}
+		if err := validateNick(m.params[0]); err != nil {
+			c.reply(errErroneusNick, m.params[0], "Erroneous nickname")
+			return nil
+		} else if c.hub.IsOnline(m.params[0]) {
+			c.reply(errNicknameInUse, m.params[0], "Nickname is already in use")
+			return nil
+		}
+		c.setNick(m.params[0])
+
+	case "USER":
+		if len(m.params) < 4 {
+			c.reply(errNeedMoreParams, m.command, "Not enough parameters")
+			return nil
+		}
+		c.user = m.params[0]
+
+	case "PASS":
+		if len(m.params) == 0 {
+			c.reply(errNeedMoreParams, m.command, "Not enough parameters")
+			return nil
+		}
+		c.pass = m.params[0]
+		return nil
+
+	case "CAP", "PONG":
+		// capability negotiation is not supported, clients continue without it
+		return nil
+
+	case "PING":
+		c.handle(m)
+		return nil
+
+	case "QUIT":
+		return fmt.Errorf("quit before registration")
+
+	default:
+		c.reply(errNotRegistered, "You have not registered")
+		return nil
+	}
+
+	nick := c.getNick()
+	if nick == "" || c.user == "" {
+		return nil
+	}
+
+	// registered nicks require the password of the account, which new users in accounts-only mode choose with PASS
+	connect := c.hub.Connect
+	var err error
+	if c.hub.IsRegistered(nick) {
+		err = c.hub.Authenticate(nick, c.pass)
+		connect = c.hub.ConnectAccount
+	} else if c.hub.AccountsOnly && c.pass != "" {
+		err = c.hub.Register(nick, c.pass)
+		connect = c.hub.ConnectAccount
+	}
+	c.pass = ""
+	if err != nil {
+		text := err.Error()
+		if err == tcp.ErrInvalidPassword {
+			text = "Password incorrect"
+		}
+		c.reply(errPasswdMismatch, text)
+		c.conn.Write([]byte(formatMessage("", "ERROR", "Closing Link: "+err.Error())))
+		return err
+	}
+
+	c.reply(rplWelcome, fmt.Sprintf("Welcome to telchat %s", nick))
+	c.reply(rplYourHost, fmt.Sprintf("Your host is %s", serverName))
+	c.reply(rplCreated, "This server speaks a subset of RFC 2812")
+	c.reply(rplMyInfo, serverName, "telchat", "o", "o")
+	c.reply(errNoMotd, "MOTD File is missing")
+
+	// mark c as registered first, the hub starts delivering messages (e.g. the join of #lobby) right away
+	c.mutex.Lock()
+	c.registered = true
+	c.mutex.Unlock()
+	if err := connect(c.conn, nick, tcp.SourceIRC, c.encode); err != nil {
+		c.mutex.Lock()
+		c.registered = false
+		c.mutex.Unlock()
+		if _, banned := err.(*tcp.BannedError); banned {
+			c.reply(errYoureBannedCreep, err.Error())
+		} else if err == tcp.ErrNickInUse {
+			c.reply(errNicknameInUse, nick, "Nickname is already in use")
+		} else {
+			c.reply(errPasswdMismatch, err.Error())
+		}
+		c.conn.Write([]byte(formatMessage("", "ERROR", "Closing Link: "+err.Error())))
+		return err
+	}
+	return nil
+}
+
+// handle executes a command sent by the registered client c
+func (c *client) handle(m message) {
+	if needed, ok := minParams[m.command]; ok && len(m.params) < needed {
+		c.reply(errNeedMoreParams, m.command, "Not enough parameters")
+		return
+	}
+
+	switch m.command {
+	case "JOIN":
+		for _, channel := range strings.Split(m.params[0], ",") {
+			if !strings.HasPrefix(channel, "#") {
+				c.reply(errNoSuchChannel, channel, "No such channel")
+			} else if err := c.hub.Join(c.conn, channel); err != nil {
+				c.reply(errNoSuchChannel, channel, err.Error())
+			}
+		}
+
+	case "MODE":
+		// modes are not supported, but clients query them after joining a channel
+		if strings.HasPrefix(m.params[0], "#") {
+			c.reply(rplChannelModeIs, m.params[0], "+")
+		} else if strings.EqualFold(m.params[0], c.getNick()) {
+			c.reply(rplUModeIs, "+")
+		}
+
+	case "NAMES":
+		if len(m.params) == 0 {
+			c.reply(rplEndOfNames, "*", "End of /NAMES list")
+			return
+		}
+		for _, channel := range strings.Split(m.params[0], ",") {
+			c.conn.Write([]byte(c.names(channel)))
+		}
+
+	case "KICK":
+		// telchat has no per-channel membership control, so KICK disconnects the user like /kick
+		c.hub.Input(c.conn, "/kick "+strings.Join(m.params[1:], " "))
+
+	case "NICK":
+		c.rename(m.params[0])
+
+	case "NOTICE", "PRIVMSG":
+		c.privmsg(m)
+
+	case "PART":
+		for _, channel := range strings.Split(m.params[0], ",") {
+			room, err := tcp.NormalizeRoom(channel)
+			if err == nil {
+				_, err = c.hub.Part(c.conn, room)
+			}
+			if err != nil {
+				c.reply(errNotOnChannel, channel, "You're not on that channel")
+				continue
+			}
+
+			// the hub only tells the remaining members of the room, but IRC clients wait for their own PART
+			nick := c.getNick()
+			c.conn.Write([]byte(formatMessage(fmt.Sprintf("%s!%s@%s", nick, nick, serverName), "PART", "#"+room)))
+		}
+
+	case "PING":
+		token := serverName
+		if len(m.params) > 0 {
+			token = m.params[0]
+		}
+		c.send("PONG", serverName, token)
+
+	case "PONG":
+
+	case "QUIT":
+		text := ""
+		if len(m.params) > 0 {
+			text = m.params[0]
+		}
+		c.conn.Write([]byte(formatMessage("", "ERROR", "Closing Link: "+c.getNick())))
+		c.hub.Quit(c.conn, text)
+
+	case "TOPIC":
+		c.topic(m)
+
+	case "USER":
+		c.reply(errAlreadyRegistred, "You may not reregister")
+
+	case "WHO":
+		c.who(m)
+
+	default:
+		// other commands of telchat (e.g. /register or /rooms) are sent as raw commands by IRC clients
+		for _, cmd := range c.hub.Commands() {
+			if strings.EqualFold(cmd.Name, m.command) {
+				c.hub.Input(c.conn, "/"+cmd.Name+" "+strings.Join(m.params, " "))
+				return
+			}
+		}
+		c.reply(errUnknownCommand, m.command, "Unknown command")
+	}
+}
+
+// minParams is the number of parameters required by commands
+var minParams = map[string]int{
+	"JOIN":    1,
+	"KICK":    2,
+	"MODE":    1,
+	"NICK":    1,
+	"NOTICE":  2,
+	"PART":    1,
+	"PRIVMSG": 2,
+	"TOPIC":   1,
+}
+
+// names returns the RPL_NAMREPLY and RPL_ENDOFNAMES replies listing the members of channel
+func (c *client) names(channel string) string {
+	nick := c.getNick()
+	room, err := tcp.NormalizeRoom(channel)
+	var lines string
+	if err == nil {
+		if members := c.hub.Members(room); len(members) > 0 {
+			// the list of names is always sent as a trailing parameter, even when it contains a single name
+			lines = fmt.Sprintf(":%s %s %s = #%s :%s\r\n", serverName, rplNamReply, nick, room, strings.Join(ircNicks(members), " "))
+		}
+		channel = "#" + room
+	}
+	return lines + formatMessage(serverName, rplEndOfNames, nick, channel, "End of /NAMES list")
+}
+
+// privmsg sends the text of a PRIVMSG or NOTICE to a channel or a nick. Errors are not reported for NOTICE.
+func (c *client) privmsg(m message) {
+	target, text := m.params[0], m.params[1]
+	if target == "" {
+		c.reply(errNoRecipient, fmt.Sprintf("No recipient given (%s)", m.command))
+		return
+	} else if text == "" {
+		c.reply(errNoTextToSend, "No text to send")
+		return
+	}
+
+	msg := tcp.Message{Message: text}
+	if strings.HasPrefix(text, "\x01ACTION ") && strings.HasSuffix(text, "\x01") {
+		msg.Action = true
+		msg.Message = strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01")
+	} else if strings.HasPrefix(text, "\x01") {
+		// other CTCP requests (e.g. VERSION) are not supported
+		return
+	}
+
+	numeric := errNoSuchNick
+	if strings.HasPrefix(target, "#") {
+		msg.Room = target
+		numeric = errCannotSendToChan
+	} else {
+		msg.Recipient = target
+	}
+
+	if err := c.hub.Send(c.conn, msg); err != nil && m.command == "PRIVMSG" {
+		c.reply(numeric, target, err.Error())
+	}
+}
+
+// rename changes the nick of c
+func (c *client) rename(nick string) {
+	old := c.getNick()
+	if err := validateNick(nick); err != nil {
+		c.reply(errErroneusNick, nick, "Erroneous nickname")
+		return
+	}
+
+	// the nick is changed first so that the NICK message sent by the hub is recognized as our own
+	c.setNick(nick)
+	if err := c.hub.Rename(c.conn, nick); err == tcp.ErrNickReserved {
+		c.setNick(old)
+		c.reply(errNicknameInUse, nick, "Nickname is registered by another user")
+	} else if _, banned := err.(*tcp.BannedError); banned {
+		c.setNick(old)
+		c.reply(errErroneusNick, nick, "Nickname is banned")
+	} else if err != nil {
+		c.setNick(old)
+		c.reply(errNicknameInUse, nick, "Nickname is already in use")
+	}
+}
+
+// topic displays or changes the topic of a channel
+func (c *client) topic(m message) {
+	room, err := tcp.NormalizeRoom(m.params[0])
+	if err != nil {
+		c.reply(errNoSuchChannel, m.params[0], "No such channel")
+		return
+	}
+
+	if len(m.params) > 1 {
+		if err := c.hub.SetTopic(c.conn, room, m.params[1]); err != nil {
+			c.reply(errNotOnChannel, m.params[0], err.Error())
+		}
+		return
+	}
+
+	if topic := c.hub.Topic(room); topic != "" {
+		c.reply(rplTopic, "#"+room, topic)
+	} else {
+		c.reply(rplNoTopic, "#"+room, "No topic is set")
+	}
+}
+
+// who lists the members of a channel or a single user
+func (c *client) who(m message) {
+	mask := "*"
+	if len(m.params) > 0 {
+		mask = m.params[0]
+	}
+
+	var lines string
+	channel := "*"
+	var names []string
+	if strings.HasPrefix(mask, "#") {
+		if room, err := tcp.NormalizeRoom(mask); err == nil {
+			channel = "#" + room
+			names = c.hub.Members(room)
+		}
+	} else if c.hub.IsOnline(mask) {
+		names = []string{mask}
+	}
+	for _, name := range names {
+		nick := ircNick(name)
+		lines += formatMessage(serverName, rplWhoReply, c.getNick(), channel, nick, serverName, serverName, nick, "H", "0 "+name)
+	}
+	c.conn.Write([]byte(lines + formatMessage(serverName, rplEndOfWho, c.getNick(), mask, "End of /WHO list")))
+}
+
+// encode is the tcp.Encoder of c, which converts the messages sent by the hub into IRC protocol messages
+func (c *client) encode(m tcp.Message) []byte {
+	nick := c.getNick()
+	if m.Kind == tcp.KindSystem {
+		// notices from the server, e.g. the replies to commands such as /help
+		var lines string
+		for _, line := range strings.Split(strings.TrimRight(m.Message, "\r\n"), "\r\n") {
+			lines += formatMessage(serverName, "NOTICE", nick, line)
+		}
+		return []byte(lines)
+	}
+
+	// events are not replayed, the client would think that they just happened
+	if m.Replay && m.IsEvent() {
+		return nil
+	}
+
+	sender := ircNick(m.Sender)
+	prefix := fmt.Sprintf("%s!%s@%s", sender, sender, serverName)
+	channel := "#" + m.Room
+	if m.Room == "" {
+		channel = "#" + tcp.DefaultRoom
+	}
+
+	switch m.Kind {
+	case tcp.KindJoin:
+		line := formatMessage(prefix, "JOIN", channel)
+		if strings.EqualFold(m.Sender, nick) {
+			// a client that joined a channel is sent its topic and members
+			if topic := c.hub.Topic(m.Room); topic != "" {
+				line += formatMessage(serverName, rplTopic, nick, channel, topic)
+			}
+			line += c.names(channel)
+		}
+		return []byte(line)
+
+	case tcp.KindNick, tcp.KindQuit:
+		// the hub sends these events to every room of the sender, but IRC clients expect them once
+		event := m.Kind + " " + m.Sender + " " + m.Message
+		c.mutex.Lock()
+		duplicate := c.lastEvent == event && m.Time.Sub(c.lastTime) < time.Second
+		c.lastEvent = event
+		c.lastTime = m.Time
+		c.mutex.Unlock()
+		if duplicate {
+			return nil
+		}
+		if m.Kind == tcp.KindNick {
+			return []byte(formatMessage(prefix, "NICK", ircNick(m.Message)))
+		}
+		return []byte(formatMessage(prefix, "QUIT", tcp.Describe(m)))
+
+	case tcp.KindPart:
+		return []byte(formatMessage(prefix, "PART", channel))
+
+	case tcp.KindTopic:
+		return []byte(formatMessage(prefix, "TOPIC", channel, m.Message))
+	}
+
+	// IRC clients don't expect their own messages to be echoed
+	if !m.Replay && m.Source == tcp.SourceIRC && strings.EqualFold(m.Sender, nick) {
+		return nil
+	}
+
+	target := channel
+	if m.Recipient != "" {
+		target = nick
+	}
+	if m.Source == tcp.SourceHTTP {
+		// messages posted via HTTP are tagged so that they can't be mistaken for messages from a connected client
+		prefix = fmt.Sprintf("%s/http!http@%s", sender, serverName)
+	}
+
+	text := m.Message
+	if m.Replay {
+		text = fmt.Sprintf("[%s] %s", m.Time.Format("15:04:05"), text)
+	}
+	if m.Action {
+		text = "\x01ACTION " + text + "\x01"
+	}
+	return []byte(formatMessage(prefix, "PRIVMSG", target, text))
+}
+
+// validateNick will return an error if nick can't be used by an IRC client. In addition to the rules of the hub, IRC
+// nicknames may only contain letters, numbers and the characters -_.[]\`^{|} (see RFC 2812 section 2.3.1).
+func validateNick(nick string) error {
+	if err := tcp.ValidateNick(nick); err != nil {
+		return err
+	}
+	for _, r := range nick {
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.[]\\`^{|}", r)) {
+			return fmt.Errorf("invalid nickname %q", nick)
+		}
+	}
+	return nil
+}
+
+// ircNick converts the name of a hub client into a nick that can be sent to IRC clients. Names of telnet and HTTP
+// clients may contain spaces, which aren't allowed in IRC nicknames. The hub treats a space and an underscore as the
+// same character, so the nick is unique and IRC clients can use it to send private messages.
+func ircNick(name string) string {
+	return strings.Replace(name, " ", "_", -1)
+}
+
+// ircNicks converts the names of hub clients with ircNick
+func ircNicks(names []string) []string {
+	nicks := make([]string, len(names))
+	for i, name := range names {
+		nicks[i] = ircNick(name)
+	}
+	return nicks
+}
@@ -0,0 +1,216 @@
+package irc
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus"
+)
+
+// serverName is the name that the server uses as the prefix of its own messages
+const serverName = "telchat"
+
+// Handler serves the chat to IRC clients. Every IRC channel is a room of the hub, e.g. #lobby.
+type Handler struct {
+	address   string
+	done      chan struct{}
+	hub       *tcp.Handler
+	logger    *logrus.Logger
+	port      int
+	Ready     bool        // Indicates that the irc listener is ready to accept connections
+	startDone func()      // a callback that can be defined to do something once Start() has done all its work
+	TLSConfig *tls.Config // only accept TLS connections when set
+}
+
+// New initializes a new irc Handler that connects IRC clients to hub
+func New(address string, port int, hub *tcp.Handler, logger *logrus.Logger) *Handler {
+	return &Handler{
+		address: address,
+		done:    make(chan struct{}),
+		hub:     hub,
+		logger:  logger,
+		port:    port,
+	}
+}
+
+// Start will start the irc listener
+func (h *Handler) Start() error {
+	defer func() {
+		h.Ready = false
+		close(h.done)
+	}()
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", h.address, h.port))
+	if err != nil {
+		return err
+	}
+	if h.TLSConfig != nil {
+		listener = tls.NewListener(listener, h.TLSConfig)
+	}
+
+	stopping := make(chan struct{})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-stopping:
+					return
+				default:
+				}
+				h.logger.WithField("error", err).Error("error accepting connection")
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			go h.handleConn(conn)
+		}
+	}()
+
+	h.Ready = true
+	h.logger.WithFields(logrus.Fields{
+		"address": listener.Addr(),
+		"tls":     h.TLSConfig != nil,
+	}).Info("IRC listener accepting connections")
+
+	if h.startDone != nil {
+		h.startDone()
+	}
+
+	<-h.done
+	h.logger.Info("stopping irc listener...")
+	close(stopping)
+	return listener.Close()
+}
+
+// Stop will shutdown the IRC listener
+func (h *Handler) Stop() {
+	if h.Ready && h.done != nil {
+		h.done <- struct{}{}
+
+		// wait for the done channel to be closed (meaning the Start() func has actually stopped running)
+		<-h.done
+		h.done = nil
+	}
+}
+
+// handleConn reads the commands sent by the IRC client conn until it disconnects
+func (h *Handler) handleConn(conn net.Conn) {
+	if err := h.hub.Admit(conn); err != nil {
+		h.logger.WithFields(logrus.Fields{
+			"address.remote": conn.RemoteAddr(),
+			"error":          err,
+		}).Warn("rejected irc connection over the connection limit")
+		conn.Write([]byte(formatMessage("", "ERROR", "Closing Link: "+err.Error())))
+		conn.Close()
+		return
+	}
+	defer h.hub.Release(conn)
+
+	c := &client{conn: conn, hub: h.hub}
+	reader := bufio.NewReader(conn)
+
+	// clients must register within the time that telnet clients have to choose their name
+	if h.hub.NameTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(h.hub.NameTimeout))
+	}
+	for {
+		line, err := tcp.ReadLimitedLine(reader, h.hub.MaxLineLength)
+		if err == tcp.ErrLineTooLong {
+			c.reply(errInputTooLong, "Input line was too long")
+			continue
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			h.logger.WithField("address.remote", conn.RemoteAddr()).Warn("irc client didn't register in time")
+			conn.Write([]byte(formatMessage("", "ERROR", "Closing Link: registration timed out")))
+			break
+		} else if err != nil {
+			break
+		}
+		msg, ok := parseMessage(line)
+		if !ok {
+			continue
+		}
+
+		if !c.isRegistered() {
+			if err := c.register(msg); err != nil {
+				h.logger.WithFields(logrus.Fields{
+					"address.remote": conn.RemoteAddr(),
+					"error":          err,
+				}).Debug("irc registration failed")
+				break
+			} else if c.isRegistered() {
+				conn.SetReadDeadline(time.Time{})
+			}
+			continue
+		}
+		c.handle(msg)
+	}
+
+	if c.isRegistered() {
+		h.hub.Disconnect(conn)
+	} else {
+		conn.Close()
+	}
+}
+
+// message is a single parsed IRC protocol message
+type message struct {
+	command string
+	params  []string
+}
+
+// parseMessage will parse a line sent by a client, e.g. "PRIVMSG #lobby :hello there". ok is false for empty lines.
+func parseMessage(line string) (m message, ok bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, ":") {
+		// the prefix of messages sent by clients is ignored
+		if i := strings.Index(line, " "); i >= 0 {
+			line = line[i+1:]
+		} else {
+			return m, false
+		}
+	}
+
+	for line = strings.TrimLeft(line, " "); line != ""; line = strings.TrimLeft(line, " ") {
+		if m.command != "" && strings.HasPrefix(line, ":") {
+			m.params = append(m.params, line[1:])
+			break
+		}
+
+		word := line
+		if i := strings.Index(line, " "); i >= 0 {
+			word, line = line[:i], line[i+1:]
+		} else {
+			line = ""
+		}
+		if m.command == "" {
+			m.command = strings.ToUpper(word)
+		} else {
+			m.params = append(m.params, word)
+		}
+	}
+	return m, m.command != ""
+}
+
+// formatMessage will build a protocol line from prefix (optional), command and params. The last parameter is sent as
+// a trailing parameter when required.
+func formatMessage(prefix, command string, params ...string) string {
+	var b strings.Builder
+	if prefix != "" {
+		b.WriteString(":" + prefix + " ")
+	}
+	b.WriteString(command)
+	for i, p := range params {
+		b.WriteString(" ")
+		if i == len(params)-1 && (p == "" || strings.HasPrefix(p, ":") || strings.ContainsAny(p, " ")) {
+			b.WriteString(":")
+		}
+		b.WriteString(p)
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
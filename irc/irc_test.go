@@ -0,0 +1,289 @@
+package irc
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestParseMessage(t *testing.T) {
+	testCases := map[string]struct {
+		line string
+		eMsg message
+		eOk  bool
+	}{
+		"empty":           {"\r\n", message{}, false},
+		"command only":    {"quit\r\n", message{command: "QUIT"}, true},
+		"params":          {"USER alice 0 * :Alice Smith\r\n", message{"USER", []string{"alice", "0", "*", "Alice Smith"}}, true},
+		"prefix":          {":alice PRIVMSG #lobby :hi there\n", message{"PRIVMSG", []string{"#lobby", "hi there"}}, true},
+		"empty trailing":  {"TOPIC #lobby :\r\n", message{"TOPIC", []string{"#lobby", ""}}, true},
+		"extra spaces":    {"JOIN   #ops  \r\n", message{"JOIN", []string{"#ops"}}, true},
+		"colon in middle": {"PRIVMSG bob :a :b\r\n", message{"PRIVMSG", []string{"bob", "a :b"}}, true},
+	}
+
+	for k, v := range testCases {
+		m, ok := parseMessage(v.line)
+		if ok != v.eOk {
+			t.Errorf("%s: expected ok (%v) differed from actual ok (%v)", k, v.eOk, ok)
+		}
+		if ok && !reflect.DeepEqual(m, v.eMsg) {
+			t.Errorf("%s: expected message (%#v) differed from actual message (%#v)", k, v.eMsg, m)
+		}
+	}
+}
+
+func TestFormatMessage(t *testing.T) {
+	testCases := map[string]struct {
+		prefix  string
+		command string
+		params  []string
+		e       string
+	}{
+		"no params":      {"telchat", "PING", nil, ":telchat PING\r\n"},
+		"single word":    {"alice!alice@telchat", "JOIN", []string{"#lobby"}, ":alice!alice@telchat JOIN #lobby\r\n"},
+		"trailing":       {"telchat", "NOTICE", []string{"alice", "hello there"}, ":telchat NOTICE alice :hello there\r\n"},
+		"empty trailing": {"alice", "TOPIC", []string{"#lobby", ""}, ":alice TOPIC #lobby :\r\n"},
+		"no prefix":      {"", "ERROR", []string{"Closing Link: alice"}, "ERROR :Closing Link: alice\r\n"},
+	}
+
+	for k, v := range testCases {
+		if actual := formatMessage(v.prefix, v.command, v.params...); actual != v.e {
+			t.Errorf("%s: expected line (%q) differed from actual line (%q)", k, v.e, actual)
+		}
+	}
+}
+
+func TestValidateNick(t *testing.T) {
+	testCases := map[string]struct {
+		nick string
+		eErr bool
+	}{
+		"simple":    {"alice", false},
+		"irc chars": {"[alice]_-^{|}", false},
+		"space":     {"alice smith", true},
+		"prefix":    {"bad!nick", true},
+		"empty":     {"", true},
+	}
+
+	for k, v := range testCases {
+		if err := validateNick(v.nick); (err != nil) != v.eErr {
+			t.Errorf("%s: expected error (%v) differed from actual error (%v)", k, v.eErr, err)
+		}
+	}
+	if nick := ircNick("alice smith"); nick != "alice_smith" {
+		t.Errorf("expected the spaces of a name to be replaced (%q)", nick)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	hub := tcp.New("", 6024, logger)
+	hub.MaxLineLength = 100
+	hub.NameTimeout = 500 * time.Millisecond
+	go hub.Start()
+	<-hub.Listening()
+	defer hub.Stop()
+
+	h := New("", 6026, hub, logger)
+	started := make(chan struct{})
+	h.startDone = func() {
+		close(started)
+	}
+	go h.Start()
+	<-started
+	defer h.Stop()
+
+	alice, aliceReader := dial(t)
+	defer alice.Close()
+	fmt.Fprintf(alice, "PRIVMSG #lobby :too early\r\n")
+	expectLines(t, aliceReader, ":telchat 451 \\* :You have not registered")
+	fmt.Fprintf(alice, "NICK bad!nick\r\n")
+	expectLines(t, aliceReader, ":telchat 432 \\* bad!nick :Erroneous nickname")
+	fmt.Fprintf(alice, "NICK alice\r\nUSER alice 0 * :Alice\r\n")
+	expectLines(t, aliceReader,
+		":telchat 001 alice :Welcome to telchat alice",
+		":telchat 002 .*", ":telchat 003 .*", ":telchat 004 .*", ":telchat 422 .*",
+		":telchat NOTICE alice :Welcome to telchat alice",
+		":alice!alice@telchat JOIN #lobby",
+		":telchat 353 alice = #lobby :alice",
+		":telchat 366 alice #lobby :End of /NAMES list",
+	)
+
+	bob, bobReader := dial(t)
+	defer bob.Close()
+	fmt.Fprintf(bob, "NICK ALICE\r\n")
+	expectLines(t, bobReader, ":telchat 433 \\* ALICE :Nickname is already in use")
+	fmt.Fprintf(bob, "NICK bob\r\nUSER bob 0 * :Bob\r\n")
+	expectLines(t, bobReader,
+		":telchat 001 .*", ":telchat 002 .*", ":telchat 003 .*", ":telchat 004 .*", ":telchat 422 .*",
+		":telchat NOTICE bob .*",
+		":bob!bob@telchat JOIN #lobby",
+		":telchat 353 bob = #lobby :alice bob",
+		":telchat 366 .*",
+	)
+	expectLines(t, aliceReader, ":bob!bob@telchat JOIN #lobby")
+	fmt.Fprintf(bob, "PRIVMSG #lobby :%s\r\n", strings.Repeat("a", 100))
+	expectLines(t, bobReader, ":telchat 417 bob :Input line was too long")
+
+	// IRC clients and telnet clients talk to each other, without echoing messages to the IRC sender
+	carol, err := net.Dial("tcp", net.JoinHostPort("localhost", "6024"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer carol.Close()
+	carol.SetDeadline(time.Now().Add(5 * time.Second))
+	carolReader := bufio.NewReader(carol)
+	carolReader.ReadString('\n')
+	fmt.Fprintf(carol, "carol\r\n")
+	carolReader.ReadString('\n')
+	carolReader.ReadString('\n')
+	expectLines(t, aliceReader, ":carol!carol@telchat JOIN #lobby")
+	expectLines(t, bobReader, ":carol!carol@telchat JOIN #lobby")
+
+	fmt.Fprintf(alice, "PRIVMSG #lobby :hello everyone\r\n")
+	expectLines(t, bobReader, ":alice!alice@telchat PRIVMSG #lobby :hello everyone")
+	expectLines(t, carolReader, "[0-9:]+ alice: hello everyone")
+	fmt.Fprintf(carol, "hi alice\r\n")
+	expectLines(t, carolReader, "[0-9:]+ carol: hi alice")
+	expectLines(t, aliceReader, ":carol!carol@telchat PRIVMSG #lobby :hi alice")
+	expectLines(t, bobReader, ":carol!carol@telchat PRIVMSG #lobby :hi alice")
+	fmt.Fprintf(alice, "PRIVMSG bob :\x01ACTION waves\x01\r\n")
+	expectLines(t, bobReader, ":alice!alice@telchat PRIVMSG bob :\x01ACTION waves\x01")
+	fmt.Fprintf(alice, "PRIVMSG dave :hello?\r\n")
+	expectLines(t, aliceReader, ":telchat 401 alice dave :dave is not online")
+
+	// spaces in names are shown as underscores, which can be used to reach the client
+	fmt.Fprintf(carol, "/nick carol ann\r\n")
+	expectLines(t, aliceReader, ":carol!carol@telchat NICK carol_ann")
+	expectLines(t, bobReader, ":carol!carol@telchat NICK carol_ann")
+	fmt.Fprintf(alice, "PRIVMSG carol_ann :psst\r\n")
+	expectLines(t, carolReader, "[0-9:]+ carol: Is now known as carol ann", "[0-9:]+ alice -> carol ann: psst")
+	fmt.Fprintf(carol, "/nick carol\r\n")
+	expectLines(t, aliceReader, ":carol_ann!carol_ann@telchat NICK carol")
+	expectLines(t, bobReader, ":carol_ann!carol_ann@telchat NICK carol")
+	expectLines(t, carolReader, "[0-9:]+ carol ann: Is now known as carol")
+
+	// channels are rooms
+	fmt.Fprintf(alice, "JOIN #ops\r\n")
+	expectLines(t, aliceReader, ":alice!alice@telchat JOIN #ops", ":telchat 353 alice = #ops :alice", ":telchat 366 .*")
+	fmt.Fprintf(alice, "TOPIC #ops :deploys only\r\n")
+	expectLines(t, aliceReader, ":alice!alice@telchat TOPIC #ops :deploys only")
+	fmt.Fprintf(carol, "/join ops\r\n")
+	expectLines(t, carolReader, "Now talking in ops, the topic is: deploys only", "[0-9:]+ \\[ops\\] carol: Joined")
+	expectLines(t, aliceReader, ":carol!carol@telchat JOIN #ops")
+	fmt.Fprintf(bob, "PRIVMSG #ops :let me in\r\n")
+	expectLines(t, bobReader, ":telchat 404 bob #ops :You are not in ops")
+	fmt.Fprintf(bob, "WHO #ops\r\n")
+	expectLines(t, bobReader,
+		":telchat 352 bob #ops alice telchat telchat alice H :0 alice",
+		":telchat 352 bob #ops carol telchat telchat carol H :0 carol",
+		":telchat 315 bob #ops :End of /WHO list",
+	)
+	fmt.Fprintf(alice, "PART #ops\r\n")
+	expectLines(t, aliceReader, ":alice!alice@telchat PART #ops")
+	expectLines(t, carolReader, "[0-9:]+ \\[ops\\] alice: Left")
+
+	// nick changes and quits are sent once, even when sharing multiple channels
+	fmt.Fprintf(carol, "/nick dave\r\n")
+	expectLines(t, aliceReader, ":carol!carol@telchat NICK dave")
+	expectLines(t, bobReader, ":carol!carol@telchat NICK dave")
+	hub.Bans.Add(tcp.Ban{Kind: tcp.BanNick, Value: "spammer"})
+	fmt.Fprintf(bob, "NICK Spammer\r\n")
+	expectLines(t, bobReader, ":telchat 432 bob Spammer :Nickname is banned")
+	fmt.Fprintf(bob, "NICK robert\r\n")
+	expectLines(t, bobReader, ":bob!bob@telchat NICK robert")
+	expectLines(t, aliceReader, ":bob!bob@telchat NICK robert")
+	fmt.Fprintf(bob, "PING :12345\r\n")
+	expectLines(t, bobReader, ":telchat PONG telchat 12345")
+	fmt.Fprintf(bob, "QUIT :lunch\r\n")
+	expectLines(t, aliceReader, ":robert!robert@telchat QUIT :Disconnected \\(lunch\\)")
+
+	// other telchat commands are available as raw commands, and registered nicks require PASS
+	fmt.Fprintf(alice, "REGISTER correct horse\r\n")
+	expectLines(t, aliceReader, ":telchat NOTICE alice :Registered alice, enter your password the next time you connect")
+	fmt.Fprintf(alice, "QUIT\r\n")
+	expectLines(t, aliceReader, "ERROR :Closing Link: alice")
+
+	eve, eveReader := dial(t)
+	defer eve.Close()
+	fmt.Fprintf(eve, "PASS wrong\r\nNICK alice\r\nUSER eve 0 * :Eve\r\n")
+	expectLines(t, eveReader, ":telchat 464 alice :Password incorrect", "ERROR :Closing Link: invalid password")
+
+	alice, aliceReader = dial(t)
+	defer alice.Close()
+	fmt.Fprintf(alice, "PASS :correct horse\r\nNICK alice\r\nUSER alice 0 * :Alice\r\n")
+	expectLines(t, aliceReader, ":telchat 001 alice :Welcome to telchat alice")
+
+	// clients that don't register in time are disconnected
+	mallory, malloryReader := dial(t)
+	defer mallory.Close()
+	fmt.Fprintf(mallory, "NICK mallory\r\n")
+	expectLines(t, malloryReader, "ERROR :Closing Link: registration timed out")
+}
+
+func TestHandler_ConnectionLimits(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	hub := tcp.New("", 6060, logger)
+	hub.MaxConnectionsPerIP = 1
+	go hub.Start()
+	<-hub.Listening()
+	defer hub.Stop()
+
+	h := New("", 6062, hub, logger)
+	started := make(chan struct{})
+	h.startDone = func() {
+		close(started)
+	}
+	go h.Start()
+	<-started
+	defer h.Stop()
+
+	// the connections to the TCP listener count towards the limits of the IRC listener
+	telnet, err := net.Dial("tcp", net.JoinHostPort("localhost", "6060"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer telnet.Close()
+	telnet.SetDeadline(time.Now().Add(5 * time.Second))
+	bufio.NewReader(telnet).ReadString('\n')
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("localhost", "6062"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	expectLines(t, bufio.NewReader(conn), "ERROR :Closing Link: Too many connections from your address, please try again later")
+}
+
+// dial will connect to the irc listener
+func dial(t *testing.T) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", net.JoinHostPort("localhost", "6026"))
+	if err != nil {
+		t.Fatalf("failed to connect to irc listener -> %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+// expectLines will read one line per pattern from reader and match it against the pattern, in order
+func expectLines(t *testing.T, reader *bufio.Reader, patterns ...string) {
+	t.Helper()
+	for _, p := range patterns {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected a line matching %q -> %s", p, err)
+		}
+		if !regexp.MustCompile("^" + p + "\r\n$").MatchString(line) {
+			t.Errorf("expected line matching (%q) differed from actual line (%q)", p, line)
+		}
+	}
+}
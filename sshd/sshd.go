@@ -0,0 +1,506 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Handler serves the chat over SSH. Each SSH session is connected to the hub as a client named after the SSH user.
+// Clients authenticate with a public key listed in AuthorizedKeysFile, or with the password of their registered
+// account if PasswordAuth is set.
+type Handler struct {
+	address            string
+	AuthorizedKeysFile string // the authorized_keys style file listing the public keys that are allowed to connect
+	done               chan struct{}
+	HostKey            ssh.Signer // the private key that identifies the server to clients
+	hub                *tcp.Handler
+	logger             *logrus.Logger
+	PasswordAuth       bool // whether registered accounts may log in with their password instead of a listed key
+	port               int
+	Ready              bool   // Indicates that the ssh listener is ready to accept connections
+	startDone          func() // a callback that can be defined to do something once Start() has done all its work
+}
+
+// New initializes a new ssh Handler that connects SSH sessions to hub
+func New(address string, port int, hub *tcp.Handler, logger *logrus.Logger) *Handler {
+	return &Handler{
+		address: address,
+		done:    make(chan struct{}),
+		hub:     hub,
+		logger:  logger,
+		port:    port,
+	}
+}
+
+// Start will start the ssh listener
+func (h *Handler) Start() error {
+	defer func() {
+		h.Ready = false
+		close(h.done)
+	}()
+	if h.HostKey == nil {
+		return errors.New("no host key configured")
+	}
+
+	config := &ssh.ServerConfig{PublicKeyCallback: h.authenticate}
+	if h.PasswordAuth {
+		config.PasswordCallback = h.login
+	}
+	config.AddHostKey(h.HostKey)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", h.address, h.port))
+	if err != nil {
+		return err
+	}
+
+	stopping := make(chan struct{})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-stopping:
+					return
+				default:
+				}
+				h.logger.WithField("error", err).Error("error accepting connection")
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			go h.handleConn(conn, config)
+		}
+	}()
+
+	h.Ready = true
+	h.logger.WithFields(logrus.Fields{
+		"address": listener.Addr(),
+	}).Info("SSH listener accepting connections")
+
+	if h.startDone != nil {
+		h.startDone()
+	}
+
+	<-h.done
+	h.logger.Info("stopping ssh listener...")
+	close(stopping)
+	return listener.Close()
+}
+
+// Stop will shutdown the SSH listener
+func (h *Handler) Stop() {
+	if h.Ready && h.done != nil {
+		h.done <- struct{}{}
+
+		// wait for the done channel to be closed (meaning the Start() func has actually stopped running)
+		<-h.done
+		h.done = nil
+	}
+}
+
+// authenticate accepts a client if its public key is listed in h.AuthorizedKeysFile. The file is read on every
+// attempt so that keys can be added and removed without restarting telchat.
+func (h *Handler) authenticate(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	authorized, err := LoadAuthorizedKeys(h.AuthorizedKeysFile)
+	if err != nil {
+		h.logger.WithField("error", err).Error("error loading ssh authorized keys")
+		return nil, errors.New("unable to verify public key")
+	}
+
+	for _, k := range authorized {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return &ssh.Permissions{Extensions: map[string]string{"fingerprint": ssh.FingerprintSHA256(key)}}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown public key for %s", meta.User())
+}
+
+// login accepts a client that provides the password of the registered account named after the SSH user. The client
+// is logged into the account.
+func (h *Handler) login(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	if err := h.hub.Authenticate(meta.User(), string(password)); err != nil {
+		h.logger.WithFields(logrus.Fields{
+			"address.remote": meta.RemoteAddr(),
+			"user":           meta.User(),
+		}).Warn("failed ssh login")
+		return nil, fmt.Errorf("invalid password for %s", meta.User())
+	}
+	return &ssh.Permissions{Extensions: map[string]string{"account": meta.User()}}, nil
+}
+
+// handleConn performs the SSH handshake on conn and serves the session channels opened by the client
+func (h *Handler) handleConn(conn net.Conn, config *ssh.ServerConfig) {
+	// the connection is counted until the client disconnects, which ends the loop over its channels below
+	if err := h.hub.Admit(conn); err != nil {
+		h.logger.WithFields(logrus.Fields{
+			"address.remote": conn.RemoteAddr(),
+			"error":          err,
+		}).Warn("rejected ssh connection over the connection limit")
+		conn.Close()
+		return
+	}
+	defer h.hub.Release(conn)
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		h.logger.WithFields(logrus.Fields{
+			"address.remote": conn.RemoteAddr(),
+			"error":          err,
+		}).Debug("ssh handshake failed")
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	go ssh.DiscardRequests(requests)
+
+	h.logger.WithFields(logrus.Fields{
+		"account":        sshConn.Permissions.Extensions["account"],
+		"address.remote": sshConn.RemoteAddr(),
+		"fingerprint":    sshConn.Permissions.Extensions["fingerprint"],
+		"user":           sshConn.User(),
+	}).Info("ssh client authenticated")
+
+	// every session ends on its own, the connection is closed once the last one has ended
+	var mutex sync.Mutex
+	sessions := 0
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			h.logger.WithField("error", err).Debug("error accepting ssh channel")
+			continue
+		}
+		mutex.Lock()
+		sessions++
+		mutex.Unlock()
+		go func() {
+			h.handleSession(sshConn, channel, requests)
+			mutex.Lock()
+			sessions--
+			last := sessions == 0
+			mutex.Unlock()
+			if last {
+				sshConn.Close()
+			}
+		}()
+	}
+}
+
+// handleSession waits for the client to request a shell and then connects the session to the hub. When the client
+// requested a PTY the input is read using a line editor which echoes keystrokes and keeps the line being typed
+// intact while messages arrive.
+func (h *Handler) handleSession(sshConn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) {
+	conn := &sessionConn{channel: channel, sshConn: sshConn}
+	started := false
+
+	// the client must start its shell within the time that telnet clients have to choose their name
+	if h.hub.NameTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(h.hub.NameTimeout))
+	}
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			termType, width, height, ok := parsePtyRequest(req.Payload)
+			if ok && !started {
+				conn.term = terminal.NewTerminal(struct {
+					io.Reader
+					io.Writer
+				}{conn, channel}, "> ")
+				conn.term.AutoCompleteCallback = conn.secret.Mask
+				conn.term.SetSize(width, height)
+				conn.termType = termType
+			}
+			req.Reply(ok && !started, nil)
+
+		case "window-change":
+			if width, height, ok := parseWindowChange(req.Payload); ok && conn.term != nil {
+				conn.term.SetSize(width, height)
+			}
+			req.Reply(false, nil)
+
+		case "shell":
+			req.Reply(!started, nil)
+			if !started {
+				started = true
+				go h.chat(conn)
+			}
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// chat connects conn to the hub and passes every line typed by the client to the hub until the session ends
+func (h *Handler) chat(conn *sessionConn) {
+	conn.SetReadDeadline(time.Time{})
+	name := conn.sshConn.User()
+	connect := h.hub.Connect
+	if conn.sshConn.Permissions.Extensions["account"] != "" {
+		connect = h.hub.ConnectAccount
+	}
+	if err := connect(conn, name, tcp.SourceSSH, tcp.TextEncoder); err == tcp.ErrNickInUse {
+		fmt.Fprintf(conn, "The name %s is already in use, please connect with another user name\r\n", name)
+		conn.Close()
+		return
+	} else if _, banned := err.(*tcp.BannedError); banned {
+		fmt.Fprintf(conn, "%s\r\n", err)
+		conn.Close()
+		return
+	} else if (err == tcp.ErrNickReserved || err == tcp.ErrAccountRequired) && h.PasswordAuth {
+		fmt.Fprintf(conn, "The name %s requires a password, please connect using password authentication\r\n", name)
+		conn.Close()
+		return
+	} else if err == tcp.ErrNickReserved || err == tcp.ErrAccountRequired {
+		fmt.Fprintf(conn, "The name %s belongs to an account, please connect with another user name\r\n", name)
+		conn.Close()
+		return
+	} else if err != nil {
+		fmt.Fprintf(conn, "%s, please connect with another user name\r\n", err)
+		conn.Close()
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	readLine := func() (string, error) {
+		return tcp.ReadLimitedLine(reader, h.hub.MaxLineLength)
+	}
+	if conn.term != nil {
+		readLine = func() (string, error) {
+			line, err := conn.term.ReadLine()
+			return conn.secret.Reveal(line), err
+		}
+	}
+	for {
+		if h.hub.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(h.hub.IdleTimeout))
+		}
+		line, err := readLine()
+		if err == tcp.ErrLineTooLong {
+			h.hub.LineTooLong(conn)
+			continue
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// the session was closed by the deadline, so only the other clients are told why it ended
+			h.logger.WithFields(logrus.Fields{
+				"address.remote": conn.RemoteAddr(),
+				"name":           name,
+			}).Info("disconnecting idle ssh client")
+			h.hub.Quit(conn, "Idle timeout")
+			break
+		} else if err != nil {
+			break
+		}
+		h.hub.Input(conn, line)
+	}
+	h.hub.Disconnect(conn)
+}
+
+// errTimeout is returned by the reads and writes of a sessionConn that were ended by a deadline
+var errTimeout net.Error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// deadline calls a function once a point in time has passed, unless it is moved before
+type deadline struct {
+	mutex   sync.Mutex
+	expired bool
+	timer   *time.Timer
+}
+
+// set will call expire once t has passed, replacing the previous deadline. The zero time disables the deadline.
+func (d *deadline) set(t time.Time, expire func()) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.expired, d.timer = false, nil
+	if t.IsZero() {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(t), func() {
+		d.mutex.Lock()
+		// a timer that was stopped too late must not expire the deadline that replaced it
+		current := d.timer == timer
+		d.expired = d.expired || current
+		d.mutex.Unlock()
+		if current {
+			expire()
+		}
+	})
+	d.timer = timer
+}
+
+// hasExpired reports whether the deadline has passed
+func (d *deadline) hasExpired() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.expired
+}
+
+// sessionConn adapts an SSH session to a net.Conn so that it can be registered with the hub. An SSH channel has no
+// deadlines of its own, so the session is closed once a deadline has passed, which ends any pending read or write. A
+// write deadline only applies to the next write, so that an idle session isn't closed by the deadline of its last
+// write.
+type sessionConn struct {
+	channel       ssh.Channel
+	mutex         sync.Mutex
+	readDeadline  deadline
+	secret        tcp.SecretInput // hides the passwords typed into term
+	sshConn       *ssh.ServerConn
+	term          *terminal.Terminal // nil if the client didn't request a PTY
+	termType      string             // the terminal type requested with the PTY, e.g. "xterm"
+	writeDeadline deadline
+}
+
+func (c *sessionConn) Read(b []byte) (int, error) {
+	n, err := c.channel.Read(b)
+	if err != nil && c.readDeadline.hasExpired() {
+		return n, errTimeout
+	}
+	return n, err
+}
+
+func (c *sessionConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	defer c.writeDeadline.set(time.Time{}, nil)
+	if c.term == nil {
+		n, err := c.channel.Write(b)
+		if err != nil && c.writeDeadline.hasExpired() {
+			return n, errTimeout
+		}
+		return n, err
+	}
+
+	// the terminal translates line endings itself
+	if _, err := c.term.Write(bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1)); err != nil {
+		if c.writeDeadline.hasExpired() {
+			return 0, errTimeout
+		}
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// TerminalType implements tcp.TerminalTyper
+func (c *sessionConn) TerminalType() string {
+	return c.termType
+}
+
+// Close will end the session. Other sessions of the same SSH connection are not affected.
+func (c *sessionConn) Close() error {
+	return c.channel.Close()
+}
+
+func (c *sessionConn) LocalAddr() net.Addr  { return c.sshConn.LocalAddr() }
+func (c *sessionConn) RemoteAddr() net.Addr { return c.sshConn.RemoteAddr() }
+
+func (c *sessionConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *sessionConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t, func() { c.channel.Close() })
+	return nil
+}
+
+func (c *sessionConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t, func() { c.channel.Close() })
+	return nil
+}
+
+// parsePtyRequest returns the terminal type and size contained in the payload of a "pty-req" request
+func parsePtyRequest(payload []byte) (termType string, width, height int, ok bool) {
+	var req struct {
+		Term     string
+		Columns  uint32
+		Rows     uint32
+		Width    uint32
+		Height   uint32
+		Modelist string
+	}
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return "", 0, 0, false
+	}
+	return req.Term, int(req.Columns), int(req.Rows), true
+}
+
+// parseWindowChange returns the terminal size contained in the payload of a "window-change" request
+func parseWindowChange(payload []byte) (width, height int, ok bool) {
+	if len(payload) < 8 {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint32(payload)), int(binary.BigEndian.Uint32(payload[4:])), true
+}
+
+// LoadAuthorizedKeys will parse the public keys listed in an authorized_keys style file
+func LoadAuthorizedKeys(file string) ([]ssh.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// ParseAuthorizedKey skips blank lines, comments and lines that don't contain a key, and fails once no keys remain
+	var keys []ssh.PublicKey
+	for {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return keys, nil
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+}
+
+// LoadHostKey will read the PEM encoded private host key from file. A new key is generated and written to file if it
+// doesn't exist yet.
+func LoadHostKey(file string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		if err := ioutil.WriteFile(file, data, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
@@ -0,0 +1,349 @@
+package sshd
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a host key is generated on first use and loaded afterwards
+	hostKey, err := LoadHostKey(filepath.Join(dir, "host_key"))
+	if err != nil {
+		t.Fatalf("failed to generate host key -> %s", err)
+	}
+	if again, err := LoadHostKey(filepath.Join(dir, "host_key")); err != nil || string(again.PublicKey().Marshal()) != string(hostKey.PublicKey().Marshal()) {
+		t.Errorf("expected the generated host key to be loaded again -> %v", err)
+	}
+
+	authorized, unauthorized := newSigner(t), newSigner(t)
+	authorizedKeys := "# the team\n\n" + string(ssh.MarshalAuthorizedKey(authorized.PublicKey())) + "# end\n"
+	ioutil.WriteFile(filepath.Join(dir, "authorized_keys"), []byte(authorizedKeys), 0600)
+
+	logger, _ := test.NewNullLogger()
+	hub := tcp.New("", 6020, logger)
+	hub.HistorySize = 0
+	hub.MaxLineLength = 100
+	go hub.Start()
+	<-hub.Listening()
+	defer hub.Stop()
+
+	h := New("", 6022, hub, logger)
+	h.AuthorizedKeysFile = filepath.Join(dir, "authorized_keys")
+	h.HostKey = hostKey
+	h.PasswordAuth = true
+	started := make(chan struct{})
+	h.startDone = func() {
+		close(started)
+	}
+	go h.Start()
+	<-started
+	defer h.Stop()
+
+	if _, err := dial("alice", unauthorized); err == nil {
+		t.Errorf("expected a key that isn't authorized to be rejected")
+	}
+
+	// a session with a PTY uses a line editor that echoes the input
+	alice, err := dial("alice", authorized)
+	if err != nil {
+		t.Fatalf("failed to connect -> %s", err)
+	}
+	defer alice.Close()
+	aliceSession, aliceIn, aliceOut := shell(t, alice, true)
+	defer aliceSession.Close()
+	expectOutput(t, aliceOut, "Welcome to telchat alice")
+	expectOutput(t, aliceOut, "alice: Joined")
+
+	// a session without a PTY is line based, like a telnet client
+	bob, err := dial("bob", authorized)
+	if err != nil {
+		t.Fatalf("failed to connect -> %s", err)
+	}
+	defer bob.Close()
+	bobSession, bobIn, bobOut := shell(t, bob, false)
+	defer bobSession.Close()
+	expectOutput(t, bobOut, "Welcome to telchat bob")
+	expectOutput(t, aliceOut, "bob: Joined")
+
+	io.WriteString(aliceIn, "hi bob\r")
+	expectOutput(t, aliceOut, "alice: hi bob")
+	expectOutput(t, bobOut, "alice: hi bob")
+	io.WriteString(bobIn, "/who\n")
+	expectOutput(t, bobOut, "Users in lobby (2): alice, bob")
+	io.WriteString(bobIn, strings.Repeat("x", 200)+"\n")
+	expectOutput(t, bobOut, "Lines can't be longer than 100 bytes")
+
+	// the name is taken from the SSH user, so it must be free
+	carol, err := dial("ALICE", authorized)
+	if err != nil {
+		t.Fatalf("failed to connect -> %s", err)
+	}
+	defer carol.Close()
+	_, _, carolOut := shell(t, carol, false)
+	expectOutput(t, carolOut, "The name ALICE is already in use, please connect with another user name")
+
+	// a second session of alice can't use the name either, which doesn't end the first session
+	_, _, secondOut := shell(t, alice, false)
+	expectOutput(t, secondOut, "The name alice is already in use, please connect with another user name")
+	io.WriteString(aliceIn, "still here\r")
+	expectOutput(t, bobOut, "alice: still here")
+
+	io.WriteString(bobIn, "/quit\n")
+	expectOutput(t, aliceOut, "bob: Disconnected")
+
+	// registered names require the password of the account instead of a key
+	if err := hub.Register("dave", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	dave, err := dial("dave", authorized)
+	if err != nil {
+		t.Fatalf("failed to connect -> %s", err)
+	}
+	defer dave.Close()
+	_, _, daveOut := shell(t, dave, false)
+	expectOutput(t, daveOut, "The name dave requires a password, please connect using password authentication")
+	if _, err := dialPassword("dave", "wrong"); err == nil {
+		t.Errorf("expected a wrong password to be rejected")
+	}
+	dave, err = dialPassword("dave", "correct horse")
+	if err != nil {
+		t.Fatalf("failed to connect -> %s", err)
+	}
+	defer dave.Close()
+	_, _, daveOut = shell(t, dave, false)
+	expectOutput(t, daveOut, "Welcome to telchat dave")
+}
+
+func TestHandler_ConnectionLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hostKey, err := LoadHostKey(filepath.Join(dir, "host_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger, _ := test.NewNullLogger()
+	hub := tcp.New("", 6064, logger)
+	hub.MaxConnectionsPerIP = 1
+	go hub.Start()
+	<-hub.Listening()
+	defer hub.Stop()
+
+	h := New("", 6066, hub, logger)
+	h.HostKey = hostKey
+	h.PasswordAuth = true
+	started := make(chan struct{})
+	h.startDone = func() {
+		close(started)
+	}
+	go h.Start()
+	<-started
+	defer h.Stop()
+
+	// the connections to the TCP listener count towards the limits of the SSH listener
+	telnet, err := net.Dial("tcp", net.JoinHostPort("localhost", "6064"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer telnet.Close()
+	telnet.SetDeadline(time.Now().Add(5 * time.Second))
+	bufio.NewReader(telnet).ReadString('\n')
+
+	// connections over the limit are closed before the SSH handshake
+	conn, err := net.Dial("tcp", net.JoinHostPort("localhost", "6066"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+		t.Errorf("expected a connection over the limit to be closed, got %q", line)
+	}
+}
+
+func TestHandler_Timeouts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hostKey, err := LoadHostKey(filepath.Join(dir, "host_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := newSigner(t)
+	ioutil.WriteFile(filepath.Join(dir, "authorized_keys"), ssh.MarshalAuthorizedKey(key.PublicKey()), 0600)
+
+	logger, _ := test.NewNullLogger()
+	hub := tcp.New("", 6070, logger)
+	hub.HistorySize = 0
+	hub.IdleTimeout = time.Second
+	hub.NameTimeout = 300 * time.Millisecond
+	hub.WriteTimeout = 100 * time.Millisecond
+	go hub.Start()
+	<-hub.Listening()
+	defer hub.Stop()
+
+	h := New("", 6072, hub, logger)
+	h.AuthorizedKeysFile = filepath.Join(dir, "authorized_keys")
+	h.HostKey = hostKey
+	started := make(chan struct{})
+	h.startDone = func() {
+		close(started)
+	}
+	go h.Start()
+	<-started
+	defer h.Stop()
+
+	// the connection ends along with its last session, so every session uses its own connection
+	config := &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	}
+	client, err := ssh.Dial("tcp", net.JoinHostPort("localhost", "6072"), config)
+	if err != nil {
+		t.Fatalf("failed to connect -> %s", err)
+	}
+	defer client.Close()
+
+	// a session that doesn't start its shell within NameTimeout is closed
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := session.StdoutPipe()
+	closed := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(out)
+		closed <- err
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected a session without a shell to be closed")
+	}
+
+	// the write deadline of the last message doesn't close an idle session, IdleTimeout does
+	client, err = ssh.Dial("tcp", net.JoinHostPort("localhost", "6072"), config)
+	if err != nil {
+		t.Fatalf("failed to connect -> %s", err)
+	}
+	defer client.Close()
+	_, in, reader := shell(t, client, false)
+	expectOutput(t, reader, "Welcome to telchat alice")
+	time.Sleep(300 * time.Millisecond)
+	io.WriteString(in, "/who\n")
+	expectOutput(t, reader, "Users in lobby (1): alice")
+	closed = make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(reader)
+		closed <- err
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected an idle session to be closed")
+	}
+}
+
+// newSigner will generate a new private key for a client
+func newSigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// dial will connect to the ssh listener as user, authenticating with key
+func dial(user string, key ssh.Signer) (*ssh.Client, error) {
+	return connect(user, ssh.PublicKeys(key))
+}
+
+// dialPassword will connect to the ssh listener as user, authenticating with password
+func dialPassword(user, password string) (*ssh.Client, error) {
+	return connect(user, ssh.Password(password))
+}
+
+// connect will connect to the ssh listener as user, authenticating with auth
+func connect(user string, auth ssh.AuthMethod) (*ssh.Client, error) {
+	conn, err := net.Dial("tcp", net.JoinHostPort("localhost", "6022"))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	c, channels, requests, err := ssh.NewClientConn(conn, "localhost", config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, channels, requests), nil
+}
+
+// shell will start a shell session on client, optionally with a PTY
+func shell(t *testing.T, client *ssh.Client, pty bool) (*ssh.Session, io.Writer, *bufio.Reader) {
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("failed to open session -> %s", err)
+	}
+	if pty {
+		// a terminal without colors, so that the output can be matched as plain text
+		if err := session.RequestPty("vt100", 40, 80, ssh.TerminalModes{}); err != nil {
+			t.Fatalf("failed to request pty -> %s", err)
+		}
+	}
+	in, _ := session.StdinPipe()
+	out, _ := session.StdoutPipe()
+	if err := session.Shell(); err != nil {
+		t.Fatalf("failed to start shell -> %s", err)
+	}
+	return session, in, bufio.NewReader(out)
+}
+
+// expectOutput will read from reader until a line containing text is found
+func expectOutput(t *testing.T, reader *bufio.Reader, text string) {
+	t.Helper()
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.Contains(line, text) {
+			return
+		} else if err != nil {
+			t.Fatalf("expected output %q was not received -> %s", text, err)
+		}
+	}
+}
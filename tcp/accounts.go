@@ -0,0 +1,294 @@
+package tcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MinPasswordLength is the minimum number of characters required in the password of an account
+const MinPasswordLength = 8
+
+// MaxLoginAttempts is the number of wrong passwords that a telnet client may enter before it is disconnected
+const MaxLoginAttempts = 3
+
+var (
+	// ErrAccountRequired is returned when a guest tries to connect while the Handler only accepts registered accounts
+	ErrAccountRequired = errors.New("only registered accounts may connect")
+
+	// ErrAccountExists is returned when registering a name that already belongs to an account
+	ErrAccountExists = errors.New("name is already registered")
+
+	// ErrInvalidPassword is returned when a password doesn't match the password of an account
+	ErrInvalidPassword = errors.New("invalid password")
+
+	// ErrNickReserved is returned when a client tries to use a name that belongs to an account it isn't logged into
+	ErrNickReserved = errors.New("name is registered")
+
+	// ErrNoAccount is returned by a UserStore when no account exists for a name
+	ErrNoAccount = errors.New("no such account")
+)
+
+// Account is a registered user. The name of an account is reserved for clients that log into the account.
+type Account struct {
+	Created      time.Time `json:"created"`
+	Name         string    `json:"name"`
+	Operator     bool      `json:"operator,omitempty"` // whether the account was created by the operator with CreateAccount
+	PasswordHash []byte    `json:"password_hash"`      // the bcrypt hash of the password
+	Role         string    `json:"role,omitempty"`     // e.g. RoleModerator, accounts without a role have RoleUser
+}
+
+// UserStore persists the accounts of registered users. Names are case-insensitive.
+type UserStore interface {
+	// Get will return the account named name or ErrNoAccount if there is none. Names are compared like the names of
+	// clients, so "Alice Smith" finds the account alice_smith.
+	Get(name string) (Account, error)
+
+	// Put will create the account a or replace the account with the same name
+	Put(a Account) error
+
+	// Close will release all resources held by the UserStore
+	Close() error
+}
+
+// MemoryUserStore is a UserStore that keeps accounts in memory. All accounts are lost when the process exits.
+type MemoryUserStore struct {
+	accounts map[string]Account
+	mutex    sync.RWMutex
+}
+
+// NewMemoryUserStore will create an empty MemoryUserStore
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{accounts: make(map[string]Account)}
+}
+
+// Get implements UserStore
+func (s *MemoryUserStore) Get(name string) (Account, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	a, ok := s.accounts[nameKey(name)]
+	if !ok {
+		return Account{}, ErrNoAccount
+	}
+	return a, nil
+}
+
+// Put implements UserStore
+func (s *MemoryUserStore) Put(a Account) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.accounts[nameKey(a.Name)] = a
+	return nil
+}
+
+// Close implements UserStore
+func (s *MemoryUserStore) Close() error {
+	return nil
+}
+
+// FileUserStore is a UserStore that persists accounts to a JSON file. The whole file is rewritten on every change,
+// which is fine for the number of accounts a chat server has.
+type FileUserStore struct {
+	file   string
+	memory *MemoryUserStore
+	mutex  sync.Mutex
+}
+
+// OpenFileUserStore will load the accounts from file, which is created once the first account is registered
+func OpenFileUserStore(file string) (*FileUserStore, error) {
+	s := &FileUserStore{file: file, memory: NewMemoryUserStore()}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var accounts []Account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("invalid user store %s: %s", file, err)
+	}
+	for _, a := range accounts {
+		s.memory.Put(a)
+	}
+	return s, nil
+}
+
+// Get implements UserStore
+func (s *FileUserStore) Get(name string) (Account, error) {
+	return s.memory.Get(name)
+}
+
+// Put implements UserStore
+func (s *FileUserStore) Put(a Account) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.memory.mutex.RLock()
+	accounts := make([]Account, 0, len(s.memory.accounts)+1)
+	for k, v := range s.memory.accounts {
+		if k != nameKey(a.Name) {
+			accounts = append(accounts, v)
+		}
+	}
+	s.memory.mutex.RUnlock()
+	accounts = append(accounts, a)
+
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	} else if err := writeFile(s.file, data); err != nil {
+		return err
+	}
+	return s.memory.Put(a)
+}
+
+// Close implements UserStore
+func (s *FileUserStore) Close() error {
+	return nil
+}
+
+// writeFile will replace the contents of file with data. data is written to a temporary file first, so that a crash
+// can't leave a truncated file behind.
+func writeFile(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// IsRegistered will return true if an account exists for name (case-insensitive)
+func (h *Handler) IsRegistered(name string) bool {
+	_, err := h.Users.Get(name)
+	return err == nil
+}
+
+// Authenticate will verify that password is the password of the account named name. ErrNoAccount is returned if the
+// account doesn't exist and ErrInvalidPassword if the password is wrong.
+func (h *Handler) Authenticate(name, password string) error {
+	a, err := h.Users.Get(name)
+	if err != nil {
+		return err
+	}
+	if err := bcrypt.CompareHashAndPassword(a.PasswordHash, []byte(password)); err != nil {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// Register will create an account named name that is protected by password. ErrAccountExists is returned if the
+// name is already registered. The names listed in h.Admins can't be registered by clients, their accounts are created
+// by the operator with CreateAccount.
+func (h *Handler) Register(name, password string) error {
+	if h.isAdmin(name) {
+		return fmt.Errorf("the name %s is reserved for an admin", name)
+	}
+	hash, err := hashPassword(name, password)
+	if err != nil {
+		return err
+	}
+
+	// the mutex prevents two clients from registering the same name at once
+	h.accounts.Lock()
+	defer h.accounts.Unlock()
+	if _, err := h.Users.Get(name); err == nil {
+		return ErrAccountExists
+	} else if err != ErrNoAccount {
+		return err
+	}
+	if err := h.Users.Put(Account{Created: time.Now(), Name: name, PasswordHash: hash}); err != nil {
+		return err
+	}
+	h.logger.WithField("name", name).Info("registered account")
+	return nil
+}
+
+// CreateAccount will create the account named name on behalf of the operator, replacing an existing account of the
+// same name (but keeping its role). Only accounts created this way receive the admin role of h.Admins.
+func (h *Handler) CreateAccount(name, password string) error {
+	hash, err := hashPassword(name, password)
+	if err != nil {
+		return err
+	}
+
+	h.accounts.Lock()
+	defer h.accounts.Unlock()
+	a, err := h.Users.Get(name)
+	if err == ErrNoAccount {
+		a = Account{Created: time.Now(), Name: name}
+	} else if err != nil {
+		return err
+	}
+	a.Operator = true
+	a.PasswordHash = hash
+	if err := h.Users.Put(a); err != nil {
+		return err
+	}
+	h.logger.WithField("name", name).Info("created account")
+	return nil
+}
+
+// hashPassword will validate the name and password of a new account and return the bcrypt hash of password
+func hashPassword(name, password string) ([]byte, error) {
+	if err := ValidateNick(name); err != nil {
+		return nil, err
+	} else if len([]rune(password)) < MinPasswordLength {
+		return nil, fmt.Errorf("passwords must be at least %d characters long", MinPasswordLength)
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// setClientAccount will mark the specified client as logged into the account named account
+func (h *Handler) setClientAccount(client net.Conn, account string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if val, ok := h.clients[client]; ok {
+		val.account = account
+	}
+}
+
+// getClientAccount will retrieve the name of the account that the specified client is logged into or "" for guests
+func (h *Handler) getClientAccount(client net.Conn) string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	val, ok := h.clients[client]
+	if !ok {
+		return ""
+	}
+	return val.account
+}
+
+// checkName will return an error if a client that is logged into account (or a guest, if account is "") may not use
+// name
+func (h *Handler) checkName(name, account string) error {
+	if account != "" && nameKey(name) == nameKey(account) {
+		return nil
+	} else if h.NickLength > 0 && utf8.RuneCountInString(name) > h.NickLength {
+		return fmt.Errorf("invalid name %q: must not be longer than %d characters", name, h.NickLength)
+	} else if h.AccountsOnly && account == "" {
+		return ErrAccountRequired
+	} else if h.AccountsOnly {
+		return fmt.Errorf("names can't be changed, you are logged in as %s", account)
+	} else if h.IsRegistered(name) {
+		return ErrNickReserved
+	}
+	return nil
+}
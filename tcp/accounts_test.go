@@ -0,0 +1,163 @@
+package tcp
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryUserStore(t *testing.T) {
+	testUserStore(t, NewMemoryUserStore())
+}
+
+func TestFileUserStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "users.json")
+	s, err := OpenFileUserStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testUserStore(t, s)
+	s.Close()
+
+	// reopening the store finds all accounts
+	s, err = OpenFileUserStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := s.Get(name); err != nil {
+			t.Errorf("expected account %s to exist after reopening the store -> %s", name, err)
+		}
+	}
+}
+
+// testUserStore will verify the behavior that every UserStore must implement
+func testUserStore(t *testing.T, s UserStore) {
+	if _, err := s.Get("alice"); err != ErrNoAccount {
+		t.Errorf("expected error (%v) differed from actual error (%v)", ErrNoAccount, err)
+	}
+
+	s.Put(Account{Name: "Alice", PasswordHash: []byte("one")})
+	s.Put(Account{Name: "bob", PasswordHash: []byte("two")})
+	s.Put(Account{Name: "alice", PasswordHash: []byte("three")})
+
+	// names are case-insensitive, so the second put of alice replaced the first
+	a, err := s.Get("ALICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Name != "alice" || string(a.PasswordHash) != "three" {
+		t.Errorf("expected account (alice, three) differed from actual account (%s, %s)", a.Name, a.PasswordHash)
+	}
+}
+
+func TestHandler_Accounts(t *testing.T) {
+	address := ""
+	port := 6028
+	h := startHandler(t, address, port)
+	defer h.Stop()
+
+	alice, aliceReader := connectClient(t, address, port, "alice")
+	defer alice.Close()
+	fmt.Fprintf(alice, "/register short\r\n")
+	expectLines(t, aliceReader, fmt.Sprintf("passwords must be at least %d characters long\r\n", MinPasswordLength))
+	fmt.Fprintf(alice, "/register correct horse\r\n")
+	expectLines(t, aliceReader, "Registered alice, enter your password the next time you connect\r\n")
+	fmt.Fprintf(alice, "/register again please\r\n")
+	expectLines(t, aliceReader, "You are already logged in as alice\r\n")
+
+	// guests can't use registered names, even after the owner disconnected
+	bob, bobReader := connectClient(t, address, port, "bob")
+	defer bob.Close()
+	expectLines(t, aliceReader, ".*bob: Joined\r\n")
+	fmt.Fprintf(alice, "/quit\r\n")
+	expectLines(t, bobReader, ".*alice: Disconnected\r\n")
+	fmt.Fprintf(bob, "/nick ALICE\r\n")
+	expectLines(t, bobReader, "The name ALICE is registered by another user\r\n")
+
+	// the owner is asked for the password when connecting
+	conn, reader := dialClient(t, address, port)
+	defer conn.Close()
+	fmt.Fprintf(conn, "alice\r\n")
+	expectLines(t, reader, "The name alice is registered, enter your password\r\n")
+	fmt.Fprintf(conn, "wrong password\r\n")
+	expectLines(t, reader, "Invalid password\r\n", "Enter your name.*\r\n")
+	fmt.Fprintf(conn, "alice\r\ncorrect horse\r\n")
+	expectLines(t, reader, "The name alice is registered, enter your password\r\n", "Welcome to telchat alice\r\n", ".*alice: Joined\r\n")
+
+	// too many wrong passwords disconnect the client
+	conn, reader = dialClient(t, address, port)
+	defer conn.Close()
+	for i := 0; i < MaxLoginAttempts; i++ {
+		fmt.Fprintf(conn, "Alice\r\nwrong password\r\n")
+		expectLines(t, reader, "The name Alice is registered, enter your password\r\n")
+		if i < MaxLoginAttempts-1 {
+			expectLines(t, reader, "Invalid password\r\n", "Enter your name.*\r\n")
+		}
+	}
+	expectLines(t, reader, "Too many failed logins\r\n")
+}
+
+func TestHandler_AccountsOnly(t *testing.T) {
+	address := ""
+	port := 6030
+	h := startHandler(t, address, port, func(h *Handler) {
+		h.AccountsOnly = true
+	})
+	defer h.Stop()
+
+	// new users register their name by choosing a password
+	conn, reader := dialClient(t, address, port)
+	defer conn.Close()
+	fmt.Fprintf(conn, "carol\r\ncorrect horse\r\nbattery staple\r\n")
+	expectLines(t, reader,
+		"The name carol is not registered yet. Choose a password .*\r\n",
+		"Repeat the password\r\n",
+		"The passwords don't match\r\n",
+		"Enter your name\r\n",
+	)
+	fmt.Fprintf(conn, "carol\r\ncorrect horse\r\ncorrect horse\r\n")
+	expectLines(t, reader,
+		"The name carol is not registered yet. Choose a password .*\r\n",
+		"Repeat the password\r\n",
+		"Welcome to telchat carol\r\n",
+		".*carol: Joined\r\n",
+	)
+	if !h.IsRegistered("carol") {
+		t.Errorf("expected carol to be registered")
+	}
+
+	// names are tied to accounts, so they can't be changed
+	fmt.Fprintf(conn, "/nick dave\r\n")
+	expectLines(t, reader, "names can't be changed, you are logged in as carol\r\n")
+
+	// guests are turned away from the other transports
+	if err := h.Connect(&net.TCPConn{}, "dave", SourceWebSocket, TextEncoder); err != ErrAccountRequired {
+		t.Errorf("expected error (%v) differed from actual error (%v)", ErrAccountRequired, err)
+	}
+}
+
+// dialClient will connect to address:port and consume the name prompt
+func dialClient(t *testing.T, address string, port int) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	expectLines(t, reader, "Enter your name.*\r\n")
+	return conn, reader
+}
@@ -0,0 +1,387 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrUsage can be returned by a Command to indicate that it was called with invalid arguments. The usage text of
+// the command will be displayed to the client.
+var ErrUsage = errors.New("invalid usage")
+
+// Command is a slash command (e.g. /join) that can be executed by connected clients
+type Command struct {
+	Name        string // the name of the command without the leading '/'
+	Args        string // describes the arguments accepted by the command, e.g. "<nick> <text>"
+	Description string // a short description of what the command does
+	MinArgs     int    // the minimum number of arguments that must be provided
+	MaxArgs     int    // the maximum number of arguments, the last argument receives the remainder of the line
+	Role        string // the role required to execute the command (e.g. RoleModerator), "" allows everyone
+
+	// Run is called when a client executes the command. A returned error is displayed to the client.
+	Run func(ctx *CommandContext) error
+}
+
+// Usage returns the usage text of c
+func (c *Command) Usage() string {
+	if c.Args == "" {
+		return "/" + c.Name
+	}
+	return fmt.Sprintf("/%s %s", c.Name, c.Args)
+}
+
+// CommandContext contains the details of a single execution of a Command
+type CommandContext struct {
+	Args    []string // the parsed arguments of the command
+	Command *Command
+	Conn    net.Conn // the connection of the client that executed the command
+	Handler *Handler
+	Name    string // the name of the client that executed the command
+	Room    string // the current room of the client that executed the command
+	Source  string // the transport that the client is connected through, e.g. SourceTCP
+}
+
+// Reply will send text to the client that executed the command
+func (ctx *CommandContext) Reply(format string, a ...interface{}) error {
+	return ctx.Handler.Notify(ctx.Conn, fmt.Sprintf(format, a...))
+}
+
+// RegisterCommand will make cmd available to all clients. A previously registered command with the same name is
+// replaced.
+func (h *Handler) RegisterCommand(cmd Command) error {
+	if cmd.Name == "" || strings.ContainsAny(cmd.Name, " /") {
+		return fmt.Errorf("invalid command name %q", cmd.Name)
+	}
+	if cmd.Run == nil {
+		return fmt.Errorf("command %q has no Run func", cmd.Name)
+	}
+	if cmd.MaxArgs < cmd.MinArgs {
+		return fmt.Errorf("command %q has MaxArgs (%d) less than MinArgs (%d)", cmd.Name, cmd.MaxArgs, cmd.MinArgs)
+	}
+	if cmd.Role != "" && roleRank(cmd.Role) < 0 {
+		return fmt.Errorf("command %q has an invalid role %q", cmd.Name, cmd.Role)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.commands[strings.ToLower(cmd.Name)] = &cmd
+	return nil
+}
+
+// Commands will return all registered commands sorted by name
+func (h *Handler) Commands() []Command {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	cmds := make([]Command, 0, len(h.commands))
+	for _, c := range h.commands {
+		cmds = append(cmds, *c)
+	}
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].Name < cmds[j].Name
+	})
+	return cmds
+}
+
+// getCommand will retrieve the registered command named name or nil if it doesn't exist
+func (h *Handler) getCommand(name string) *Command {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.commands[strings.ToLower(name)]
+}
+
+// executeCommand will parse line (e.g. "/msg bob hi") and run the matching command on behalf of conn
+func (h *Handler) executeCommand(conn net.Conn, line string) {
+	ctx := &CommandContext{
+		Conn:    conn,
+		Handler: h,
+		Name:    h.getClientName(conn),
+		Room:    h.getClientRoom(conn),
+		Source:  h.getClientSource(conn),
+	}
+
+	name, rest := splitWord(strings.TrimPrefix(line, "/"))
+	ctx.Command = h.getCommand(name)
+	if ctx.Command == nil {
+		ctx.Reply("Unknown command /%s, type /help for a list of commands", name)
+		return
+	}
+
+	args, ok := parseArgs(rest, ctx.Command.MinArgs, ctx.Command.MaxArgs)
+	var err error
+	if !h.hasRole(conn, ctx.Command.Role) {
+		err = fmt.Errorf("/%s requires the %s role", ctx.Command.Name, ctx.Command.Role)
+	} else if !ok {
+		err = ErrUsage
+	} else {
+		ctx.Args = args
+		err = ctx.Command.Run(ctx)
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"command": ctx.Command.Name,
+		"error":   err,
+		"sender":  ctx.Name,
+	}).Debug("executed command")
+
+	if err == ErrUsage {
+		ctx.Reply("Usage: %s", ctx.Command.Usage())
+	} else if err != nil {
+		ctx.Reply("%s", err)
+	}
+}
+
+// parseArgs will split s into at most max whitespace separated arguments, where the last argument receives the
+// remainder of s. Arguments other than the last one may be quoted so that they can contain spaces, e.g. the name in
+// /kick "alice smith" spam. ok is false if fewer than min arguments are present or if arguments remain after max.
+func parseArgs(s string, min, max int) (args []string, ok bool) {
+	for s = strings.TrimSpace(s); s != ""; {
+		if len(args) == max-1 {
+			args = append(args, s)
+			break
+		} else if len(args) == max {
+			return nil, false
+		}
+
+		var arg string
+		arg, s = splitWord(s)
+		args = append(args, arg)
+	}
+	return args, len(args) >= min
+}
+
+// splitWord will return the first whitespace separated (or quoted) word of s along with the trimmed remainder of s
+func splitWord(s string) (word, rest string) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, `"`) {
+		if i := strings.Index(s[1:], `"`); i >= 0 {
+			return s[1 : i+1], strings.TrimSpace(s[i+2:])
+		}
+	}
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i+1:])
+	}
+	return s, ""
+}
+
+// registerDefaultCommands will register all of the commands that are built into telchat
+func (h *Handler) registerDefaultCommands() {
+	for _, cmd := range []Command{
+		{Name: "ban", Args: "<nick|account:name|ip[/bits]> [duration] [reason]", Description: "ban a user, e.g. /ban bob 1d spam", MinArgs: 1, MaxArgs: 3, Role: RoleModerator, Run: cmdBan},
+		{Name: "bans", Description: "list the active bans", Role: RoleModerator, Run: cmdBans},
+		{Name: "color", Args: "[on|off]", Description: "show or change whether messages are displayed in color", MaxArgs: 1, Run: cmdColor},
+		{Name: "help", Args: "[command]", Description: "show the available commands or the usage of a command", MaxArgs: 1, Run: cmdHelp},
+		{Name: "join", Args: "<room>", Description: "join a room and send your messages to it", MinArgs: 1, MaxArgs: 1, Run: cmdJoin},
+		{Name: "kick", Args: "<nick> [reason]", Description: "disconnect a user", MinArgs: 1, MaxArgs: 2, Role: RoleModerator, Run: cmdKick},
+		{Name: "me", Args: "<action>", Description: "describe an action, e.g. /me waves", MinArgs: 1, MaxArgs: 1, Run: cmdMe},
+		{Name: "msg", Args: "<nick> <text>", Description: "send a private message to a user", MinArgs: 2, MaxArgs: 2, Run: cmdMsg},
+		{Name: "mute", Args: "<nick> [duration]", Description: "prevent a user from sending messages, e.g. /mute bob 10m", MinArgs: 1, MaxArgs: 2, Role: RoleModerator, Run: cmdMute},
+		{Name: "nick", Args: "<name>", Description: "change your name", MinArgs: 1, MaxArgs: 1, Run: cmdNick},
+		{Name: "op", Args: "<account> [role]", Description: "assign a role (default: moderator) to an account", MinArgs: 1, MaxArgs: 2, Role: RoleAdmin, Run: cmdOp},
+		{Name: "part", Args: "[room]", Description: "leave a room (default: the current room)", MaxArgs: 1, Run: cmdPart},
+		{Name: "quit", Args: "[message]", Description: "disconnect from telchat", MaxArgs: 1, Run: cmdQuit},
+		{Name: "register", Args: "<password>", Description: "register your current name so nobody else can use it", MinArgs: 1, MaxArgs: 1, Run: cmdRegister},
+		{Name: "rooms", Description: "list all rooms", Run: cmdRooms},
+		{Name: "topic", Args: "[topic]", Description: "show or change the topic of the current room", MaxArgs: 1, Run: cmdTopic},
+		{Name: "unban", Args: "<nick|account:name|ip[/bits]>", Description: "remove a ban", MinArgs: 1, MaxArgs: 1, Role: RoleModerator, Run: cmdUnban},
+		{Name: "unmute", Args: "<nick>", Description: "allow a muted user to send messages again", MinArgs: 1, MaxArgs: 1, Role: RoleModerator, Run: cmdUnmute},
+		{Name: "who", Args: "[room]", Description: "list the users in a room (default: the current room)", MaxArgs: 1, Run: cmdWho},
+	} {
+		if err := h.RegisterCommand(cmd); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// cmdColor displays or changes whether messages are rendered using ANSI colors for the client
+func cmdColor(ctx *CommandContext) error {
+	if len(ctx.Args) == 1 {
+		var on bool
+		switch strings.ToLower(ctx.Args[0]) {
+		case "on":
+			on = true
+		case "off":
+		default:
+			return ErrUsage
+		}
+		if err := ctx.Handler.SetColor(ctx.Conn, on); err != nil {
+			return err
+		}
+	}
+
+	if ctx.Handler.Color(ctx.Conn) {
+		return ctx.Reply("Colors are on")
+	}
+	return ctx.Reply("Colors are off")
+}
+
+// cmdHelp lists all commands or displays the usage of a single command
+func cmdHelp(ctx *CommandContext) error {
+	if len(ctx.Args) == 1 {
+		cmd := ctx.Handler.getCommand(strings.TrimPrefix(ctx.Args[0], "/"))
+		if cmd == nil {
+			return fmt.Errorf("unknown command %s", ctx.Args[0])
+		}
+		return ctx.Reply("%s - %s", cmd.Usage(), cmd.Description)
+	}
+
+	lines := []string{"Commands:"}
+	for _, cmd := range ctx.Handler.Commands() {
+		if !ctx.Handler.hasRole(ctx.Conn, cmd.Role) {
+			// commands that the client isn't allowed to execute are hidden
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("  %-22s %s", cmd.Usage(), cmd.Description))
+	}
+	lines = append(lines, "Start a message with // to send text that begins with a '/'")
+	return ctx.Reply("%s", strings.Join(lines, "\r\n"))
+}
+
+// cmdJoin adds the client to a room and makes it the client's current room
+func cmdJoin(ctx *CommandContext) error {
+	room, err := NormalizeRoom(ctx.Args[0])
+	if err != nil {
+		return err
+	} else if err := ctx.Handler.Join(ctx.Conn, room); err != nil {
+		return err
+	}
+
+	if topic := ctx.Handler.Topic(room); topic != "" {
+		return ctx.Reply("Now talking in %s, the topic is: %s", room, topic)
+	}
+	return ctx.Reply("Now talking in %s", room)
+}
+
+// cmdMe sends an action to the client's current room
+func cmdMe(ctx *CommandContext) error {
+	if err := ctx.Handler.CheckMute(ctx.Name); err != nil {
+		return err
+	} else if err := ctx.Handler.CheckText(ctx.Args[0]); err != nil {
+		return err
+	}
+	ctx.Handler.messages <- Message{Action: true, Message: ctx.Args[0], Room: ctx.Room, Sender: ctx.Name, Source: ctx.Source}
+	return nil
+}
+
+// cmdMsg sends a private message that is only delivered to a single user
+func cmdMsg(ctx *CommandContext) error {
+	if !ctx.Handler.IsOnline(ctx.Args[0]) {
+		return fmt.Errorf("%s is not online", ctx.Args[0])
+	} else if err := ctx.Handler.CheckMute(ctx.Name); err != nil {
+		return err
+	} else if err := ctx.Handler.CheckText(ctx.Args[1]); err != nil {
+		return err
+	}
+
+	ctx.Handler.messages <- Message{Message: ctx.Args[1], Recipient: ctx.Args[0], Sender: ctx.Name, Source: ctx.Source}
+	return nil
+}
+
+// cmdNick changes the name of the client
+func cmdNick(ctx *CommandContext) error {
+	name := strings.TrimSpace(ctx.Args[0])
+	if err := ctx.Handler.Rename(ctx.Conn, name); err == ErrNickInUse {
+		return fmt.Errorf("The name %s is already in use", name)
+	} else if err == ErrNickReserved {
+		return fmt.Errorf("The name %s is registered by another user", name)
+	} else if _, ok := err.(*BannedError); ok {
+		return fmt.Errorf("The name %s is banned", name)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// cmdPart removes the client from a room
+func cmdPart(ctx *CommandContext) error {
+	room := ctx.Room
+	if len(ctx.Args) == 1 {
+		room = ctx.Args[0]
+	}
+
+	current, err := ctx.Handler.Part(ctx.Conn, room)
+	if err != nil {
+		return err
+	}
+	room, _ = NormalizeRoom(room)
+	return ctx.Reply("Left %s, now talking in %s", room, current)
+}
+
+// cmdQuit disconnects the client
+func cmdQuit(ctx *CommandContext) error {
+	message := ""
+	if len(ctx.Args) == 1 {
+		message = ctx.Args[0]
+	}
+	ctx.Reply("Bye")
+	return ctx.Handler.Quit(ctx.Conn, message)
+}
+
+// cmdRegister creates an account for the client's current name and logs the client into it
+func cmdRegister(ctx *CommandContext) error {
+	if account := ctx.Handler.getClientAccount(ctx.Conn); account != "" {
+		return fmt.Errorf("You are already logged in as %s", account)
+	}
+
+	if err := ctx.Handler.Register(ctx.Name, ctx.Args[0]); err == ErrAccountExists {
+		return fmt.Errorf("The name %s is already registered", ctx.Name)
+	} else if err != nil {
+		return err
+	}
+	ctx.Handler.setClientAccount(ctx.Conn, ctx.Name)
+	return ctx.Reply("Registered %s, enter your password the next time you connect", ctx.Name)
+}
+
+// cmdRooms lists all rooms along with their number of members
+func cmdRooms(ctx *CommandContext) error {
+	joined := make(map[string]bool)
+	for _, r := range ctx.Handler.getClientRooms(ctx.Conn) {
+		joined[r] = true
+	}
+
+	lines := []string{"Rooms:"}
+	for _, r := range ctx.Handler.Rooms() {
+		marker := " "
+		if r == ctx.Room {
+			marker = "*"
+		} else if joined[r] {
+			marker = "+"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s (%d)", marker, r, len(ctx.Handler.roomMembers(r))))
+	}
+	return ctx.Reply("%s", strings.Join(lines, "\r\n"))
+}
+
+// cmdTopic displays or changes the topic of the client's current room
+func cmdTopic(ctx *CommandContext) error {
+	if len(ctx.Args) == 1 {
+		return ctx.Handler.SetTopic(ctx.Conn, ctx.Room, ctx.Args[0])
+	}
+
+	if topic := ctx.Handler.Topic(ctx.Room); topic != "" {
+		return ctx.Reply("The topic of %s is: %s", ctx.Room, topic)
+	}
+	return ctx.Reply("%s has no topic", ctx.Room)
+}
+
+// cmdWho lists the names of the members of a room
+func cmdWho(ctx *CommandContext) error {
+	room := ctx.Room
+	if len(ctx.Args) == 1 {
+		r, err := NormalizeRoom(ctx.Args[0])
+		if err != nil {
+			return err
+		}
+		room = r
+	}
+
+	names := ctx.Handler.Members(room)
+	if len(names) == 0 {
+		return ctx.Reply("Nobody is in %s", room)
+	}
+	return ctx.Reply("Users in %s (%d): %s", room, len(names), strings.Join(names, ", "))
+}
@@ -0,0 +1,138 @@
+package tcp
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestParseArgs(t *testing.T) {
+	testCases := map[string]struct {
+		s     string
+		min   int
+		max   int
+		eArgs []string
+		eOk   bool
+	}{
+		"no args":             {"", 0, 0, nil, true},
+		"unexpected args":     {"extra", 0, 0, nil, false},
+		"missing args":        {"bob", 2, 2, []string{"bob"}, false},
+		"remainder":           {"bob  hello there ", 2, 2, []string{"bob", "hello there"}, true},
+		"optional arg":        {"", 0, 1, nil, true},
+		"single rest of line": {"waves at everyone", 1, 1, []string{"waves at everyone"}, true},
+		"quoted arg":          {`"alice smith"  hi "there"`, 2, 2, []string{"alice smith", `hi "there"`}, true},
+		"unclosed quote":      {`"alice smith`, 2, 2, []string{`"alice`, "smith"}, true},
+	}
+
+	for k, v := range testCases {
+		args, ok := parseArgs(v.s, v.min, v.max)
+		if ok != v.eOk {
+			t.Errorf("%s: expected ok (%v) differed from actual ok (%v)", k, v.eOk, ok)
+		}
+		if ok && !reflect.DeepEqual(args, v.eArgs) {
+			t.Errorf("%s: expected args (%#v) differed from actual args (%#v)", k, v.eArgs, args)
+		}
+	}
+}
+
+func TestHandler_RegisterCommand(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	h := New("", 6000, logger)
+	run := func(ctx *CommandContext) error { return nil }
+
+	testCases := map[string]struct {
+		cmd  Command
+		eErr bool
+	}{
+		"valid":        {Command{Name: "ping", Run: run}, false},
+		"empty name":   {Command{Run: run}, true},
+		"slash name":   {Command{Name: "/ping", Run: run}, true},
+		"missing run":  {Command{Name: "ping"}, true},
+		"bad arg spec": {Command{Name: "ping", MinArgs: 2, MaxArgs: 1, Run: run}, true},
+	}
+
+	for k, v := range testCases {
+		err := h.RegisterCommand(v.cmd)
+		if (err != nil) != v.eErr {
+			t.Errorf("%s: expected error (%v) differed from actual error (%v)", k, v.eErr, err)
+		}
+	}
+
+	if h.getCommand("PING") == nil {
+		t.Errorf("registered command was not found")
+	}
+}
+
+func TestHandler_executeCommand(t *testing.T) {
+	address := ""
+	port := 6006
+	h := startHandler(t, address, port)
+	defer h.Stop()
+
+	err := h.RegisterCommand(Command{
+		Name:    "echo",
+		Args:    "<text>",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Run: func(ctx *CommandContext) error {
+			return ctx.Reply("%s said %s in %s", ctx.Name, ctx.Args[0], ctx.Room)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, aliceReader := connectClient(t, address, port, "alice")
+	defer alice.Close()
+	bob, bobReader := connectClient(t, address, port, "bob")
+	defer bob.Close()
+	expectLines(t, aliceReader, ".*bob: Joined\r\n")
+
+	// commands registered from Go code are available to clients
+	fmt.Fprintf(alice, "/echo hello world\r\n")
+	expectLines(t, aliceReader, "alice said hello world in lobby\r\n")
+	fmt.Fprintf(alice, "/echo\r\n")
+	expectLines(t, aliceReader, "Usage: /echo <text>\r\n")
+	fmt.Fprintf(alice, "/nope\r\n")
+	expectLines(t, aliceReader, "Unknown command /nope, type /help for a list of commands\r\n")
+	fmt.Fprintf(alice, "/help msg\r\n")
+	expectLines(t, aliceReader, "/msg <nick> <text> - send a private message to a user\r\n")
+
+	// text starting with "//" is sent as chat
+	fmt.Fprintf(alice, "//shrug\r\n")
+	expectLines(t, aliceReader, "[0-9:]+ alice: /shrug\r\n")
+	expectLines(t, bobReader, "[0-9:]+ alice: /shrug\r\n")
+
+	fmt.Fprintf(alice, "/me waves\r\n")
+	expectLines(t, aliceReader, "[0-9:]+ \\* alice waves\r\n")
+	expectLines(t, bobReader, "[0-9:]+ \\* alice waves\r\n")
+
+	fmt.Fprintf(alice, "/nick carol\r\n")
+	expectLines(t, aliceReader, "[0-9:]+ alice: Is now known as carol\r\n")
+	expectLines(t, bobReader, "[0-9:]+ alice: Is now known as carol\r\n")
+
+	fmt.Fprintf(bob, "/who\r\n")
+	expectLines(t, bobReader, "Users in lobby \\(2\\): bob, carol\r\n")
+
+	fmt.Fprintf(bob, "/msg carol psst\r\n")
+	expectLines(t, bobReader, "[0-9:]+ bob -> carol: psst\r\n")
+	expectLines(t, aliceReader, "[0-9:]+ bob -> carol: psst\r\n")
+	fmt.Fprintf(bob, "/msg alice psst\r\n")
+	expectLines(t, bobReader, "alice is not online\r\n")
+
+	// colors are off for clients that didn't report a terminal type
+	fmt.Fprintf(bob, "/color\r\n")
+	expectLines(t, bobReader, "Colors are off\r\n")
+	fmt.Fprintf(bob, "/color maybe\r\n")
+	expectLines(t, bobReader, "Usage: /color \\[on\\|off\\]\r\n")
+	fmt.Fprintf(bob, "/color on\r\n")
+	expectLines(t, bobReader, "\x1b\\[2mColors are on\x1b\\[0m\r\n")
+	fmt.Fprintf(bob, "/color off\r\n")
+	expectLines(t, bobReader, "Colors are off\r\n")
+
+	fmt.Fprintf(alice, "/quit gone fishing\r\n")
+	expectLines(t, aliceReader, "Bye\r\n")
+	expectLines(t, bobReader, "[0-9:]+ carol: Disconnected \\(gone fishing\\)\r\n")
+}
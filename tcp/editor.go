@@ -0,0 +1,163 @@
+package tcp
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// editorPrompt is displayed in front of the line that a telnet client in character mode is typing
+const editorPrompt = "> "
+
+// negotiationTimeout is how long a telnet client may take to answer the negotiation of character mode, window size
+// and terminal type before it is prompted for its name
+const negotiationTimeout = time.Second
+
+// telnetIO connects the line editor of a telnetConn to the client: it reads the decoded input and escapes the output
+type telnetIO struct {
+	c *telnetConn
+}
+
+func (t telnetIO) Read(b []byte) (int, error) {
+	return t.c.Read(b)
+}
+
+func (t telnetIO) Write(b []byte) (int, error) {
+	return t.c.write(b)
+}
+
+// startEditor will edit the input of c using a line editor, which supports the cursor keys, input history (up and
+// down) and tab-completion using complete. It must be called before anything else writes to c concurrently.
+func (c *telnetConn) startEditor(complete func(line string, pos int, key rune) (string, int, bool)) {
+	editor := terminal.NewTerminal(telnetIO{c}, editorPrompt)
+	editor.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if newLine, newPos, ok := c.secret.Mask(line, pos, key); ok {
+			return newLine, newPos, true
+		}
+		return complete(line, pos, key)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.terminal.Width > 0 && c.terminal.Height > 0 {
+		editor.SetSize(c.terminal.Width, c.terminal.Height)
+	}
+	c.editor = editor
+}
+
+// completeNick is the tab-completion of the line editor. The word in front of the cursor is completed to the name of
+// a connected client, followed by ": " at the start of the line. If several names match, the word is completed to
+// their common prefix.
+func (h *Handler) completeNick(line string, pos int, key rune) (newLine string, newPos int, ok bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	start := strings.LastIndex(line[:pos], " ") + 1
+	word := strings.ToLower(line[start:pos])
+	if word == "" {
+		return "", 0, false
+	}
+
+	var matches []string
+	for _, name := range h.clientNames() {
+		if strings.HasPrefix(strings.ToLower(name), word) {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+
+	// the typed word is kept as is if it is only completed to the common prefix of several names
+	completion := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(strings.ToLower(m), strings.ToLower(completion)) {
+			completion = completion[:len(completion)-1]
+		}
+	}
+	if len(matches) > 1 && len(completion) >= pos-start {
+		completion = line[start:pos] + completion[pos-start:]
+	}
+	if len(matches) == 1 {
+		if start == 0 {
+			completion += ": "
+		} else {
+			completion += " "
+		}
+	}
+	return line[:start] + completion + line[pos:], start + len(completion), true
+}
+
+// clientNames will return the sorted names of all connected clients
+func (h *Handler) clientNames() []string {
+	h.mutex.RLock()
+	names := make([]string, 0, len(h.clients))
+	for _, c := range h.clients {
+		names = append(names, c.name)
+	}
+	h.mutex.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// secretCommands are the commands whose argument is a password, which a line editor must neither display nor keep in
+// its input history
+var secretCommands = []string{"/register "}
+
+// SecretInput hides the passwords typed as the argument of a command in secretCommands (e.g. "/register <password>")
+// in a line editor. Mask is the AutoCompleteCallback of the editor: it records the keys typed after such a command
+// and displays them as '*', so the editor only ever holds (and adds to its history) the masked line. Reveal turns the
+// masked line returned by the editor back into the line that was typed. The zero value is ready to use.
+type SecretInput struct {
+	secret []rune
+}
+
+// secretStart returns the position in line at which the password of a command in secretCommands starts, or -1 if
+// line doesn't start with such a command
+func secretStart(line string) int {
+	for _, cmd := range secretCommands {
+		if len(line) >= len(cmd) && strings.EqualFold(line[:len(cmd)], cmd) {
+			return len(cmd)
+		}
+	}
+	return -1
+}
+
+// Mask implements the AutoCompleteCallback of a terminal.Terminal. Keys typed into the password are recorded and
+// replaced by '*'. The editor can't tell which part of the password was deleted (e.g. by backspace), so the password
+// starts over once anything was deleted.
+func (s *SecretInput) Mask(line string, pos int, key rune) (newLine string, newPos int, ok bool) {
+	start := secretStart(line)
+	if start < 0 || pos < start {
+		s.secret = nil
+		return "", 0, false
+	}
+
+	masked := line[start:]
+	if masked != strings.Repeat("*", len(s.secret)) {
+		s.secret, masked, pos = nil, "", start
+	}
+	if !unicode.IsPrint(key) {
+		return line[:start] + masked, pos, true
+	}
+	i := pos - start
+	s.secret = append(s.secret[:i], append([]rune{key}, s.secret[i:]...)...)
+	return line[:start] + masked + "*", pos + 1, true
+}
+
+// Reveal will return the line that was typed, given the masked line returned by the line editor. A masked password
+// that wasn't typed into the current line (e.g. one recalled from the input history) is dropped.
+func (s *SecretInput) Reveal(line string) string {
+	secret := s.secret
+	s.secret = nil
+	start := secretStart(line)
+	if start < 0 {
+		return line
+	} else if line[start:] != strings.Repeat("*", len(secret)) {
+		return strings.TrimSpace(line[:start])
+	}
+	return line[:start] + string(secret)
+}
@@ -0,0 +1,136 @@
+package tcp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestHandler_completeNick(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	h := New("", 6046, logger)
+	for _, name := range []string{"alice", "Albert", "bob"} {
+		server, client := net.Pipe()
+		defer client.Close()
+		if err := h.addClient(server, name, "", SourceTCP, TextEncoder); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := map[string]struct {
+		line  string
+		pos   int
+		key   rune
+		eLine string
+		ePos  int
+		eOk   bool
+	}{
+		"start of line":    {"b", 1, '\t', "bob: ", 5, true},
+		"middle of line":   {"hi B and", 4, '\t', "hi bob  and", 7, true},
+		"case-insensitive": {"ALI", 3, '\t', "alice: ", 7, true},
+		"common prefix":    {"a", 1, '\t', "al", 2, true},
+		"no match":         {"hi c", 4, '\t', "", 0, false},
+		"empty word":       {"hi ", 3, '\t', "", 0, false},
+		"other key":        {"b", 1, 'o', "", 0, false},
+	}
+	for k, v := range testCases {
+		line, pos, ok := h.completeNick(v.line, v.pos, v.key)
+		if line != v.eLine || pos != v.ePos || ok != v.eOk {
+			t.Errorf("%s: expected completion (%q, %d, %v) differed from actual completion (%q, %d, %v)", k, v.eLine, v.ePos, v.eOk, line, pos, ok)
+		}
+	}
+}
+
+func TestHandler_Editor(t *testing.T) {
+	address := ""
+	port := 6046
+	h := startHandler(t, address, port, func(h *Handler) {
+		h.Telnet = true
+	})
+	defer h.Stop()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go io.Copy(ioutil.Discard, client)
+	if err := h.Connect(server, "alice", SourceWebSocket, TextEncoder); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, reader := dialTelnet(t, address, port, "VT100")
+	defer conn.Close()
+	fmt.Fprint(conn, "bob\r")
+	readUntil(t, reader, "bob: Joined\r\n")
+
+	// nicknames are completed with tab
+	fmt.Fprint(conn, "al\t")
+	readUntil(t, reader, "alice: ")
+	fmt.Fprint(conn, "hi\r")
+	readUntil(t, reader, "bob: alice: hi\r\n")
+
+	// incoming messages are written above the input line, which is restored below them
+	fmt.Fprint(conn, "partial")
+	readUntil(t, reader, "partial")
+	h.Send(server, Message{Message: "hello"})
+	readUntil(t, reader, "alice: hello\r\n")
+	readUntil(t, reader, editorPrompt+"partial")
+
+	// the input history is browsed with the up and down keys
+	fmt.Fprint(conn, "\r")
+	readUntil(t, reader, "bob: partial\r\n")
+	fmt.Fprint(conn, "\x1b[A\x1b[A\x1b[B\r")
+	readUntil(t, reader, "bob: partial\r\n")
+
+	// passwords are neither echoed nor kept in the history
+	fmt.Fprint(conn, "/register correct horse\r")
+	if out := readUntil(t, reader, "Registered bob, enter your password the next time you connect\r\n"); strings.Contains(out, "correct") {
+		t.Errorf("expected the password to be masked, got %q", out)
+	}
+	fmt.Fprint(conn, "\x1b[A\r")
+	if out := readUntil(t, reader, "Usage: /register <password>\r\n"); strings.Contains(out, "correct") {
+		t.Errorf("expected the password to be left out of the history, got %q", out)
+	}
+}
+
+func TestSecretInput(t *testing.T) {
+	testCases := map[string]struct {
+		keys    string
+		eLine   string
+		eReveal string
+	}{
+		"password":     {"/register secret", "/register ******", "/register secret"},
+		"other":        {"/msg bob secret", "/msg bob secret", "/msg bob secret"},
+		"ignores case": {"/REGISTER pw", "/REGISTER **", "/REGISTER pw"},
+		"deleted":      {"/register secrex\x7ft", "/register *", "/register t"},
+	}
+	for k, v := range testCases {
+		var s SecretInput
+		line, pos := "", 0
+		for _, key := range v.keys {
+			// the line editor handles backspace itself, everything else is passed to Mask first
+			if key == 0x7f {
+				line, pos = line[:pos-1]+line[pos:], pos-1
+			} else if newLine, newPos, ok := s.Mask(line, pos, key); ok {
+				line, pos = newLine, newPos
+			} else {
+				line, pos = line[:pos]+string(key)+line[pos:], pos+1
+			}
+		}
+		if line != v.eLine {
+			t.Errorf("%s: expected displayed line (%q) differed from actual displayed line (%q)", k, v.eLine, line)
+		}
+		if revealed := s.Reveal(line); revealed != v.eReveal {
+			t.Errorf("%s: expected revealed line (%q) differed from actual revealed line (%q)", k, v.eReveal, revealed)
+		}
+	}
+
+	// a masked password recalled from the history can't be revealed
+	var s SecretInput
+	if revealed := s.Reveal("/register ******"); revealed != "/register" {
+		t.Errorf("expected a recalled password to be dropped, got %q", revealed)
+	}
+}
@@ -0,0 +1,58 @@
+package tcp
+
+import (
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults for detecting dead TCP clients, see the fields of Handler with the same names
+const (
+	DefaultKeepAlive    = 30 * time.Second
+	DefaultPingInterval = time.Minute
+	DefaultPingTimeout  = 30 * time.Second
+)
+
+// heartbeat will probe the telnet client conn whenever it didn't send anything for h.PingInterval. A client that
+// doesn't answer within h.PingTimeout is unreachable, so conn is closed, which makes the reader of conn hand it to
+// deadConnections. heartbeat returns when stop is closed.
+func (h *Handler) heartbeat(conn net.Conn, telnet *telnetConn, stop <-chan struct{}) {
+	timer := time.NewTimer(h.PingInterval)
+	defer timer.Stop()
+
+	var probed time.Time // when the unanswered probe was sent, zero if there is none
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+
+		last, peer := telnet.lastReceived()
+		if !peer {
+			// clients that don't speak telnet would display the probes, they rely on TCP keepalive instead
+			return
+		} else if !probed.IsZero() && last.Before(probed) {
+			h.logger.WithFields(logrus.Fields{
+				"address.remote": conn.RemoteAddr(),
+				"name":           h.getClientName(conn),
+				"timeout":        h.PingTimeout,
+			}).Warn("evicting client that didn't answer a ping")
+			h.setClientQuitMessage(conn, "Ping timeout")
+			telnet.Conn.Close()
+			return
+		}
+
+		if wait := h.PingInterval - time.Since(last); wait > 0 {
+			probed = time.Time{}
+			timer.Reset(wait)
+			continue
+		}
+		probed = time.Now()
+		if err := telnet.probe(); err != nil {
+			return
+		}
+		timer.Reset(h.PingTimeout)
+	}
+}
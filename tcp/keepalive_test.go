@@ -0,0 +1,45 @@
+package tcp
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandler_heartbeat(t *testing.T) {
+	address := ""
+	port := 6056
+	h := startHandler(t, address, port, func(h *Handler) {
+		h.PingInterval = 200 * time.Millisecond
+		h.PingTimeout = 200 * time.Millisecond
+		h.Telnet = true
+	})
+	defer h.Stop()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	alice := bufio.NewReader(client)
+	if err := h.Connect(server, "alice", SourceWebSocket, TextEncoder); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, reader := dialTelnet(t, address, port, "VT100")
+	defer conn.Close()
+	conn.Write([]byte("bob\r"))
+	readUntil(t, reader, "bob: Joined\r\n")
+	readUntil(t, alice, "bob: Joined\r\n")
+
+	// an idle client is probed, and stays connected as long as it answers
+	probe := string([]byte{telnetIAC, telnetDO, telnetTM})
+	readUntil(t, reader, probe)
+	conn.Write([]byte{telnetIAC, telnetWONT, telnetTM})
+	readUntil(t, reader, probe)
+
+	// a client that stops answering is evicted
+	readUntil(t, alice, "bob: Disconnected (Ping timeout)\r\n")
+	if h.IsOnline("bob") {
+		t.Errorf("expected bob to be evicted")
+	}
+}
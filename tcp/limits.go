@@ -0,0 +1,113 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Default limits of the listeners, see the fields of Handler with the same names
+const (
+	DefaultMaxConnections      = 1024
+	DefaultMaxConnectionsPerIP = 16
+	DefaultMaxLineLength       = 4096
+	DefaultNameTimeout         = time.Minute
+)
+
+// ErrLineTooLong is returned when a client sends a line that is longer than Handler.MaxLineLength
+var ErrLineTooLong = errors.New("line is too long")
+
+// connection limits are checked when a client connects to any of the listeners, before it is prompted for anything
+var (
+	errTooManyConnections      = errors.New("Too many connections, please try again later")
+	errTooManyConnectionsPerIP = errors.New("Too many connections from your address, please try again later")
+)
+
+// Admit will count conn as a connection of its remote address, unless h.MaxConnections or h.MaxConnectionsPerIP
+// would be exceeded. Every listener admits the connections it accepts, so the limits apply to all of them together.
+// Every admitted connection must be released using Release.
+func (h *Handler) Admit(conn net.Conn) error {
+	ip := remoteIP(conn).String()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.MaxConnections > 0 && h.numConnections >= h.MaxConnections {
+		return errTooManyConnections
+	} else if h.MaxConnectionsPerIP > 0 && h.connections[ip] >= h.MaxConnectionsPerIP {
+		return errTooManyConnectionsPerIP
+	}
+	h.connections[ip]++
+	h.numConnections++
+	return nil
+}
+
+// Release will stop counting the admitted connection conn
+func (h *Handler) Release(conn net.Conn) {
+	ip := remoteIP(conn).String()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.connections[ip]--; h.connections[ip] <= 0 {
+		delete(h.connections, ip)
+	}
+	h.numConnections--
+}
+
+// ReadLimitedLine will read a line from reader, including the line ending. Lines that are longer than max bytes
+// (excluding the line ending) are discarded up to the next line ending and ErrLineTooLong is returned, so a client
+// that never ends its line can't make the server buffer it. max <= 0 disables the limit.
+func ReadLimitedLine(reader *bufio.Reader, max int) (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			if max > 0 && len(bytes.TrimRight(line, "\r\n")) > max {
+				tooLong, line = true, nil
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return string(line), err
+		} else if tooLong {
+			return "", ErrLineTooLong
+		}
+		return string(line), nil
+	}
+}
+
+// LineTooLong will tell the client conn that the line it sent was too long
+func (h *Handler) LineTooLong(conn net.Conn) {
+	h.logger.WithFields(logrus.Fields{
+		"address.remote": conn.RemoteAddr(),
+		"limit":          h.MaxLineLength,
+		"name":           h.getClientName(conn),
+	}).Warn("rejected line that is too long")
+	h.Notify(conn, h.errLineTooLong().Error())
+}
+
+// CheckLength will return an error that tells the client the limit if text is longer than h.MaxLineLength
+func (h *Handler) CheckLength(text string) error {
+	if h.MaxLineLength > 0 && len(text) > h.MaxLineLength {
+		return h.errLineTooLong()
+	}
+	return nil
+}
+
+// errLineTooLong returns the error that tells a client how long its lines may be
+func (h *Handler) errLineTooLong() error {
+	return fmt.Errorf("Lines can't be longer than %d bytes", h.MaxLineLength)
+}
+
+// isTimeout reports whether err was caused by a deadline
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
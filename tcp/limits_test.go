@@ -0,0 +1,156 @@
+package tcp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestReadLimitedLine(t *testing.T) {
+	testCases := map[string]struct {
+		in     string
+		max    int
+		eLines []string
+		eErrs  []error
+	}{
+		"short lines":  {"hi\r\nthere\n", 5, []string{"hi\r\n", "there\n", ""}, []error{nil, nil, io.EOF}},
+		"long line":    {strings.Repeat("a", 40) + "\r\nok\r\n", 5, []string{"", "ok\r\n"}, []error{ErrLineTooLong, nil}},
+		"no line end":  {strings.Repeat("a", 40), 5, []string{""}, []error{io.EOF}},
+		"unlimited":    {strings.Repeat("a", 40) + "\n", 0, []string{strings.Repeat("a", 40) + "\n"}, []error{nil}},
+		"partial line": {"abc", 5, []string{"abc"}, []error{io.EOF}},
+		"exactly max":  {"abcde\r\n", 5, []string{"abcde\r\n"}, []error{nil}},
+		"one too many": {"abcdef\r\n", 5, []string{""}, []error{ErrLineTooLong}},
+	}
+	for k, v := range testCases {
+		// a small buffer, so that long lines are read in several chunks
+		reader := bufio.NewReaderSize(strings.NewReader(v.in), 16)
+		for i := range v.eLines {
+			line, err := ReadLimitedLine(reader, v.max)
+			if line != v.eLines[i] || err != v.eErrs[i] {
+				t.Errorf("%s: expected line %d (%q, %v) differed from actual line (%q, %v)", k, i, v.eLines[i], v.eErrs[i], line, err)
+			}
+		}
+	}
+}
+
+// addrConn is a net.Conn with a fixed remote address
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestHandler_Admit(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	h := New("", 6052, logger)
+	h.MaxConnections = 3
+	h.MaxConnectionsPerIP = 2
+	conn := func(ip string) net.Conn {
+		return addrConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}}
+	}
+
+	testCases := []struct {
+		ip      string
+		release bool
+		eErr    error
+	}{
+		{"10.0.0.1", false, nil},
+		{"10.0.0.1", false, nil},
+		{"10.0.0.1", false, errTooManyConnectionsPerIP},
+		{"10.0.0.2", false, nil},
+		{"10.0.0.3", false, errTooManyConnections},
+		{"10.0.0.1", true, nil},
+		{"10.0.0.3", false, nil},
+		{"10.0.0.1", false, errTooManyConnections},
+	}
+	for i, v := range testCases {
+		if v.release {
+			h.Release(conn(v.ip))
+			continue
+		}
+		if err := h.Admit(conn(v.ip)); err != v.eErr {
+			t.Errorf("%d: expected error (%v) differed from actual error (%v)", i, v.eErr, err)
+		}
+	}
+}
+
+func TestHandler_ConnectionLimits(t *testing.T) {
+	address := ""
+	port := 6052
+	h := startHandler(t, address, port, func(h *Handler) {
+		h.MaxConnectionsPerIP = 1
+	})
+	defer h.Stop()
+
+	alice, _ := connectClient(t, address, port, "alice")
+
+	// a second connection from the same address is turned away before it is prompted for a name
+	conn, err := net.Dial("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	expectLines(t, bufio.NewReader(conn), errTooManyConnectionsPerIP.Error()+"\r\n")
+
+	// the connection is released when the client disconnects
+	alice.Close()
+	for i := 0; i < 1000; i++ {
+		h.mutex.RLock()
+		n := h.numConnections
+		h.mutex.RUnlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	bob, _ := connectClient(t, address, port, "bob")
+	bob.Close()
+}
+
+func TestHandler_InputLimits(t *testing.T) {
+	address := ""
+	port := 6054
+	h := startHandler(t, address, port, func(h *Handler) {
+		h.IdleTimeout = 300 * time.Millisecond
+		h.MaxLineLength = 10
+		h.NameTimeout = 300 * time.Millisecond
+		h.NickLength = 5
+	})
+	defer h.Stop()
+
+	// a client that doesn't choose a name in time is disconnected
+	conn, reader := dialClient(t, address, port)
+	defer conn.Close()
+	expectLines(t, reader, "Timed out waiting for your name\r\n")
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected the connection to be closed -> %v", err)
+	}
+
+	conn, reader = dialClient(t, address, port)
+	defer conn.Close()
+	fmt.Fprintf(conn, "robert\r\n")
+	expectLines(t, reader, "invalid name \"robert\": must not be longer than 5 characters\r\n", "Enter your name.*\r\n")
+	fmt.Fprintf(conn, "bob\r\n")
+	expectLines(t, reader, "Welcome to telchat bob\r\n", ".*bob: Joined\r\n")
+
+	// long lines are rejected, but the client stays connected
+	fmt.Fprintf(conn, "%s\r\nshort\r\n", strings.Repeat("a", 100))
+	expectLines(t, reader, "Lines can't be longer than 10 bytes\r\n", ".*bob: short\r\n")
+
+	// the name prompt timeout doesn't apply after logging in, but the idle timeout does
+	expectLines(t, reader, "Disconnected after 300ms without activity\r\n")
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected the connection to be closed -> %v", err)
+	}
+}
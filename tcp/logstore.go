@@ -0,0 +1,401 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultSegmentSize is the size in bytes at which a LogStore starts writing to a new segment
+const DefaultSegmentSize = 64 * 1024 * 1024
+
+const (
+	indexEntrySize   = 8 // each index entry is the offset of a record within its segment as a big endian uint64
+	indexExtension   = ".idx"
+	segmentExtension = ".log"
+)
+
+// LogStore is a Store that persists messages to disk in an append-only log. The log is split into segments, each
+// holding one JSON encoded message per line. A segment is named after the ID of its first message and is accompanied
+// by an index file containing the offset of every message within the segment, so messages can be read by ID without
+// scanning the log. The IDs of the messages of each room are kept in memory, so the messages of a room can be read
+// without scanning the messages of all other rooms.
+type LogStore struct {
+	dir         string
+	mutex       sync.RWMutex
+	nextID      uint64
+	rooms       map[string][]uint64 // the IDs of the messages of each room in ascending order, excluding private messages
+	segments    []*segment          // ordered by baseID, the last segment is the one being appended to
+	segmentSize int64
+}
+
+// segment is a single file of a LogStore along with its index
+type segment struct {
+	baseID  uint64 // the ID of the first message in the segment
+	file    *os.File
+	index   *os.File
+	offsets []int64 // the offset of each message within file, offsets[i] belongs to message baseID+i
+	size    int64
+}
+
+// OpenLogStore will open (or create) the LogStore located in dir. A new segment is started whenever the current one
+// grows beyond segmentSize bytes. Incomplete records left behind by a crash are discarded.
+func OpenLogStore(dir string, segmentSize int64) (*LogStore, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var baseIDs []uint64
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), segmentExtension) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentExtension), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected file in message store %s: %s", dir, f.Name())
+		}
+		baseIDs = append(baseIDs, id)
+	}
+	sort.Slice(baseIDs, func(i, j int) bool {
+		return baseIDs[i] < baseIDs[j]
+	})
+
+	s := &LogStore{dir: dir, nextID: 1, rooms: make(map[string][]uint64), segmentSize: segmentSize}
+	for _, id := range baseIDs {
+		seg, err := s.openSegment(id)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if err := seg.indexRooms(s.rooms); err != nil {
+			seg.close()
+			s.Close()
+			return nil, fmt.Errorf("error indexing message store segment %d: %s", id, err)
+		}
+		s.segments = append(s.segments, seg)
+		s.nextID = seg.baseID + uint64(len(seg.offsets))
+	}
+
+	if len(s.segments) == 0 {
+		seg, err := s.openSegment(s.nextID)
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, seg)
+	}
+	return s, nil
+}
+
+// openSegment will open the segment starting at baseID, creating it if it doesn't exist. The index is repaired if it
+// doesn't match the contents of the segment.
+func (s *LogStore) openSegment(baseID uint64) (*segment, error) {
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d", baseID))
+	file, err := os.OpenFile(name+segmentExtension, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(name+indexExtension, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	seg := &segment{baseID: baseID, file: file, index: index}
+
+	if err := seg.recover(); err != nil {
+		seg.close()
+		return nil, fmt.Errorf("error recovering message store segment %s: %s", name, err)
+	}
+	return seg, nil
+}
+
+// recover will load the index of seg and bring it up to date with the records in the segment file. A partially
+// written record at the end of the segment is truncated.
+func (seg *segment) recover() error {
+	info, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+	seg.size = info.Size()
+
+	raw, err := ioutil.ReadAll(seg.index)
+	if err != nil {
+		return err
+	}
+	for i := 0; i+indexEntrySize <= len(raw); i += indexEntrySize {
+		offset := int64(binary.BigEndian.Uint64(raw[i:]))
+		if offset >= seg.size || (len(seg.offsets) > 0 && offset <= seg.offsets[len(seg.offsets)-1]) {
+			break
+		}
+		seg.offsets = append(seg.offsets, offset)
+	}
+
+	// The last indexed record is re-read, because it might not have been completely written. All records following
+	// it are missing from the index.
+	var pos int64
+	if len(seg.offsets) > 0 {
+		pos = seg.offsets[len(seg.offsets)-1]
+		seg.offsets = seg.offsets[:len(seg.offsets)-1]
+	}
+	reader := bufio.NewReader(io.NewSectionReader(seg.file, pos, seg.size-pos))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		seg.offsets = append(seg.offsets, pos)
+		pos += int64(len(line))
+	}
+	if pos != seg.size {
+		if err := seg.file.Truncate(pos); err != nil {
+			return err
+		}
+		seg.size = pos
+	}
+
+	// rewrite the index so that it matches the recovered offsets
+	buf := make([]byte, len(seg.offsets)*indexEntrySize)
+	for i, offset := range seg.offsets {
+		binary.BigEndian.PutUint64(buf[i*indexEntrySize:], uint64(offset))
+	}
+	if !bytes.Equal(buf, raw) {
+		if err := seg.index.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := seg.index.WriteAt(buf, 0); err != nil {
+			return err
+		}
+	}
+	_, err = seg.index.Seek(int64(len(buf)), io.SeekStart)
+	return err
+}
+
+// indexRooms will add the IDs of the messages in seg to rooms, which maps the name of a room to the IDs of its
+// messages. Private messages are skipped.
+func (seg *segment) indexRooms(rooms map[string][]uint64) error {
+	reader := bufio.NewReader(io.NewSectionReader(seg.file, 0, seg.size))
+	for i := range seg.offsets {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		var m struct {
+			Recipient string `json:"recipient"`
+			Room      string `json:"room"`
+		}
+		if err := json.Unmarshal(line, &m); err != nil {
+			return err
+		}
+		if m.Recipient == "" {
+			rooms[m.Room] = append(rooms[m.Room], seg.baseID+uint64(i))
+		}
+	}
+	return nil
+}
+
+// read will return the message stored at position i of seg
+func (seg *segment) read(i int) (Message, error) {
+	end := seg.size
+	if i+1 < len(seg.offsets) {
+		end = seg.offsets[i+1]
+	}
+
+	buf := make([]byte, end-seg.offsets[i])
+	if _, err := seg.file.ReadAt(buf, seg.offsets[i]); err != nil {
+		return Message{}, err
+	}
+
+	var m Message
+	err := json.Unmarshal(buf, &m)
+	return m, err
+}
+
+// close will close the files of seg
+func (seg *segment) close() error {
+	err := seg.file.Close()
+	if e := seg.index.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Append implements Store
+func (s *LogStore) Append(m Message) (Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	seg := s.segments[len(s.segments)-1]
+	if seg.size >= s.segmentSize {
+		next, err := s.openSegment(s.nextID)
+		if err != nil {
+			return m, err
+		}
+		s.segments = append(s.segments, next)
+		seg = next
+	}
+
+	m.ID = s.nextID
+	record, err := json.Marshal(m)
+	if err != nil {
+		return m, err
+	}
+	record = append(record, '\n')
+	if _, err := seg.file.Write(record); err != nil {
+		// a partially written record would be read as the start of the next one
+		seg.truncate()
+		return m, err
+	}
+
+	entry := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint64(entry, uint64(seg.size))
+	if _, err := seg.index.Write(entry); err != nil {
+		seg.truncate()
+		return m, err
+	}
+
+	seg.offsets = append(seg.offsets, seg.size)
+	seg.size += int64(len(record))
+	if m.Recipient == "" {
+		s.rooms[m.Room] = append(s.rooms[m.Room], m.ID)
+	}
+	s.nextID++
+	return m, nil
+}
+
+// truncate will discard whatever was written to seg and its index after the last complete record, e.g. when a write
+// failed halfway
+func (seg *segment) truncate() {
+	seg.file.Truncate(seg.size)
+	end := int64(len(seg.offsets)) * indexEntrySize
+	seg.index.Truncate(end)
+	seg.index.Seek(end, io.SeekStart)
+}
+
+// Query implements Store
+func (s *LogStore) Query(q Query) ([]Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if q.Room != "" && !q.Private {
+		return s.queryRoom(q)
+	}
+
+	first := s.segments[0].baseID
+	if q.After >= first {
+		first = q.After + 1
+	}
+	last := s.nextID - 1
+	if q.Before != 0 && q.Before <= last {
+		last = q.Before - 1
+	}
+
+	var result []Message
+	add := func(id uint64) error {
+		m, err := s.read(id)
+		if err != nil {
+			return err
+		}
+		if q.Matches(m) {
+			result = append(result, m)
+		}
+		return nil
+	}
+
+	if !q.Oldest {
+		for id := last; id >= first && id > 0 && (q.Limit <= 0 || len(result) < q.Limit); id-- {
+			if err := add(id); err != nil {
+				return nil, err
+			}
+		}
+		reverse(result)
+	} else {
+		for id := first; id <= last && (q.Limit <= 0 || len(result) < q.Limit); id++ {
+			if err := add(id); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// queryRoom will return the messages selected by q, which is restricted to the public messages of q.Room, using the
+// room index of s. The caller must hold s.mutex.
+func (s *LogStore) queryRoom(q Query) ([]Message, error) {
+	ids := s.rooms[q.Room]
+	start := sort.Search(len(ids), func(i int) bool {
+		return ids[i] > q.After
+	})
+	end := len(ids)
+	if q.Before != 0 {
+		end = sort.Search(len(ids), func(i int) bool {
+			return ids[i] >= q.Before
+		})
+	}
+	if start >= end {
+		return nil, nil
+	}
+	ids = ids[start:end]
+	if q.Limit > 0 && len(ids) > q.Limit {
+		if q.Oldest {
+			ids = ids[:q.Limit]
+		} else {
+			ids = ids[len(ids)-q.Limit:]
+		}
+	}
+
+	var result []Message
+	for _, id := range ids {
+		m, err := s.read(id)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+// read will return the message with the specified id, which must exist in s
+func (s *LogStore) read(id uint64) (Message, error) {
+	i := sort.Search(len(s.segments), func(i int) bool {
+		return s.segments[i].baseID > id
+	}) - 1
+	seg := s.segments[i]
+	return seg.read(int(id - seg.baseID))
+}
+
+// Close implements Store
+func (s *LogStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var err error
+	for _, seg := range s.segments {
+		if e := seg.file.Sync(); e != nil && err == nil {
+			err = e
+		}
+		if e := seg.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	s.segments = nil
+	return err
+}
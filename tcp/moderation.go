@@ -0,0 +1,600 @@
+package tcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Roles of clients, ordered by increasing privileges. Guests are clients that aren't logged into an account, the other
+// roles are assigned to accounts.
+const (
+	RoleGuest     = "guest"
+	RoleUser      = "user"
+	RoleModerator = "moderator" // may kick, ban and mute clients with a lower role
+	RoleAdmin     = "admin"     // may also assign roles using /op
+)
+
+// roles lists all roles ordered by increasing privileges
+var roles = []string{RoleGuest, RoleUser, RoleModerator, RoleAdmin}
+
+// roleRank returns the position of role in roles, or -1 for unknown roles
+func roleRank(role string) int {
+	for i, r := range roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// Kinds of bans
+const (
+	BanAccount = "account" // bans the clients logged into an account
+	BanIP      = "ip"      // bans the clients connecting from an IP address or network
+	BanNick    = "nick"    // bans the clients using a name
+)
+
+// Ban prevents the matching clients from connecting and from sending messages via HTTP
+type Ban struct {
+	By      string    `json:"by"` // the name of the moderator that created the ban
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitempty"` // the ban is permanent if Expires is zero
+	Kind    string    `json:"kind"`              // e.g. BanNick
+	Reason  string    `json:"reason,omitempty"`
+	Value   string    `json:"value"` // the lower case name or account, or the network in CIDR notation
+}
+
+// Expired reports whether b no longer applies at the time now
+func (b *Ban) Expired(now time.Time) bool {
+	return !b.Expires.IsZero() && !now.Before(b.Expires)
+}
+
+// is reports whether b is the ban of kind and value. Names are compared with nameKey.
+func (b *Ban) is(kind, value string) bool {
+	if b.Kind == BanNick || b.Kind == BanAccount {
+		return b.Kind == kind && nameKey(b.Value) == nameKey(value)
+	}
+	return b.Kind == kind && b.Value == value
+}
+
+// Matches reports whether b applies to a client named name that is logged into account ("" for guests) and connected
+// from ip (nil if unknown)
+func (b *Ban) Matches(name, account string, ip net.IP) bool {
+	switch b.Kind {
+	case BanAccount:
+		return account != "" && nameKey(account) == nameKey(b.Value)
+	case BanIP:
+		_, network, err := net.ParseCIDR(b.Value)
+		return err == nil && ip != nil && network.Contains(ip)
+	case BanNick:
+		return name != "" && nameKey(name) == nameKey(b.Value)
+	}
+	return false
+}
+
+// String describes b for display to moderators
+func (b *Ban) String() string {
+	s := fmt.Sprintf("%s %s (by %s", b.Kind, b.Value, b.By)
+	if !b.Expires.IsZero() {
+		s += ", until " + b.Expires.Format("2006-01-02 15:04 MST")
+	}
+	s += ")"
+	if b.Reason != "" {
+		s += ": " + b.Reason
+	}
+	return s
+}
+
+// BannedError is returned when a banned client tries to connect
+type BannedError struct {
+	Ban Ban
+}
+
+// Error implements error
+func (e *BannedError) Error() string {
+	s := "You are banned"
+	if !e.Ban.Expires.IsZero() {
+		s += " until " + e.Ban.Expires.Format("2006-01-02 15:04 MST")
+	}
+	if e.Ban.Reason != "" {
+		s += ": " + e.Ban.Reason
+	}
+	return s
+}
+
+// ParseBanTarget will determine the kind of ban to create for target, which is an IP address, a network in CIDR
+// notation, "account:<name>" or a nickname
+func ParseBanTarget(target string) (kind, value string, err error) {
+	if strings.HasPrefix(strings.ToLower(target), "account:") {
+		name := target[len("account:"):]
+		if err := ValidateNick(name); err != nil {
+			return "", "", err
+		}
+		return BanAccount, strings.ToLower(name), nil
+	} else if ip := net.ParseIP(target); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return BanIP, (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String(), nil
+	} else if _, network, err := net.ParseCIDR(target); err == nil {
+		return BanIP, network.String(), nil
+	} else if err := ValidateNick(target); err != nil {
+		return "", "", fmt.Errorf("invalid ban target %q: must be a name, account:<name>, an IP address or a network", target)
+	}
+	return BanNick, strings.ToLower(target), nil
+}
+
+// BanList holds the active bans. A BanList opened with OpenBanList is persisted to a JSON file, so that bans survive
+// restarts.
+type BanList struct {
+	bans  []Ban
+	file  string
+	mutex sync.RWMutex
+}
+
+// NewBanList will create an empty BanList that keeps bans in memory
+func NewBanList() *BanList {
+	return &BanList{}
+}
+
+// OpenBanList will load the bans from file, which is created once the first ban is added
+func OpenBanList(file string) (*BanList, error) {
+	l := &BanList{file: file}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &l.bans); err != nil {
+		return nil, fmt.Errorf("invalid ban list %s: %s", file, err)
+	}
+	return l, nil
+}
+
+// Add will add b to the list, replacing an existing ban of the same kind and value
+func (l *BanList) Add(b Ban) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bans := []Ban{b}
+	for _, v := range l.bans {
+		if !v.is(b.Kind, b.Value) {
+			bans = append(bans, v)
+		}
+	}
+	return l.save(bans)
+}
+
+// Remove will delete the ban of kind and value. found is false if there is no such ban.
+func (l *BanList) Remove(kind, value string) (found bool, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var bans []Ban
+	for _, v := range l.bans {
+		if v.is(kind, value) {
+			found = true
+		} else {
+			bans = append(bans, v)
+		}
+	}
+	if !found {
+		return false, nil
+	}
+	return true, l.save(bans)
+}
+
+// Match will return the first active ban that applies to a client named name that is logged into account ("" for
+// guests) and connected from ip (nil if unknown), or nil if the client isn't banned
+func (l *BanList) Match(name, account string, ip net.IP) *Ban {
+	now := time.Now()
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	for _, b := range l.bans {
+		if !b.Expired(now) && b.Matches(name, account, ip) {
+			return &b
+		}
+	}
+	return nil
+}
+
+// List will return all active bans ordered by creation time
+func (l *BanList) List() []Ban {
+	now := time.Now()
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	bans := []Ban{}
+	for _, b := range l.bans {
+		if !b.Expired(now) {
+			bans = append(bans, b)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Created.Before(bans[j].Created)
+	})
+	return bans
+}
+
+// save will write bans (without the expired ones) to l.file and make them the bans of l. The caller must hold
+// l.mutex.
+func (l *BanList) save(bans []Ban) error {
+	now := time.Now()
+	active := []Ban{}
+	for _, b := range bans {
+		if !b.Expired(now) {
+			active = append(active, b)
+		}
+	}
+
+	if l.file != "" {
+		data, err := json.MarshalIndent(active, "", "  ")
+		if err != nil {
+			return err
+		} else if err := writeFile(l.file, data); err != nil {
+			return err
+		}
+	}
+	l.bans = active
+	return nil
+}
+
+// Role will return the role of the client conn
+func (h *Handler) Role(conn net.Conn) string {
+	return h.accountRole(h.getClientAccount(conn))
+}
+
+// accountRole will return the role of the account named account, or RoleGuest if account is "". The accounts listed
+// in h.Admins are only admins if the operator created them, so that nobody can become an admin by registering the
+// name first.
+func (h *Handler) accountRole(account string) string {
+	if account == "" {
+		return RoleGuest
+	}
+	a, err := h.Users.Get(account)
+	if err != nil {
+		return RoleUser
+	} else if h.isAdmin(account) && a.Operator {
+		return RoleAdmin
+	} else if a.Role != "" {
+		return a.Role
+	}
+	return RoleUser
+}
+
+// isAdmin reports whether name is listed in h.Admins
+func (h *Handler) isAdmin(name string) bool {
+	for _, a := range h.Admins {
+		if nameKey(a) == nameKey(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRole reports whether the client conn has role or a role with more privileges
+func (h *Handler) hasRole(conn net.Conn, role string) bool {
+	return roleRank(h.Role(conn)) >= roleRank(role)
+}
+
+// SetRole will assign role to the account named account. Accounts listed in h.Admins are always admins.
+func (h *Handler) SetRole(account, role string) error {
+	if role == RoleGuest || roleRank(role) < 0 {
+		return fmt.Errorf("invalid role %q, must be one of: %s", role, strings.Join(roles[1:], ", "))
+	}
+	if h.isAdmin(account) {
+		return fmt.Errorf("%s is an admin in the configuration", account)
+	}
+
+	h.accounts.Lock()
+	defer h.accounts.Unlock()
+	a, err := h.Users.Get(account)
+	if err != nil {
+		return err
+	}
+	a.Role = role
+	if role == RoleUser {
+		a.Role = ""
+	}
+	return h.Users.Put(a)
+}
+
+// CheckBan will return a *BannedError if a client named name that is logged into account ("" for guests) and
+// connected from ip (nil if unknown) is banned
+func (h *Handler) CheckBan(name, account string, ip net.IP) error {
+	if b := h.Bans.Match(name, account, ip); b != nil {
+		return &BannedError{Ban: *b}
+	}
+	return nil
+}
+
+// CheckMute will return an error if the client named name is muted and may not send messages
+func (h *Handler) CheckMute(name string) error {
+	key := nameKey(name)
+	h.mutex.RLock()
+	until, ok := h.mutes[key]
+	h.mutex.RUnlock()
+	if !ok {
+		return nil
+	} else if !until.IsZero() && !time.Now().Before(until) {
+		h.mutex.Lock()
+		if h.mutes[key] == until {
+			delete(h.mutes, key)
+		}
+		h.mutex.Unlock()
+		return nil
+	} else if until.IsZero() {
+		return fmt.Errorf("You are muted")
+	}
+	return fmt.Errorf("You are muted until %s", until.Format("15:04:05"))
+}
+
+// Mute will prevent the client named name from sending messages until the time until, or indefinitely if until is
+// zero. The mute follows the client when it changes its name.
+func (h *Handler) Mute(name string, until time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.mutes[nameKey(name)] = until
+}
+
+// extendMute is the same as Mute, but an existing mute that lasts longer than until is kept
+func (h *Handler) extendMute(name string, until time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if current, ok := h.mutes[nameKey(name)]; !ok || !current.IsZero() && current.Before(until) {
+		h.mutes[nameKey(name)] = until
+	}
+}
+
+// Unmute will allow the client named name to send messages again. found is false if the client wasn't muted.
+func (h *Handler) Unmute(name string) (found bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	_, found = h.mutes[nameKey(name)]
+	delete(h.mutes, nameKey(name))
+	return found
+}
+
+// checkModerate will return an error if the client conn may not moderate a client with the role target. Clients can
+// only moderate clients with a lower role.
+func (h *Handler) checkModerate(conn net.Conn, target string) error {
+	if roleRank(h.Role(conn)) <= roleRank(target) {
+		return fmt.Errorf("You can't moderate users with the %s role", target)
+	}
+	return nil
+}
+
+// remoteIP returns the IP address that conn is connected from, or nil if it is unknown
+func remoteIP(conn net.Conn) net.IP {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// parseDuration parses durations such as "90s", "30m", "12h" or "7d"
+func parseDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if strings.HasSuffix(s, "d") {
+		var days int
+		days, err = strconv.Atoi(strings.TrimSuffix(s, "d"))
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q, e.g. 90s, 30m, 12h or 7d", s)
+	}
+	return d, nil
+}
+
+// cmdBan bans a name, an account or an IP address/network and disconnects the matching clients
+func cmdBan(ctx *CommandContext) error {
+	h := ctx.Handler
+	kind, value, err := ParseBanTarget(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	b := Ban{By: ctx.Name, Created: time.Now(), Kind: kind, Value: value}
+	if len(ctx.Args) > 1 {
+		if d, err := parseDuration(ctx.Args[1]); err == nil {
+			b.Expires = b.Created.Add(d)
+			b.Reason = strings.Join(ctx.Args[2:], " ")
+		} else {
+			b.Reason = strings.Join(ctx.Args[1:], " ")
+		}
+	}
+	// the reason is shown to the banned clients and in /bans, so it follows the policy for control characters
+	if err := h.CheckText(b.Reason); err != nil {
+		return err
+	}
+	b.Reason = h.sanitize(b.Reason)
+
+	// registered names and accounts can only be banned by moderators with a higher role than the account
+	if kind != BanIP && h.IsRegistered(value) {
+		if err := h.checkModerate(ctx.Conn, h.accountRole(value)); err != nil {
+			return err
+		}
+	}
+
+	var targets []net.Conn
+	h.mutex.RLock()
+	for conn, c := range h.clients {
+		if b.Matches(c.name, c.account, remoteIP(conn)) {
+			targets = append(targets, conn)
+		}
+	}
+	h.mutex.RUnlock()
+	for _, conn := range targets {
+		if conn == ctx.Conn {
+			return fmt.Errorf("You can't ban yourself")
+		}
+	}
+	for _, conn := range targets {
+		if err := h.checkModerate(ctx.Conn, h.Role(conn)); err != nil {
+			return fmt.Errorf("%s matches %s -> %s", b.Kind, h.getClientName(conn), err)
+		}
+	}
+
+	if err := h.Bans.Add(b); err != nil {
+		return err
+	}
+	h.logger.WithFields(logrus.Fields{
+		"by":      b.By,
+		"expires": b.Expires,
+		"kind":    b.Kind,
+		"reason":  b.Reason,
+		"value":   b.Value,
+	}).Warn("banned")
+
+	for _, conn := range targets {
+		h.Notify(conn, (&BannedError{Ban: b}).Error())
+		h.Quit(conn, fmt.Sprintf("Banned by %s", ctx.Name))
+	}
+	return ctx.Reply("Banned %s", b.String())
+}
+
+// cmdBans lists the active bans
+func cmdBans(ctx *CommandContext) error {
+	bans := ctx.Handler.Bans.List()
+	if len(bans) == 0 {
+		return ctx.Reply("Nobody is banned")
+	}
+
+	lines := []string{"Bans:"}
+	for _, b := range bans {
+		lines = append(lines, "  "+b.String())
+	}
+	return ctx.Reply("%s", strings.Join(lines, "\r\n"))
+}
+
+// cmdKick disconnects a client
+func cmdKick(ctx *CommandContext) error {
+	h := ctx.Handler
+	conn := h.findClient(ctx.Args[0])
+	if conn == nil {
+		return fmt.Errorf("%s is not online", ctx.Args[0])
+	} else if err := h.checkModerate(ctx.Conn, h.Role(conn)); err != nil {
+		return err
+	}
+
+	reason := fmt.Sprintf("Kicked by %s", ctx.Name)
+	if len(ctx.Args) == 2 {
+		if err := h.CheckText(ctx.Args[1]); err != nil {
+			return err
+		}
+		reason += ": " + h.sanitize(ctx.Args[1])
+	}
+	h.logger.WithFields(logrus.Fields{
+		"by":   ctx.Name,
+		"name": h.getClientName(conn),
+	}).Warn("kicked client")
+	h.Notify(conn, reason)
+	return h.Quit(conn, reason)
+}
+
+// cmdMute prevents a client from sending messages
+func cmdMute(ctx *CommandContext) error {
+	h := ctx.Handler
+	conn := h.findClient(ctx.Args[0])
+	if conn == nil {
+		return fmt.Errorf("%s is not online", ctx.Args[0])
+	} else if err := h.checkModerate(ctx.Conn, h.Role(conn)); err != nil {
+		return err
+	}
+
+	name := h.getClientName(conn)
+	var until time.Time
+	if len(ctx.Args) == 2 {
+		d, err := parseDuration(ctx.Args[1])
+		if err != nil {
+			return err
+		}
+		until = time.Now().Add(d)
+	}
+	h.Mute(name, until)
+	h.logger.WithFields(logrus.Fields{
+		"by":    ctx.Name,
+		"name":  name,
+		"until": until,
+	}).Warn("muted client")
+
+	if until.IsZero() {
+		h.Notify(conn, fmt.Sprintf("You were muted by %s", ctx.Name))
+		return ctx.Reply("Muted %s", name)
+	}
+	h.Notify(conn, fmt.Sprintf("You were muted by %s until %s", ctx.Name, until.Format("15:04:05")))
+	return ctx.Reply("Muted %s until %s", name, until.Format("15:04:05"))
+}
+
+// cmdOp assigns a role to an account
+func cmdOp(ctx *CommandContext) error {
+	h := ctx.Handler
+	role := RoleModerator
+	if len(ctx.Args) == 2 {
+		role = strings.ToLower(ctx.Args[1])
+	}
+
+	if err := h.SetRole(ctx.Args[0], role); err == ErrNoAccount {
+		return fmt.Errorf("%s is not a registered account", ctx.Args[0])
+	} else if err != nil {
+		return err
+	}
+	h.logger.WithFields(logrus.Fields{
+		"account": ctx.Args[0],
+		"by":      ctx.Name,
+		"role":    role,
+	}).Warn("changed role")
+
+	if conn := h.findClient(ctx.Args[0]); conn != nil && conn != ctx.Conn {
+		h.Notify(conn, fmt.Sprintf("%s changed your role to %s", ctx.Name, role))
+	}
+	return ctx.Reply("%s is now a %s", ctx.Args[0], role)
+}
+
+// cmdUnban removes a ban
+func cmdUnban(ctx *CommandContext) error {
+	kind, value, err := ParseBanTarget(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+	if found, err := ctx.Handler.Bans.Remove(kind, value); err != nil {
+		return err
+	} else if !found {
+		return fmt.Errorf("%s %s is not banned", kind, value)
+	}
+	ctx.Handler.logger.WithFields(logrus.Fields{
+		"by":    ctx.Name,
+		"kind":  kind,
+		"value": value,
+	}).Warn("unbanned")
+	return ctx.Reply("Unbanned %s %s", kind, value)
+}
+
+// cmdUnmute allows a muted client to send messages again
+func cmdUnmute(ctx *CommandContext) error {
+	if !ctx.Handler.Unmute(ctx.Args[0]) {
+		return fmt.Errorf("%s is not muted", ctx.Args[0])
+	}
+	if conn := ctx.Handler.findClient(ctx.Args[0]); conn != nil {
+		ctx.Handler.Notify(conn, fmt.Sprintf("You were unmuted by %s", ctx.Name))
+	}
+	return ctx.Reply("Unmuted %s", ctx.Args[0])
+}
@@ -0,0 +1,203 @@
+package tcp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseBanTarget(t *testing.T) {
+	testCases := map[string]struct {
+		target string
+		eKind  string
+		eValue string
+		eErr   bool
+	}{
+		"nick":         {"Bob", BanNick, "bob", false},
+		"account":      {"account:Bob", BanAccount, "bob", false},
+		"ipv4":         {"203.0.113.7", BanIP, "203.0.113.7/32", false},
+		"ipv6":         {"2001:db8::1", BanIP, "2001:db8::1/128", false},
+		"network":      {"203.0.113.7/24", BanIP, "203.0.113.0/24", false},
+		"invalid nick": {"b(o)b", "", "", true},
+		"bad account":  {"account:", "", "", true},
+	}
+	for k, v := range testCases {
+		kind, value, err := ParseBanTarget(v.target)
+		if (err != nil) != v.eErr {
+			t.Errorf("%s: expected error (%v) differed from actual error (%v)", k, v.eErr, err)
+		} else if kind != v.eKind || value != v.eValue {
+			t.Errorf("%s: expected ban (%s %s) differed from actual ban (%s %s)", k, v.eKind, v.eValue, kind, value)
+		}
+	}
+}
+
+func TestBanList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "bans.json")
+	l, err := OpenBanList(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Add(Ban{Kind: BanNick, Value: "bob"})
+	l.Add(Ban{Kind: BanAccount, Value: "carol"})
+	l.Add(Ban{Kind: BanIP, Value: "203.0.113.0/24", Reason: "flooding"})
+	l.Add(Ban{Kind: BanNick, Value: "dave", Expires: time.Now().Add(-time.Minute)})
+
+	// bans are kept across restarts
+	l, err = OpenBanList(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		name    string
+		account string
+		ip      string
+		eBanned bool
+	}{
+		"nick":          {"Bob", "", "", true},
+		"account":       {"carol", "carol", "", true},
+		"guest carol":   {"carol", "", "", false},
+		"ip":            {"alice", "", "203.0.113.7", true},
+		"other ip":      {"alice", "", "198.51.100.7", false},
+		"expired":       {"dave", "", "", false},
+		"not banned":    {"alice", "alice", "", false},
+		"unknown ip v6": {"alice", "", "2001:db8::1", false},
+	}
+	for k, v := range testCases {
+		if b := l.Match(v.name, v.account, net.ParseIP(v.ip)); (b != nil) != v.eBanned {
+			t.Errorf("%s: expected banned (%v) differed from actual ban (%v)", k, v.eBanned, b)
+		}
+	}
+
+	if found, err := l.Remove(BanNick, "bob"); !found || err != nil {
+		t.Errorf("failed to remove ban -> %v", err)
+	}
+	if found, _ := l.Remove(BanNick, "bob"); found {
+		t.Errorf("expected the ban to be removed already")
+	}
+	if bans := l.List(); len(bans) != 2 {
+		t.Errorf("expected 2 active bans, got %v", bans)
+	}
+}
+
+func TestHandler_Moderation(t *testing.T) {
+	address := ""
+	port := 6032
+	h := startHandler(t, address, port, func(h *Handler) {
+		h.Admins = []string{"alice", "root"}
+	})
+	defer h.Stop()
+	if err := h.CreateAccount("alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	} else if err := h.Register("bob", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the names of admins can't be registered by clients, and only accounts created by the operator are admins
+	if err := h.Register("Root", "correct horse"); err == nil {
+		t.Errorf("expected the name of an admin not to be registrable")
+	}
+	h.Users.Put(Account{Name: "root"})
+	if role := h.accountRole("root"); role != RoleUser {
+		t.Errorf("expected role (%s) differed from actual role (%s)", RoleUser, role)
+	}
+
+	login := func(name string) (net.Conn, func(...string)) {
+		conn, reader := dialClient(t, address, port)
+		fmt.Fprintf(conn, "%s\r\ncorrect horse\r\n", name)
+		expectLines(t, reader, ".*enter your password\r\n", "Welcome to telchat "+name+"\r\n", ".*"+name+": Joined\r\n")
+		return conn, func(lines ...string) {
+			expectLines(t, reader, lines...)
+		}
+	}
+	alice, aliceExpect := login("alice")
+	defer alice.Close()
+	bob, bobExpect := login("bob")
+	defer bob.Close()
+	aliceExpect(".*bob: Joined\r\n")
+	mallory, malloryReader := connectClient(t, address, port, "mallory")
+	defer mallory.Close()
+	aliceExpect(".*mallory: Joined\r\n")
+	bobExpect(".*mallory: Joined\r\n")
+
+	// only admins may assign roles
+	fmt.Fprintf(mallory, "/kick bob\r\n")
+	expectLines(t, malloryReader, "/kick requires the moderator role\r\n")
+	fmt.Fprintf(bob, "/op bob\r\n")
+	bobExpect("/op requires the admin role\r\n")
+	fmt.Fprintf(alice, "/op bob\r\n")
+	aliceExpect("bob is now a moderator\r\n")
+	bobExpect("alice changed your role to moderator\r\n")
+
+	// moderators can only moderate users with a lower role
+	fmt.Fprintf(bob, "/kick alice\r\n")
+	bobExpect("You can't moderate users with the admin role\r\n")
+	fmt.Fprintf(bob, "/mute mallory 10m\r\n")
+	bobExpect("Muted mallory until .*\r\n")
+	expectLines(t, malloryReader, "You were muted by bob until .*\r\n")
+	fmt.Fprintf(mallory, "buy cheap stuff\r\n/nick mal\r\n/me spams\r\n")
+	expectLines(t, malloryReader, "You are muted until .*\r\n", ".*mallory: Is now known as mal\r\n", "You are muted until .*\r\n")
+	aliceExpect(".*mallory: Is now known as mal\r\n")
+	bobExpect(".*mallory: Is now known as mal\r\n")
+
+	// the own address can't be banned
+	fmt.Fprintf(bob, "/ban 127.0.0.0/8\r\n")
+	bobExpect("You can't ban yourself\r\n")
+
+	// banned users are disconnected and can't connect again
+	fmt.Fprintf(bob, "/ban mal 1h spam\r\n")
+	expectLines(t, malloryReader, "You are banned until .*: spam\r\n")
+	bobExpect("Banned nick mal \\(by bob, until .*\\): spam\r\n", ".*mal: Disconnected \\(Banned by bob\\)\r\n")
+	aliceExpect(".*mal: Disconnected \\(Banned by bob\\)\r\n")
+	conn, reader := dialClient(t, address, port)
+	defer conn.Close()
+	fmt.Fprintf(conn, "MAL\r\n")
+	expectLines(t, reader, "You are banned until .*: spam\r\n", "Enter your name.*\r\n")
+	if err := h.Connect(&net.TCPConn{}, "mal", SourceWebSocket, TextEncoder); err == nil {
+		t.Errorf("expected a banned user to be turned away from the other transports")
+	}
+
+	// banned names can't be taken by renaming either
+	fmt.Fprintf(conn, "eve\r\n")
+	expectLines(t, reader, "Welcome to telchat eve\r\n", ".*eve: Joined\r\n")
+	aliceExpect(".*eve: Joined\r\n")
+	bobExpect(".*eve: Joined\r\n")
+	fmt.Fprintf(conn, "/nick Mal\r\n")
+	expectLines(t, reader, "The name Mal is banned\r\n")
+
+	// names with spaces can be quoted, and can't be imitated by replacing the spaces with underscores
+	troll, trollReader := connectClient(t, address, port, "troll face")
+	defer troll.Close()
+	aliceExpect(".*troll face: Joined\r\n")
+	bobExpect(".*troll face: Joined\r\n")
+	expectLines(t, reader, ".*troll face: Joined\r\n")
+	imitator, imitatorReader := dialClient(t, address, port)
+	defer imitator.Close()
+	fmt.Fprintf(imitator, "Troll_Face\r\n")
+	expectLines(t, imitatorReader, "The name Troll_Face is already in use, please choose another name\r\n")
+	// reasons follow the policy for control characters
+	fmt.Fprintf(bob, "/kick \"troll face\" bye\x1b[2J\r\n")
+	expectLines(t, trollReader, "Kicked by bob: bye\\^\\[\\[2J\r\n")
+	bobExpect(".*troll face: Disconnected \\(Kicked by bob: bye\\^\\[\\[2J\\)\r\n")
+	aliceExpect(".*troll face: Disconnected \\(Kicked by bob: bye\\^\\[\\[2J\\)\r\n")
+	fmt.Fprintf(bob, "/ban 198.51.100.7 spam\x1b[2J\r\n")
+	bobExpect("Banned ip 198.51.100.7/32 \\(by bob\\): spam\\^\\[\\[2J\r\n")
+	fmt.Fprintf(bob, "/unban 198.51.100.7\r\n")
+	bobExpect("Unbanned ip 198.51.100.7/32\r\n")
+
+	fmt.Fprintf(bob, "/unban mal\r\n")
+	bobExpect("Unbanned nick mal\r\n")
+	fmt.Fprintf(alice, "/kick bob bye\r\n")
+	bobExpect("Kicked by alice: bye\r\n")
+	aliceExpect(".*bob: Disconnected \\(Kicked by alice: bye\\)\r\n")
+}
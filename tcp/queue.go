@@ -0,0 +1,184 @@
+package tcp
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultQueueSize is the default number of messages that are queued for a client that isn't reading fast enough
+const DefaultQueueSize = 256
+
+// DefaultWriteTimeout is the default time that a write to a client may take before the client is disconnected
+const DefaultWriteTimeout = 10 * time.Second
+
+// Policies for clients whose outbound queue is full, see Handler.OverflowPolicy
+const (
+	OverflowDisconnect = "disconnect"  // disconnect the client
+	OverflowDropOldest = "drop-oldest" // drop the oldest queued message to make room for the new one
+)
+
+// errQueueClosed is returned when writing to a client that is disconnecting
+var errQueueClosed = errors.New("connection is closing")
+
+// ErrQueueFull is returned when a message can't be queued for a client because it is too far behind. The client is
+// disconnected.
+var ErrQueueFull = errors.New("outbound queue is full")
+
+// outQueue holds the messages waiting to be written to a client. A dedicated writer goroutine (see run) writes them
+// to the client's connection, so a client that stops reading can't block anyone else.
+type outQueue struct {
+	closing bool // no further messages are accepted, the connection is closed once the queue is drained
+	cond    *sync.Cond
+	conn    net.Conn
+	dropped uint64
+	items   [][]byte
+	mutex   sync.Mutex
+	size    int
+}
+
+// newOutQueue will create an empty outQueue for conn that holds up to size messages
+func newOutQueue(conn net.Conn, size int) *outQueue {
+	q := &outQueue{conn: conn, size: size}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// push will add b to the end of q. If q is full, the oldest message is dropped when drop is true, otherwise
+// ErrQueueFull is returned. dropped reports whether a message was dropped.
+func (q *outQueue) push(b []byte, drop bool) (dropped bool, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closing {
+		return false, errQueueClosed
+	} else if len(q.items) >= q.size {
+		if !drop {
+			return false, ErrQueueFull
+		}
+		q.items = q.items[1:]
+		q.dropped++
+		dropped = true
+	}
+	q.items = append(q.items, b)
+	q.cond.Signal()
+	return dropped, nil
+}
+
+// pop will wait for the next message of q. ok is false once q is closing and has been drained.
+func (q *outQueue) pop() (b []byte, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.items) == 0 && !q.closing {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	b = q.items[0]
+	q.items = q.items[1:]
+	return b, true
+}
+
+// close will stop q from accepting messages. The messages that are already queued are still written, unless discard
+// is true.
+func (q *outQueue) close(discard bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closing = true
+	if discard {
+		q.items = nil
+	}
+	q.cond.Broadcast()
+}
+
+// depth returns the number of queued messages and the number of messages dropped so far
+func (q *outQueue) depth() (queued int, dropped uint64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.items), q.dropped
+}
+
+// run writes the messages of q to its connection until q is closed or a write fails, and then closes the
+// connection. Every write must finish within timeout (unless it is 0), so a client that stops reading is disconnected
+// instead of holding on to the messages queued for it.
+func (q *outQueue) run(timeout time.Duration, logger *logrus.Logger) {
+	defer q.conn.Close()
+	for {
+		b, ok := q.pop()
+		if !ok {
+			return
+		}
+		if timeout > 0 {
+			q.conn.SetWriteDeadline(time.Now().Add(timeout))
+		}
+		if _, err := q.conn.Write(b); err != nil {
+			logger.WithFields(logrus.Fields{
+				"address.remote": q.conn.RemoteAddr(),
+				"error":          err,
+			}).Info("error writing to client, disconnecting")
+			q.close(true)
+			return
+		}
+	}
+}
+
+// enqueue will add b to the outbound queue of the client conn, applying h.OverflowPolicy if the queue is full
+func (h *Handler) enqueue(conn net.Conn, q *outQueue, b []byte) error {
+	dropped, err := q.push(b, h.OverflowPolicy != OverflowDisconnect)
+	if err == ErrQueueFull {
+		h.logger.WithFields(logrus.Fields{
+			"address.remote": conn.RemoteAddr(),
+			"name":           h.getClientName(conn),
+			"queue":          q.size,
+		}).Warn("outbound queue is full, disconnecting slow client")
+		q.close(true)
+
+		// closing conn also ends a write that is blocked on the client
+		conn.Close()
+	} else if dropped {
+		_, total := q.depth()
+		logger := h.logger.WithFields(logrus.Fields{
+			"dropped": total,
+			"name":    h.getClientName(conn),
+			"queue":   q.size,
+		})
+		if total&(total-1) == 0 {
+			// only every power of two is logged as a warning, so that a stuck client doesn't flood the log
+			logger.Warn("outbound queue is full, dropped oldest message of slow client")
+		} else {
+			logger.Debug("outbound queue is full, dropped oldest message of slow client")
+		}
+	}
+	return err
+}
+
+// QueueStats describes the outbound queue of a connected client
+type QueueStats struct {
+	Dropped uint64 `json:"dropped"` // the number of messages dropped because the queue was full
+	Name    string `json:"name"`
+	Queued  int    `json:"queued"` // the number of messages waiting to be written
+	Source  string `json:"source"`
+}
+
+// QueueStats will return the state of the outbound queue of every connected client, sorted by name
+func (h *Handler) QueueStats() []QueueStats {
+	h.mutex.RLock()
+	stats := make([]QueueStats, 0, len(h.clients))
+	for _, c := range h.clients {
+		s := QueueStats{Name: c.name, Source: c.source}
+		if c.queue != nil {
+			s.Queued, s.Dropped = c.queue.depth()
+		}
+		stats = append(stats, s)
+	}
+	h.mutex.RUnlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
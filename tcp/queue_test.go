@@ -0,0 +1,97 @@
+package tcp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOutQueue(t *testing.T) {
+	q := newOutQueue(nil, 2)
+	for _, s := range []string{"a", "b", "c"} {
+		if _, err := q.push([]byte(s), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := q.push([]byte("d"), false); err != ErrQueueFull {
+		t.Errorf("expected error (%v) differed from actual error (%v)", ErrQueueFull, err)
+	}
+	if queued, dropped := q.depth(); queued != 2 || dropped != 1 {
+		t.Errorf("expected depth (2, 1) differed from actual depth (%d, %d)", queued, dropped)
+	}
+
+	// queued messages are still written after the queue was closed, unless they are discarded
+	q.close(false)
+	if _, err := q.push([]byte("e"), true); err != errQueueClosed {
+		t.Errorf("expected error (%v) differed from actual error (%v)", errQueueClosed, err)
+	}
+	for _, e := range []string{"b", "c"} {
+		if b, ok := q.pop(); !ok || string(b) != e {
+			t.Errorf("expected message (%s) differed from actual message (%s)", e, b)
+		}
+	}
+	if _, ok := q.pop(); ok {
+		t.Errorf("expected a drained queue to be done")
+	}
+}
+
+func TestHandler_SlowClient(t *testing.T) {
+	// slowClient connects a client that doesn't read to a new Handler, and then sends 10 messages from another client
+	slowClient := func(port int, configure func(h *Handler)) (*Handler, net.Conn, net.Conn, *bufio.Reader) {
+		address := ""
+		h := startHandler(t, address, port, configure)
+		server, client := net.Pipe()
+		if err := h.Connect(server, "alice", SourceWebSocket, TextEncoder); err != nil {
+			t.Fatal(err)
+		}
+		bob, bobReader := connectClient(t, address, port, "bob")
+		for i := 1; i <= 10; i++ {
+			fmt.Fprintf(bob, "spam %d\r\n", i)
+			expectLines(t, bobReader, fmt.Sprintf(".*bob: spam %d\r\n", i))
+		}
+		return h, server, client, bobReader
+	}
+
+	// a slow client loses the oldest messages, but keeps receiving the newest ones
+	h, _, client, _ := slowClient(6036, func(h *Handler) {
+		h.QueueSize = 4
+	})
+	defer h.Stop()
+	defer client.Close()
+	stats := h.QueueStats()
+	if len(stats) != 2 || stats[0].Name != "alice" || stats[0].Queued != 4 || stats[0].Dropped != 8 {
+		t.Errorf("expected alice to have 4 queued and 8 dropped messages, got %+v", stats)
+	}
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	expectLines(t, bufio.NewReader(client), "Welcome to telchat alice\r\n", ".*bob: spam 7\r\n", ".*bob: spam 8\r\n", ".*bob: spam 9\r\n", ".*bob: spam 10\r\n")
+
+	// with the disconnect policy a slow client is disconnected instead
+	h, server, client, bobReader := slowClient(6038, func(h *Handler) {
+		h.OverflowPolicy = OverflowDisconnect
+		h.QueueSize = 4
+	})
+	defer h.Stop()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, client); err != nil {
+		t.Errorf("expected alice to be disconnected -> %s", err)
+	}
+	h.Disconnect(server)
+	expectLines(t, bobReader, ".*alice: Disconnected\r\n")
+
+	// a client that doesn't read at all is disconnected once the write timeout expires
+	h, server, client, bobReader = slowClient(6040, func(h *Handler) {
+		h.WriteTimeout = 100 * time.Millisecond
+	})
+	defer h.Stop()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	time.Sleep(200 * time.Millisecond)
+	if _, err := io.Copy(ioutil.Discard, client); err != nil {
+		t.Errorf("expected alice to be disconnected -> %s", err)
+	}
+	h.Disconnect(server)
+	expectLines(t, bobReader, ".*alice: Disconnected\r\n")
+}
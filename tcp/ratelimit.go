@@ -0,0 +1,201 @@
+package tcp
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// floodMemory is how long the offences of a client are remembered. A client that hasn't been throttled for this long
+// starts over with warnings.
+const floodMemory = 10 * time.Minute
+
+// RateLimit configures a token bucket: Burst messages may be sent at once, after that the bucket refills at Rate
+// messages per second. A RateLimit with a Rate of 0 or less doesn't limit anything.
+type RateLimit struct {
+	Burst int
+	Rate  float64
+}
+
+// tokenBucket implements RateLimit for a single client
+type tokenBucket struct {
+	last   time.Time
+	limit  RateLimit
+	tokens float64
+}
+
+// newTokenBucket will create a full tokenBucket for limit
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst)}
+}
+
+// refill will add the tokens that accumulated since the last call
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	}
+	b.last = now
+}
+
+// allow will take a token from b and return true, or return false if b is empty. wait is the time until the next
+// token is available.
+func (b *tokenBucket) allow(now time.Time) (ok bool, wait time.Duration) {
+	if b.limit.Rate <= 0 {
+		return true, 0
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// full reports whether b has refilled completely, in which case it no longer holds any state worth keeping
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= float64(b.limit.Burst)
+}
+
+// RateLimiter applies a RateLimit to each of many keys (e.g. the IP addresses of HTTP clients)
+type RateLimiter struct {
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	limit     RateLimit
+	mutex     sync.Mutex
+	throttled uint64
+}
+
+// NewRateLimiter will create a RateLimiter that applies limit to every key
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{buckets: make(map[string]*tokenBucket), lastSweep: time.Now(), limit: limit}
+}
+
+// Allow will return true if key may send another message. Otherwise wait is the time until it may send again.
+func (l *RateLimiter) Allow(key string) (ok bool, wait time.Duration) {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// forget the keys that haven't been seen long enough for their buckets to refill, so that the map doesn't grow
+	// with every address that ever sent a request
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, found := l.buckets[key]
+	if !found {
+		b = newTokenBucket(l.limit)
+		l.buckets[key] = b
+	}
+	if ok, wait = b.allow(now); !ok {
+		l.throttled++
+	}
+	return ok, wait
+}
+
+// Throttled returns the number of messages that were rejected by l
+func (l *RateLimiter) Throttled() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.throttled
+}
+
+// FloodControl configures how clients that send messages or commands faster than Limit are dealt with. The first
+// Warnings throttled messages are answered with a warning, the next one mutes the client for MuteDuration. A client
+// that keeps flooding after it was muted Mutes times is disconnected.
+type FloodControl struct {
+	Limit        RateLimit
+	MuteDuration time.Duration
+	Mutes        int
+	Warnings     int
+}
+
+// FloodStats counts the messages that were throttled by FloodControl and what was done about them
+type FloodStats struct {
+	Disconnects uint64 `json:"disconnects"`
+	Mutes       uint64 `json:"mutes"`
+	Throttled   uint64 `json:"throttled"`
+	Warnings    uint64 `json:"warnings"`
+}
+
+// FloodStats returns the number of throttled messages, warnings, mutes and disconnects since h was created
+func (h *Handler) FloodStats() FloodStats {
+	return FloodStats{
+		Disconnects: atomic.LoadUint64(&h.floodStats.Disconnects),
+		Mutes:       atomic.LoadUint64(&h.floodStats.Mutes),
+		Throttled:   atomic.LoadUint64(&h.floodStats.Throttled),
+		Warnings:    atomic.LoadUint64(&h.floodStats.Warnings),
+	}
+}
+
+// throttle will return true if the client conn exceeded h.FloodControl, in which case its message must be dropped.
+// The client is warned, muted or disconnected depending on how often it was throttled.
+func (h *Handler) throttle(conn net.Conn) bool {
+	fc := h.FloodControl
+	if fc.Limit.Rate <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	h.mutex.Lock()
+	c, found := h.clients[conn]
+	if !found {
+		h.mutex.Unlock()
+		return false
+	}
+	if c.bucket == nil {
+		c.bucket = newTokenBucket(fc.Limit)
+	}
+	if ok, _ := c.bucket.allow(now); ok {
+		h.mutex.Unlock()
+		return false
+	}
+
+	if now.Sub(c.lastStrike) > floodMemory {
+		c.strikes, c.floodMutes = 0, 0
+	}
+	c.lastStrike = now
+	c.strikes++
+	strikes, mutes, name := c.strikes, c.floodMutes, c.name
+	if strikes > fc.Warnings {
+		c.strikes = 0
+		c.floodMutes++
+	}
+	h.mutex.Unlock()
+
+	atomic.AddUint64(&h.floodStats.Throttled, 1)
+	logger := h.logger.WithFields(logrus.Fields{
+		"address.remote": conn.RemoteAddr(),
+		"name":           name,
+		"strikes":        strikes,
+		"throttled":      atomic.LoadUint64(&h.floodStats.Throttled),
+	})
+	switch {
+	case strikes <= fc.Warnings:
+		atomic.AddUint64(&h.floodStats.Warnings, 1)
+		logger.Warn("throttled client")
+		h.Notify(conn, fmt.Sprintf("You are sending messages too fast, slow down (warning %d of %d)", strikes, fc.Warnings))
+	case mutes < fc.Mutes:
+		atomic.AddUint64(&h.floodStats.Mutes, 1)
+		logger.Warn("muted client for flooding")
+		h.extendMute(name, now.Add(fc.MuteDuration))
+		h.Notify(conn, fmt.Sprintf("You were muted for %s for flooding", fc.MuteDuration))
+	default:
+		atomic.AddUint64(&h.floodStats.Disconnects, 1)
+		logger.Warn("disconnected client for flooding")
+		h.Notify(conn, "You were disconnected for flooding")
+		h.Quit(conn, "Flooding")
+	}
+	return true
+}
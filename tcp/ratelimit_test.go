@@ -0,0 +1,90 @@
+package tcp
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(RateLimit{Burst: 2, Rate: 1})
+	now := time.Now()
+
+	testCases := []struct {
+		after time.Duration
+		eOK   bool
+	}{
+		{0, true},
+		{0, true},
+		{0, false},
+		{500 * time.Millisecond, false},
+		{500 * time.Millisecond, true},
+		{10 * time.Second, true},
+		{0, true},
+		{0, false},
+	}
+	for i, v := range testCases {
+		now = now.Add(v.after)
+		if ok, _ := b.allow(now); ok != v.eOK {
+			t.Errorf("%d: expected allow (%v) differed from actual allow (%v)", i, v.eOK, ok)
+		}
+	}
+
+	if _, wait := b.allow(now); wait != time.Second {
+		t.Errorf("expected wait (%v) differed from actual wait (%v)", time.Second, wait)
+	}
+	if ok, _ := newTokenBucket(RateLimit{}).allow(now); !ok {
+		t.Errorf("expected a bucket without a rate to allow everything")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(RateLimit{Burst: 1, Rate: 0.001})
+	if ok, _ := l.Allow("a"); !ok {
+		t.Errorf("expected the first message of a to be allowed")
+	}
+	if ok, wait := l.Allow("a"); ok || wait <= 0 {
+		t.Errorf("expected the second message of a to be throttled, got %v %v", ok, wait)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Errorf("expected every key to have its own bucket")
+	}
+	if l.Throttled() != 1 {
+		t.Errorf("expected throttled (1) differed from actual throttled (%d)", l.Throttled())
+	}
+}
+
+func TestHandler_FloodControl(t *testing.T) {
+	address := ""
+	port := 6034
+	h := startHandler(t, address, port, func(h *Handler) {
+		h.FloodControl = FloodControl{Limit: RateLimit{Burst: 2, Rate: 0.001}, MuteDuration: time.Minute, Mutes: 1, Warnings: 1}
+	})
+	defer h.Stop()
+
+	conn, reader := connectClient(t, address, port, "bot")
+	defer conn.Close()
+
+	// the burst is allowed, then warnings come first, followed by a mute and a disconnect
+	fmt.Fprintf(conn, "spam 1\r\nspam 2\r\n")
+	expectLines(t, reader, ".*bot: spam 1\r\n", ".*bot: spam 2\r\n")
+	for i := 3; i <= 6; i++ {
+		fmt.Fprintf(conn, "spam %d\r\n", i)
+	}
+	expectLines(t, reader, "You are sending messages too fast, slow down \\(warning 1 of 1\\)\r\n")
+	expectLines(t, reader, "You were muted for 1m0s for flooding\r\n")
+	expectLines(t, reader, "You are sending messages too fast, slow down \\(warning 1 of 1\\)\r\n")
+	expectLines(t, reader, "You were disconnected for flooding\r\n")
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected the client to be disconnected, got %v", err)
+	}
+
+	e := FloodStats{Disconnects: 1, Mutes: 1, Throttled: 4, Warnings: 2}
+	if s := h.FloodStats(); s != e {
+		t.Errorf("expected stats (%+v) differed from actual stats (%+v)", e, s)
+	}
+	if err := h.CheckMute("bot"); err == nil {
+		t.Errorf("expected bot to be muted")
+	}
+}
@@ -0,0 +1,164 @@
+package tcp
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Encoder converts a Message into the bytes that are written to a client's connection
+type Encoder func(m Message) []byte
+
+// TextEncoder is an Encoder that renders messages as lines of text for display in a terminal
+func TextEncoder(m Message) []byte {
+	return []byte(Render(m))
+}
+
+// Describe returns the text displayed for m, which describes the event for messages such as joins
+func Describe(m Message) string {
+	switch m.Kind {
+	case KindJoin:
+		return "Joined"
+	case KindNick:
+		return fmt.Sprintf("Is now known as %s", m.Message)
+	case KindPart:
+		return "Left"
+	case KindQuit:
+		if m.Message != "" {
+			return fmt.Sprintf("Disconnected (%s)", m.Message)
+		}
+		return "Disconnected"
+	case KindTopic:
+		if m.Message == "" {
+			return "Cleared the topic"
+		}
+		return fmt.Sprintf("Changed the topic to: %s", m.Message)
+	}
+	return m.Message
+}
+
+// ANSI escape sequences used by RenderColor
+const (
+	ansiBold    = "\x1b[1m"
+	ansiDim     = "\x1b[2m"
+	ansiReset   = "\x1b[0m"
+	ansiReverse = "\x1b[7m"
+)
+
+// nickColors are the foreground colors that are assigned to nicknames, excluding black and white which are invisible
+// on some backgrounds
+var nickColors = []int{31, 32, 33, 34, 35, 36, 91, 92, 93, 94, 95, 96}
+
+// colorTerminals are the prefixes of the terminal types that are known to support ANSI colors
+var colorTerminals = []string{"ansi", "cygwin", "konsole", "linux", "putty", "rxvt", "screen", "tmux", "vt220", "xterm"}
+
+// TerminalTyper is implemented by the connections of clients that report their terminal type, such as telnet and SSH
+// clients. Clients with a terminal that supports colors receive colored messages (see RenderColor) by default.
+type TerminalTyper interface {
+	TerminalType() string
+}
+
+// SupportsColor reports whether the terminal type t (e.g. as reported by a telnet or SSH client) supports ANSI colors
+func SupportsColor(t string) bool {
+	t = strings.ToLower(t)
+	if strings.Contains(t, "color") {
+		return true
+	}
+	for _, prefix := range colorTerminals {
+		if strings.HasPrefix(t, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// NickColor returns the ANSI escape sequence of the color of the nickname name. A name always has the same color,
+// regardless of its case.
+func NickColor(name string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.ToLower(name)))
+	return fmt.Sprintf("\x1b[%dm", nickColors[hash.Sum32()%uint32(len(nickColors))])
+}
+
+// Render converts m into a line of text that can be displayed to a user. Every message except for system notices is
+// prefixed with the time it was received by the server.
+func Render(m Message) string {
+	return render(m, "", false)
+}
+
+// RenderColor is the same as Render, but formats the line using ANSI escape sequences for the client named self:
+// nicknames are colored, system notices and events are dimmed, the messages of self are bold and mentions of self are
+// highlighted.
+func RenderColor(m Message, self string) string {
+	return render(m, self, true)
+}
+
+// render converts m into a line of text for the client named self, using ANSI escape sequences if color is true
+func render(m Message, self string, color bool) string {
+	paint := func(s string, style string) string {
+		if !color || s == "" {
+			return s
+		}
+		return style + s + ansiReset
+	}
+
+	text := strings.TrimSuffix(Describe(m), "\r\n")
+	if m.Kind == KindSystem {
+		// notices from the server (e.g. replies to commands) are displayed as is
+		return paint(text, ansiDim) + "\r\n"
+	}
+	own := strings.EqualFold(m.Sender, self)
+	if m.IsEvent() {
+		text = paint(text, ansiDim)
+	} else if own {
+		text = paint(text, ansiBold)
+	} else if color {
+		text = highlightMentions(text, self)
+	}
+
+	prefix := paint(m.Time.Format("15:04:05"), ansiDim)
+	sender := paint(m.Sender, NickColor(m.Sender))
+	if m.Source == SourceHTTP {
+		// messages posted via HTTP are tagged so that they can't be mistaken for messages from a connected client
+		sender = fmt.Sprintf("%s (via http)", sender)
+	}
+	if m.Kind == KindPrivate {
+		recipient := paint(m.Recipient, NickColor(m.Recipient))
+		if m.Action {
+			return fmt.Sprintf("%s * %s -> %s %s\r\n", prefix, sender, recipient, text)
+		}
+		return fmt.Sprintf("%s %s -> %s: %s\r\n", prefix, sender, recipient, text)
+	} else if m.Room != "" && m.Room != DefaultRoom {
+		prefix = fmt.Sprintf("%s [%s]", prefix, m.Room)
+	}
+	if m.Kind == KindAction {
+		return fmt.Sprintf("%s * %s %s\r\n", prefix, sender, text)
+	}
+	return fmt.Sprintf("%s %s: %s\r\n", prefix, sender, text)
+}
+
+// highlightMentions will highlight the words of text that equal name, ignoring case
+func highlightMentions(text string, name string) string {
+	if name == "" {
+		return text
+	}
+	var b strings.Builder
+	runes, length := []rune(text), utf8.RuneCountInString(name)
+	for i := 0; i < len(runes); i++ {
+		if i+length <= len(runes) && strings.EqualFold(string(runes[i:i+length]), name) &&
+			(i == 0 || !isWordRune(runes[i-1])) && (i+length == len(runes) || !isWordRune(runes[i+length])) {
+			b.WriteString(ansiReverse + string(runes[i:i+length]) + ansiReset)
+			i += length - 1
+			continue
+		}
+		b.WriteRune(runes[i])
+	}
+	return b.String()
+}
+
+// isWordRune reports whether r continues a word, so that a mention isn't highlighted inside a longer name
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.[]\\`^{|}", r)
+}
@@ -0,0 +1,82 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Policies for control characters in the text sent by clients, see Handler.SanitizePolicy
+const (
+	SanitizeEscape = "escape" // replace control characters with a visible representation, e.g. ESC with "^["
+	SanitizeReject = "reject" // refuse text that contains control characters
+	SanitizeStrip  = "strip"  // remove control characters
+)
+
+// ErrControlCharacters is returned for text that contains control characters when the sanitization policy is
+// SanitizeReject
+var ErrControlCharacters = errors.New("messages must not contain control characters or escape sequences")
+
+// unsafeRune reports whether r changes the state of a terminal or the way that the text around it is displayed. These
+// are the ASCII and C1 control characters except for tab (including ESC, which starts ANSI escape sequences, and CR
+// and LF, which could be used to fake lines from other users) and the Unicode bidirectional formatting characters,
+// which can make text appear in a different order.
+func unsafeRune(r rune) bool {
+	return (unicode.IsControl(r) && r != '\t') || (r >= 0x202a && r <= 0x202e) || (r >= 0x2066 && r <= 0x2069)
+}
+
+// ContainsControl reports whether text contains control characters or invalid UTF-8, which are removed or escaped by
+// SanitizeText
+func ContainsControl(text string) bool {
+	if !utf8.ValidString(text) {
+		return true
+	}
+	return strings.IndexFunc(text, unsafeRune) >= 0
+}
+
+// SanitizeText will remove the control characters and invalid UTF-8 from text, so that it can be written to a terminal
+// safely. If escape is true they are replaced with a visible representation instead: "^[" for ESC (caret notation)
+// and other ASCII control characters, "<U+009B>" for the remaining control characters and "\x9b" for invalid bytes.
+func SanitizeText(text string, escape bool) string {
+	if !ContainsControl(text) {
+		return text
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			if escape {
+				fmt.Fprintf(&b, "\\x%02x", text[i])
+			}
+		case !unsafeRune(r):
+			b.WriteRune(r)
+		case !escape:
+		case r < 0x20:
+			b.WriteString("^" + string(r+'@'))
+		case r == 0x7f:
+			b.WriteString("^?")
+		default:
+			fmt.Fprintf(&b, "<U+%04X>", r)
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// CheckText will return ErrControlCharacters if text must be refused according to h.SanitizePolicy
+func (h *Handler) CheckText(text string) error {
+	if h.SanitizePolicy == SanitizeReject && ContainsControl(text) {
+		return ErrControlCharacters
+	}
+	return nil
+}
+
+// sanitize will remove or escape the control characters of text according to h.SanitizePolicy. Text that reaches it
+// despite SanitizeReject (e.g. quit messages) is stripped.
+func (h *Handler) sanitize(text string) string {
+	return SanitizeText(text, h.SanitizePolicy == SanitizeEscape)
+}
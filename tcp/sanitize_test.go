@@ -0,0 +1,72 @@
+package tcp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSanitizeText(t *testing.T) {
+	testCases := map[string]struct {
+		text    string
+		eEscape string
+		eStrip  string
+	}{
+		"plain":           {"hi\tthere, ünïcode", "hi\tthere, ünïcode", "hi\tthere, ünïcode"},
+		"clear screen":    {"\x1b[2Jhi", "^[[2Jhi", "[2Jhi"},
+		"window title":    {"\x1b]0;pwned\x07", "^[]0;pwned^G", "]0;pwned"},
+		"fake line":       {"hi\r\n12:00:00 alice: bye", "hi^M^J12:00:00 alice: bye", "hi12:00:00 alice: bye"},
+		"delete":          {"a\x7fb", "a^?b", "ab"},
+		"c1 control":      {"\u009b2J", "<U+009B>2J", "2J"},
+		"bidi override":   {"abc\u202edef", "abc<U+202E>def", "abcdef"},
+		"invalid utf-8":   {"a\x9bb", "a\\x9bb", "ab"},
+		"already escaped": {"^[[2J", "^[[2J", "^[[2J"},
+	}
+	for k, v := range testCases {
+		if s := SanitizeText(v.text, true); s != v.eEscape {
+			t.Errorf("%s: expected escaped text (%q) differed from actual escaped text (%q)", k, v.eEscape, s)
+		}
+		if s := SanitizeText(v.text, false); s != v.eStrip {
+			t.Errorf("%s: expected stripped text (%q) differed from actual stripped text (%q)", k, v.eStrip, s)
+		}
+	}
+}
+
+func TestHandler_Sanitize(t *testing.T) {
+	address := ""
+	port := 6048
+	h := startHandler(t, address, port)
+	defer h.Stop()
+
+	alice, aliceReader := connectClient(t, address, port, "alice")
+	defer alice.Close()
+	bob, bobReader := connectClient(t, address, port, "bob")
+	defer bob.Close()
+	expectLines(t, aliceReader, ".*bob: Joined\r\n")
+
+	// escape sequences typed by a client are displayed instead of being interpreted by the terminals of others
+	fmt.Fprintf(alice, "\x1b[2Jhi\r\n")
+	expectLines(t, bobReader, "[0-9:]+ alice: \\^\\[\\[2Jhi\r\n")
+	fmt.Fprintf(alice, "/me \x1b[31mwaves\r\n")
+	expectLines(t, bobReader, "[0-9:]+ \\* alice \\^\\[\\[31mwaves\r\n")
+	expectLines(t, aliceReader, "[0-9:]+ alice: \\^\\[\\[2Jhi\r\n", "[0-9:]+ \\* alice \\^\\[\\[31mwaves\r\n")
+
+}
+
+func TestHandler_SanitizeReject(t *testing.T) {
+	address := ""
+	port := 6050
+	h := startHandler(t, address, port, func(h *Handler) {
+		h.SanitizePolicy = SanitizeReject
+	})
+	defer h.Stop()
+
+	alice, aliceReader := connectClient(t, address, port, "alice")
+	defer alice.Close()
+
+	fmt.Fprintf(alice, "\x1b[2Jhi\r\n")
+	expectLines(t, aliceReader, ErrControlCharacters.Error()+"\r\n")
+	fmt.Fprintf(alice, "/topic \x1b[5mnews\r\n")
+	expectLines(t, aliceReader, ErrControlCharacters.Error()+"\r\n")
+	fmt.Fprintf(alice, "fine\r\n")
+	expectLines(t, aliceReader, "[0-9:]+ alice: fine\r\n")
+}
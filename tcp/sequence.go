@@ -0,0 +1,79 @@
+package tcp
+
+import (
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ingest will stamp message with the time it was received, its kind and its sequence number within its room, persist
+// it and deliver it to every subscriber and client. Messages are ingested one at a time, so every client and
+// subscriber receives the messages of a room in the order of their sequence numbers.
+func (h *Handler) ingest(message Message) {
+	h.sequencer.Lock()
+	defer h.sequencer.Unlock()
+
+	message.Time = time.Now()
+	if message.Kind == "" {
+		message.Kind = chatKind(message)
+	}
+	// text from clients is written to terminals, server-generated formatting is only added when it is rendered
+	message.Message = h.sanitize(strings.TrimRight(message.Message, "\r\n"))
+	if message.Recipient != "" {
+		message.Room = ""
+	} else {
+		if message.Room == "" {
+			message.Room = DefaultRoom
+		}
+		message.Seq = h.nextSeq(message.Room)
+	}
+	if stored, err := h.Store.Append(message); err != nil {
+		h.logger.WithFields(logrus.Fields{
+			"error":   err,
+			"message": message.Message,
+			"sender":  message.Sender,
+		}).Error("error storing message")
+	} else {
+		message = stored
+	}
+	h.publishMessage(message)
+	h.broadcastMessage(message)
+}
+
+// nextSeq will return the next sequence number of room. The first message of a room is number 1. The caller must hold
+// h.sequencer.
+func (h *Handler) nextSeq(room string) uint64 {
+	seq := h.lastSeq(room) + 1
+	h.seqs[room] = seq
+	return seq
+}
+
+// lastSeq will return the sequence number of the last message of room. After a restart the numbering continues from
+// the newest message of room in h.Store. The caller must hold h.sequencer.
+func (h *Handler) lastSeq(room string) uint64 {
+	if seq, found := h.seqs[room]; found {
+		return seq
+	}
+
+	var seq uint64
+	latest, err := h.Store.Query(Query{Limit: 1, Room: room})
+	if err != nil {
+		h.logger.WithFields(logrus.Fields{
+			"error": err,
+			"room":  room,
+		}).Error("error loading the last sequence number of room")
+		return 0
+	} else if len(latest) > 0 {
+		seq = latest[0].Seq
+	}
+	h.seqs[room] = seq
+	return seq
+}
+
+// LastSeq returns the sequence number of the last message that was sent to room, or 0 if room has no messages
+func (h *Handler) LastSeq(room string) uint64 {
+	h.sequencer.Lock()
+	defer h.sequencer.Unlock()
+	return h.lastSeq(room)
+}
@@ -0,0 +1,108 @@
+package tcp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestHandler_nextSeq(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	h := New("", 6042, logger)
+	h.Store = NewMemoryStore(0)
+
+	// the numbering of a room continues from the newest stored message of the room after a restart
+	h.Store.Append(Message{Message: "before the restart", Room: DefaultRoom, Seq: 41})
+	h.ingest(Message{Message: "after the restart", Sender: "alice"})
+	h.ingest(Message{Message: "hi", Room: "ops", Sender: "alice"})
+	h.ingest(Message{Message: "psst", Recipient: "bob", Sender: "alice"})
+
+	messages, _ := h.Store.Query(Query{Private: true})
+	var seqs []uint64
+	for _, m := range messages {
+		seqs = append(seqs, m.Seq)
+	}
+	if e := []uint64{41, 42, 1, 0}; !reflect.DeepEqual(seqs, e) {
+		t.Errorf("expected sequence numbers (%v) differed from actual sequence numbers (%v)", e, seqs)
+	}
+	if seq := h.LastSeq("empty"); seq != 0 {
+		t.Errorf("expected last sequence number (0) differed from actual last sequence number (%d)", seq)
+	}
+}
+
+func TestHandler_OrderedDelivery(t *testing.T) {
+	h := startHandler(t, "", 6042, func(h *Handler) {
+		h.HistorySize = 0
+	})
+	defer h.Stop()
+
+	seqEncoder := func(m Message) []byte {
+		if m.Kind != KindChat {
+			return nil
+		}
+		return []byte(fmt.Sprintf("%d %s\n", m.Seq, m.Message))
+	}
+	names := []string{"alice", "bob", "carol"}
+	conns := make([]net.Conn, len(names))
+	readers := make([]*bufio.Reader, len(names))
+	for i, name := range names {
+		server, client := net.Pipe()
+		defer client.Close()
+		if err := h.Connect(server, name, SourceWebSocket, seqEncoder); err != nil {
+			t.Fatal(err)
+		}
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		conns[i], readers[i] = server, bufio.NewReader(client)
+	}
+
+	for i := 0; h.LastSeq(DefaultRoom) < uint64(len(names)) && i < 1000; i++ {
+		// wait for the join messages, so that they don't interrupt the numbering of the chat messages
+		time.Sleep(time.Millisecond)
+	}
+
+	// all clients talk at once, but every client receives the messages in the same order, numbered without gaps
+	count := 20
+	transcripts := make([][]string, len(names))
+	wg := sync.WaitGroup{}
+	for i := range names {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				h.Send(conns[i], Message{Message: fmt.Sprintf("%s %d", names[i], j)})
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < count*len(names); j++ {
+				line, err := readers[i].ReadString('\n')
+				if err != nil {
+					t.Errorf("%s: failed to read message %d -> %s", names[i], j, err)
+					return
+				}
+				transcripts[i] = append(transcripts[i], strings.TrimSpace(line))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	first := h.LastSeq(DefaultRoom) - uint64(count*len(names)) + 1
+	for i, line := range transcripts[0] {
+		if !strings.HasPrefix(line, fmt.Sprintf("%d ", first+uint64(i))) {
+			t.Errorf("expected message %d to have sequence number %d, got %q", i, first+uint64(i), line)
+			break
+		}
+	}
+	for i := range names[1:] {
+		if !reflect.DeepEqual(transcripts[0], transcripts[i+1]) {
+			t.Errorf("expected %s to receive the messages in the same order as %s", names[i+1], names[0])
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package tcp
+
+import (
+	"sort"
+	"sync"
+)
+
+// DefaultMemoryStoreLimit is the number of messages kept by the MemoryStore that is used when no Store is configured
+const DefaultMemoryStoreLimit = 10000
+
+// Store persists every message that is broadcast by a Handler. It is the single source of truth for message history.
+type Store interface {
+	// Append will assign m a unique ID, which is greater than the ID of every previously appended message, and
+	// persist it. The stored message is returned.
+	Append(m Message) (Message, error)
+
+	// Query will return the stored messages that match q, ordered by ID (oldest first)
+	Query(q Query) ([]Message, error)
+
+	// Close will release all resources held by the Store
+	Close() error
+}
+
+// Query selects messages from a Store
+type Query struct {
+	After   uint64 // only return messages with an ID greater than After
+	Before  uint64 // only return messages with an ID less than Before (0 for no limit)
+	Limit   int    // the maximum number of messages to return (0 for no limit)
+	Oldest  bool   // return the oldest instead of the newest matching messages when more than Limit match
+	Private bool   // include private messages, which are otherwise excluded
+	Room    string // only return messages of Room ("" for all rooms)
+}
+
+// Matches reports whether m is selected by q, not taking q.Limit into account
+func (q Query) Matches(m Message) bool {
+	if m.ID <= q.After || (q.Before != 0 && m.ID >= q.Before) {
+		return false
+	}
+	if m.Recipient != "" {
+		return q.Private
+	}
+	return q.Room == "" || q.Room == m.Room
+}
+
+// MemoryStore is a Store that keeps messages in memory. All messages are lost when the process exits.
+type MemoryStore struct {
+	limit    int
+	messages []Message
+	mutex    sync.RWMutex
+	nextID   uint64
+}
+
+// NewMemoryStore will create a MemoryStore that holds at most limit messages. The oldest messages are discarded once
+// the limit is reached. A limit <= 0 means that messages are never discarded.
+func NewMemoryStore(limit int) *MemoryStore {
+	return &MemoryStore{limit: limit, nextID: 1}
+}
+
+// Append implements Store
+func (s *MemoryStore) Append(m Message) (Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m.ID = s.nextID
+	s.nextID++
+	s.messages = append(s.messages, m)
+	if s.limit > 0 && len(s.messages) > s.limit {
+		// copy the retained messages so the discarded ones can be garbage collected
+		s.messages = append([]Message(nil), s.messages[len(s.messages)-s.limit:]...)
+	}
+	return m, nil
+}
+
+// Query implements Store
+func (s *MemoryStore) Query(q Query) ([]Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// messages are ordered by ID, so the first candidate can be found using a binary search
+	start := sort.Search(len(s.messages), func(i int) bool {
+		return s.messages[i].ID > q.After
+	})
+	end := len(s.messages)
+	if q.Before != 0 {
+		end = sort.Search(len(s.messages), func(i int) bool {
+			return s.messages[i].ID >= q.Before
+		})
+	}
+
+	var result []Message
+	if !q.Oldest {
+		for i := end - 1; i >= start && (q.Limit <= 0 || len(result) < q.Limit); i-- {
+			if q.Matches(s.messages[i]) {
+				result = append(result, s.messages[i])
+			}
+		}
+		reverse(result)
+	} else {
+		for i := start; i < end && (q.Limit <= 0 || len(result) < q.Limit); i++ {
+			if q.Matches(s.messages[i]) {
+				result = append(result, s.messages[i])
+			}
+		}
+	}
+	return result, nil
+}
+
+// Close implements Store
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// reverse will reverse the order of messages in place
+func reverse(messages []Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
@@ -0,0 +1,188 @@
+package tcp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore(0))
+}
+
+func TestMemoryStore_Limit(t *testing.T) {
+	s := NewMemoryStore(2)
+	for _, text := range []string{"one", "two", "three"} {
+		s.Append(Message{Message: text, Room: "lobby"})
+	}
+
+	messages, _ := s.Query(Query{})
+	if actual := messageIDs(messages); !reflect.DeepEqual(actual, []uint64{2, 3}) {
+		t.Errorf("expected IDs (%v) differed from actual IDs (%v)", []uint64{2, 3}, actual)
+	}
+}
+
+func TestLogStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a tiny segment size forces the log to be split over many segments
+	s, err := OpenLogStore(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+	if len(s.segments) < 2 {
+		t.Errorf("expected messages to be split over multiple segments, got %d segment(s)", len(s.segments))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopening the store finds all messages, and the next ID continues where it left off
+	s, err = OpenLogStore(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := s.Query(Query{Private: true})
+	if len(messages) != 7 {
+		t.Errorf("expected 7 messages after reopening the store, got %d", len(messages))
+	}
+	m, _ := s.Append(Message{Message: "after reopen", Room: "lobby"})
+	if m.ID != 8 {
+		t.Errorf("expected ID (%d) differed from actual ID (%d)", 8, m.ID)
+	}
+
+	// the room index is rebuilt from the log and kept up to date
+	messages, _ = s.Query(Query{Room: "lobby"})
+	if actual := messageIDs(messages); !reflect.DeepEqual(actual, []uint64{1, 3, 5, 7, 8}) {
+		t.Errorf("expected IDs (%v) differed from actual IDs (%v)", []uint64{1, 3, 5, 7, 8}, actual)
+	}
+	s.Close()
+}
+
+func TestLogStore_Recover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenLogStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"one", "two", "three"} {
+		s.Append(Message{Message: text, Room: "lobby"})
+	}
+	s.Close()
+
+	// simulate a crash that lost the end of the index and left a partially written record behind
+	name := filepath.Join(dir, "00000000000000000001")
+	if err := os.Truncate(name+indexExtension, indexEntrySize); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(name+segmentExtension, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"id":4,"message":"fo`))
+	f.Close()
+
+	s, err = OpenLogStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	messages, err := s.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := messageIDs(messages); !reflect.DeepEqual(actual, []uint64{1, 2, 3}) {
+		t.Errorf("expected IDs (%v) differed from actual IDs (%v)", []uint64{1, 2, 3}, actual)
+	}
+
+	m, err := s.Append(Message{Message: "four", Room: "lobby"})
+	if err != nil || m.ID != 4 {
+		t.Errorf("failed to append after recovery, got ID %d -> %v", m.ID, err)
+	}
+	if messages, _ := s.Query(Query{After: 3, Oldest: true}); len(messages) != 1 || messages[0].Message != "four" {
+		t.Errorf("expected to read back the appended message, got %#v", messages)
+	}
+
+	// the remains of a failed write are discarded before the next message is appended
+	seg := s.segments[len(s.segments)-1]
+	seg.file.Write([]byte(`{"id":5,"mess`))
+	seg.index.Write([]byte{0, 0})
+	seg.truncate()
+	s.Append(Message{Message: "five", Room: "lobby"})
+	if messages, err := s.Query(Query{After: 4, Room: "lobby"}); err != nil || len(messages) != 1 || messages[0].Message != "five" {
+		t.Errorf("expected to read back the message appended after a failed write, got %#v -> %v", messages, err)
+	}
+}
+
+// testStore will run the tests that every Store implementation must pass against the empty store s
+func testStore(t *testing.T, s Store) {
+	now := time.Now().Round(0)
+	for _, m := range []Message{
+		{Message: "one", Room: "lobby", Sender: "alice", Time: now},
+		{Message: "two", Room: "ops", Sender: "alice", Time: now},
+		{Message: "three", Room: "lobby", Sender: "bob", Time: now},
+		{Message: "secret", Recipient: "bob", Sender: "alice", Time: now},
+		{Message: "four", Room: "lobby", Sender: "carol", Time: now},
+		{Message: "five", Room: "ops", Sender: "bob", Time: now},
+		{Message: "six", Room: "lobby", Sender: "alice", Time: now},
+	} {
+		stored, err := s.Append(m)
+		if err != nil {
+			t.Fatalf("failed to append message -> %s", err)
+		}
+		m.ID = stored.ID
+		if !reflect.DeepEqual(stored, m) {
+			t.Errorf("expected stored message (%#v) differed from actual stored message (%#v)", m, stored)
+		}
+	}
+
+	testCases := map[string]struct {
+		q    Query
+		eIDs []uint64
+	}{
+		"everything public": {Query{}, []uint64{1, 2, 3, 5, 6, 7}},
+		"with private":      {Query{Private: true}, []uint64{1, 2, 3, 4, 5, 6, 7}},
+		"room":              {Query{Room: "lobby"}, []uint64{1, 3, 5, 7}},
+		"newest":            {Query{Limit: 2, Room: "lobby"}, []uint64{5, 7}},
+		"after":             {Query{After: 1, Limit: 2, Room: "lobby"}, []uint64{5, 7}},
+		"oldest after":      {Query{After: 1, Limit: 2, Oldest: true, Room: "lobby"}, []uint64{3, 5}},
+		"room before":       {Query{Before: 7, Room: "lobby"}, []uint64{1, 3, 5}},
+		"oldest":            {Query{Limit: 2, Oldest: true}, []uint64{1, 2}},
+		"before":            {Query{Before: 5, Limit: 1}, []uint64{3}},
+		"after and before":  {Query{After: 1, Before: 6}, []uint64{2, 3, 5}},
+		"unknown room":      {Query{Room: "dev"}, nil},
+		"after the end":     {Query{After: 100}, nil},
+	}
+
+	for k, v := range testCases {
+		messages, err := s.Query(v.q)
+		if err != nil {
+			t.Errorf("%s: failed to query messages -> %s", k, err)
+		}
+		if actual := messageIDs(messages); !reflect.DeepEqual(actual, v.eIDs) {
+			t.Errorf("%s: expected IDs (%v) differed from actual IDs (%v)", k, v.eIDs, actual)
+		}
+	}
+}
+
+// messageIDs will return the IDs of messages
+func messageIDs(messages []Message) []uint64 {
+	var ids []uint64
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
@@ -0,0 +1,50 @@
+package tcp
+
+// Subscription receives every message that is broadcast by a Handler, in the order the messages were stored
+type Subscription struct {
+	C       <-chan Message // receives the messages, closed when the subscription ends
+	c       chan Message
+	handler *Handler
+}
+
+// Subscribe will create a Subscription that buffers up to size messages. A subscriber that falls further behind than
+// size messages is unsubscribed (C is closed), so a slow subscriber can never hold up the delivery of messages. It
+// can catch up on missed messages using the Store.
+func (h *Handler) Subscribe(size int) *Subscription {
+	c := make(chan Message, size)
+	s := &Subscription{C: c, c: c, handler: h}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.subscriptions[s] = struct{}{}
+	return s
+}
+
+// Close will end s. It is safe to call Close more than once.
+func (s *Subscription) Close() {
+	s.handler.mutex.Lock()
+	defer s.handler.mutex.Unlock()
+	s.handler.unsubscribe(s)
+}
+
+// unsubscribe will remove s from h and close its channel. The caller must hold h.mutex.
+func (h *Handler) unsubscribe(s *Subscription) {
+	if _, ok := h.subscriptions[s]; ok {
+		delete(h.subscriptions, s)
+		close(s.c)
+	}
+}
+
+// publishMessage will send message to every Subscription
+func (h *Handler) publishMessage(message Message) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for s := range h.subscriptions {
+		select {
+		case s.c <- message:
+		default:
+			h.logger.WithField("buffer", cap(s.c)).Warn("subscriber fell behind and was unsubscribed")
+			h.unsubscribe(s)
+		}
+	}
+}
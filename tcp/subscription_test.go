@@ -0,0 +1,40 @@
+package tcp
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestHandler_Subscribe(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	h := New("", 6000, logger)
+
+	slow := h.Subscribe(1)
+	fast := h.Subscribe(2)
+	h.publishMessage(Message{ID: 1, Message: "one"})
+	h.publishMessage(Message{ID: 2, Message: "two"})
+
+	// the slow subscriber receives what fit into its buffer and is then unsubscribed
+	if m := <-slow.C; m.ID != 1 {
+		t.Errorf("expected message 1, got %#v", m)
+	}
+	if m, ok := <-slow.C; ok {
+		t.Errorf("expected subscription to be closed after falling behind, got %#v", m)
+	}
+
+	for _, id := range []uint64{1, 2} {
+		if m := <-fast.C; m.ID != id {
+			t.Errorf("expected message %d, got %#v", id, m)
+		}
+	}
+
+	fast.Close()
+	fast.Close()
+	if _, ok := <-fast.C; ok {
+		t.Errorf("expected subscription to be closed")
+	}
+	if len(h.subscriptions) != 0 {
+		t.Errorf("expected all subscriptions to be removed, %d remain", len(h.subscriptions))
+	}
+}
@@ -1,58 +1,216 @@
 package tcp
 
 import (
+	"context"
+	"crypto/tls"
 	"github.com/sirupsen/logrus"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
 	"time"
 	"sync"
 	"github.com/Pallinder/go-randomdata"
 	"bufio"
+	"unicode/utf8"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
-// Message is to be broadcasted to clients
+// DefaultRoom is the room that every client is placed into when it connects
+const DefaultRoom = "lobby"
+
+// MaxNickLength is the maximum number of characters allowed in a nickname
+const MaxNickLength = 32
+
+// Sources that a Message can originate from
+const (
+	SourceHTTP      = "http"
+	SourceIRC       = "irc"
+	SourceSSH       = "ssh"
+	SourceTCP       = "tcp"
+	SourceWebSocket = "websocket"
+)
+
+// ErrNickInUse is returned when a client tries to use a name that belongs to another connected client
+var ErrNickInUse = errors.New("name is already in use")
+
+// ErrNoColor is returned by SetColor for clients that aren't connected through a terminal
+var ErrNoColor = errors.New("colors are only supported by telnet and SSH clients")
+
+// MaxTopicLength is the maximum number of characters allowed in the topic of a room
+const MaxTopicLength = 300
+
+// Kinds of messages. Every message that is broadcast has a Kind, messages sent by clients are chat, action or private
+// messages, the others describe events.
+const (
+	KindAction  = "action"  // Sender performed the action described by Message (/me)
+	KindChat    = "chat"    // Sender said Message in Room
+	KindJoin    = "join"    // Sender joined Room
+	KindNick    = "nick"    // Sender changed their name to Message
+	KindPart    = "part"    // Sender left Room
+	KindPrivate = "private" // Sender said Message to Recipient only, Action is set for private actions
+	KindQuit    = "quit"    // Sender disconnected, Message is the optional quit message
+	KindSystem  = "system"  // a notice from the server to a single client, e.g. the reply to a command
+	KindTopic   = "topic"   // Sender changed the topic of Room to Message
+)
+
+// MaxMetaEntries is the maximum number of entries in the metadata of a message
+const MaxMetaEntries = 16
+
+// Message is to be broadcasted to clients. How a message is displayed is up to the Encoder of each client, see Render.
 type Message struct {
+	ID uint64 `json:"id,omitempty"` // a unique identifier assigned by the Store, IDs increase with every message
+	Action bool `json:"action,omitempty"` // indicates that Message describes an action performed by Sender (/me)
+	Kind string `json:"kind,omitempty"` // the kind of the message, e.g. KindChat or KindJoin
 	Message string `json:"message"`
+	Meta map[string]string `json:"meta,omitempty"` // arbitrary metadata provided by the sender, e.g. a build number
+	Recipient string `json:"recipient,omitempty"` // the name of the only client to deliver to, Room is ignored when set
+	Replay bool `json:"replay,omitempty"` // indicates that the message is replayed from the history of Room
+	Room string `json:"room,omitempty"`
 	Sender string `json:"sender"`
+	Seq uint64 `json:"seq,omitempty"` // the position of the message within Room, counting from 1 (0 for private messages)
+	Source string `json:"source,omitempty"` // the transport that the message was received from, e.g. SourceHTTP
+	Time time.Time `json:"time"` // the time that the message was received by the server
 }
 
-// String converts m into a message that can be displayed to a user
-func (m *Message) String() string {
-	if !strings.HasSuffix(m.Message, "\r\n") {
-		m.Message += "\r\n"
+// IsEvent reports whether m describes an event (such as a join) rather than something that was said
+func (m *Message) IsEvent() bool {
+	switch m.Kind {
+	case KindJoin, KindNick, KindPart, KindQuit, KindTopic:
+		return true
 	}
-	return fmt.Sprintf("%v %s: %s", time.Now().Format("15:04:05"), m.Sender, m.Message)
+	return false
+}
+
+// chatKind returns the Kind of a message sent by a client, which depends on its Recipient and Action
+func chatKind(m Message) string {
+	if m.Recipient != "" {
+		return KindPrivate
+	} else if m.Action {
+		return KindAction
+	}
+	return KindChat
+}
+
+// ValidateMeta will return an error if meta can't be attached to a message
+func ValidateMeta(meta map[string]string) error {
+	if len(meta) > MaxMetaEntries {
+		return fmt.Errorf("metadata can't have more than %d entries", MaxMetaEntries)
+	}
+	for k, v := range meta {
+		if k == "" || utf8.RuneCountInString(k) > 64 {
+			return fmt.Errorf("invalid metadata key %q: must be between 1 and 64 characters", k)
+		} else if utf8.RuneCountInString(v) > 1024 {
+			return fmt.Errorf("invalid metadata value of %s: must be at most 1024 characters", k)
+		}
+	}
+	return nil
+}
+
+// client holds the state of a single connected client
+type client struct {
+	account    string       // the name of the account that the client is logged into, "" for guests
+	bucket     *tokenBucket // limits how fast the client may send messages, see Handler.FloodControl
+	color      bool         // messages are rendered using ANSI colors instead of encode, see SetColor
+	encode     Encoder      // converts messages into the bytes written to the client's connection
+	floodMutes int          // the number of times the client was muted for flooding
+	lastStrike time.Time    // the last time the client was throttled
+	name       string
+	queue      *outQueue       // the messages waiting to be written to the client
+	quit       string          // an optional message provided by the client when it used /quit
+	room       string          // the room that chat text typed by the client is sent to
+	rooms      map[string]bool // all rooms the client is a member of
+	source     string          // the transport that the client is connected through, e.g. SourceTCP
+	strikes    int             // the number of times the client was throttled since it was last muted for flooding
 }
 
 // Handler contains options for a net.Listener as well as a way to handle all new connections that are accepted
 type Handler struct {
+	accounts			sync.Mutex // held while an account is created or changed, so that h.Users isn't written under h.mutex
+	AccountsOnly		bool // only accept clients that log into a registered account, guests are turned away
 	address 			string
-	clients         	map[net.Conn]string
+	Admins				[]string // the names of the accounts that always have RoleAdmin
+	Bans				*BanList // checked whenever a client connects
+	clients         	map[net.Conn]*client
+	commands			map[string]*Command
+	connections			map[string]int // the number of TCP connections of each remote IP address
 	deadConnections 	chan net.Conn
 	done				chan struct{}
+	FloodControl		FloodControl // limits how fast clients may send messages and commands, disabled by default
+	floodStats			FloodStats
+	HistorySize			int // the number of recent messages per room that are replayed to clients joining the room
+	IdleTimeout			time.Duration // TCP and SSH clients that don't send anything for this long are disconnected, 0 for no limit
+	KeepAlive			time.Duration // the TCP keepalive period of accepted connections, negative to disable keepalive
+	listening			chan struct{} // closed once Start() accepts connections
 	logger 				*logrus.Logger
+	MaxConnections		int // the maximum number of connections to all listeners, 0 for no limit
+	MaxConnectionsPerIP	int // the maximum number of connections to all listeners from a single IP address, 0 for no limit
+	MaxLineLength		int // the maximum length in bytes of a line sent by any client, 0 for no limit
 	messages        	chan Message
+	mutes				map[string]time.Time // the lower case names of muted clients and when their mute expires (zero for never)
 	mutex           	*sync.RWMutex
+	NameTimeout			time.Duration // the time a TCP client may take to choose its name (and log in), or an SSH session to start its shell, 0 for no limit
 	newConnections 		chan net.Conn
+	NickLength			int // the maximum number of characters of a nickname, at most MaxNickLength
+	numConnections		int // the number of TCP connections
+	OverflowPolicy		string // what to do when the outbound queue of a client is full, e.g. OverflowDropOldest
+	PingInterval		time.Duration // telnet clients that don't send anything for this long are probed, 0 to disable probes
+	PingTimeout			time.Duration // the time a telnet client may take to answer a probe before it is disconnected
 	port 				int
+	QueueSize			int // the number of messages that can be queued for a client that isn't reading fast enough
 	Ready				bool // Indicates that the http listener is ready to accept connections
+	SanitizePolicy		string // what to do with control characters in the text sent by clients, e.g. SanitizeEscape
+	seqs				map[string]uint64 // the last sequence number assigned in each room
+	sequencer			sync.Mutex // held while a message is ingested, so that messages are delivered one at a time
+	Store				Store // persists every message that is broadcast
+	subscriptions		map[*Subscription]struct{}
+	Telnet				bool // negotiate character mode, window size and terminal type with telnet clients
+	topics				map[string]string // the topic of each room that has one
 	startDone	   		func() // a callback that can be defined to do something once Start() has done all its work
+	TLSConfig			*tls.Config // only accept TLS connections when set
+	Users				UserStore // the accounts of registered users
+	WriteTimeout		time.Duration // the time a write to a client may take before the client is disconnected, 0 for no limit
 }
 
 // New will create a new Handler for starting a new TCP listener
 func New(address string, port int, logger *logrus.Logger) *Handler {
-	return &Handler{
+	h := &Handler{
 		address:			address,
-		clients:         	make(map[net.Conn]string),
+		Bans:				NewBanList(),
+		clients:         	make(map[net.Conn]*client),
+		commands:			make(map[string]*Command),
+		connections:		make(map[string]int),
 		deadConnections: 	make(chan net.Conn, 1),
 		done:				make(chan struct{}),
+		KeepAlive:			DefaultKeepAlive,
+		listening:			make(chan struct{}),
 		logger:      		logger,
+		MaxConnections:		DefaultMaxConnections,
+		MaxConnectionsPerIP:	DefaultMaxConnectionsPerIP,
+		MaxLineLength:		DefaultMaxLineLength,
 		messages:        	make(chan Message, 1),
+		mutes:				make(map[string]time.Time),
 		mutex:           	&sync.RWMutex{},
+		NameTimeout:		DefaultNameTimeout,
 		newConnections: 	make(chan net.Conn, 1),
+		NickLength:			MaxNickLength,
+		OverflowPolicy:		OverflowDropOldest,
+		PingInterval:		DefaultPingInterval,
+		PingTimeout:		DefaultPingTimeout,
 		port:				port,
+		QueueSize:			DefaultQueueSize,
+		SanitizePolicy:		SanitizeEscape,
+		seqs:				make(map[string]uint64),
+		Store:				NewMemoryStore(DefaultMemoryStoreLimit),
+		subscriptions:		make(map[*Subscription]struct{}),
+		topics:				make(map[string]string),
+		Users:				NewMemoryUserStore(),
+		WriteTimeout:		DefaultWriteTimeout,
 	}
+
+	h.registerDefaultCommands()
+	return h
 }
 
 // Start starts the TCP listener and accepts incoming connections indefinitely until Stop() is called
@@ -62,25 +220,43 @@ func (h *Handler) Start() error {
 		close(h.done)
 	}()
 
-	// Start the TCP listener
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", h.address, h.port))
+	// Start the TCP listener, TCP keepalive detects clients whose connection went away without being closed
+	lc := net.ListenConfig{KeepAlive: h.KeepAlive}
+	listener, err := lc.Listen(context.Background(), "tcp", fmt.Sprintf("%s:%d", h.address, h.port))
 	if err != nil {
 		return err
 	}
+	if h.TLSConfig != nil {
+		listener = tls.NewListener(listener, h.TLSConfig)
+	}
 
+	stopping := make(chan struct{})
 	go func() {
 		for {
 			conn, err := listener.Accept()
 			if err != nil {
+				select {
+				case <-stopping:
+					return
+				default:
+				}
 				h.logger.WithField("error", err).Error("error accepting connection")
-			} else {
-				h.newConnections <- conn
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			select {
+			case h.newConnections <- conn:
+			case <-stopping:
+				conn.Close()
+				return
 			}
 		}
 	}()
 	h.Ready = true
+	close(h.listening)
 	h.logger.WithFields(logrus.Fields{
 		"address": listener.Addr(),
+		"tls": h.TLSConfig != nil,
 	}).Info("TCP listener accepting connections")
 
 	if h.startDone != nil {
@@ -95,7 +271,7 @@ func (h *Handler) Start() error {
 
 		// Accept messages from connected clients
 		case message := <-h.messages:
-			go h.broadcastMessage(message, h.deadConnections)
+			h.ingest(message)
 
 		// Remove dead clients
 		case conn := <-h.deadConnections:
@@ -103,6 +279,12 @@ func (h *Handler) Start() error {
 
 		case <-h.done:
 			h.logger.Info("stopping TCP listener...")
+			h.mutex.Lock()
+			for s := range h.subscriptions {
+				h.unsubscribe(s)
+			}
+			h.mutex.Unlock()
+			close(stopping)
 			err := listener.Close()
 			if err != nil {
 				return err
@@ -112,6 +294,12 @@ func (h *Handler) Start() error {
 	}
 }
 
+// Listening returns a channel that is closed once the TCP listener accepts connections. Unlike h.Ready it can be used
+// by other goroutines than the one running Start().
+func (h *Handler) Listening() <-chan struct{} {
+	return h.listening
+}
+
 // Stop will shutdown the TCP listener
 func (h *Handler) Stop() {
 	for {
@@ -127,48 +315,172 @@ func (h *Handler) Stop() {
 	}
 }
 
-// addClient will place the connection/name (key/value) pair into c.clients
-func (h *Handler) addClient(key net.Conn, value string) {
+// addClient will place the connection/name (key/value) pair into c.clients. account is the name of the account that
+// the client has logged into ("" for guests). ErrNickInUse is returned if another client is already using the name and
+// a *BannedError if the client is banned.
+func (h *Handler) addClient(key net.Conn, value string, account string, source string, encode Encoder) error {
+	if err := h.checkName(value, account); err != nil {
+		return err
+	} else if err := h.CheckBan(value, account, remoteIP(key)); err != nil {
+		return err
+	}
+
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
-	h.clients[key] = value
+	if conn := h.lookupClient(value); conn != nil {
+		return ErrNickInUse
+	}
+	// terminals that support colors receive colored messages until the client turns them off
+	color := false
+	if t, ok := key.(TerminalTyper); ok && (source == SourceTCP || source == SourceSSH) {
+		color = SupportsColor(t.TerminalType())
+	}
+	q := newOutQueue(key, h.QueueSize)
+	h.clients[key] = &client{account: account, color: color, encode: encode, name: value, queue: q, rooms: make(map[string]bool), source: source}
+	go q.run(h.WriteTimeout, h.logger)
+	return nil
 }
 
-// broadcastMessage will send message to all clients within c
-func (h *Handler) broadcastMessage(message Message, deadConnections chan net.Conn) {
-	wg := sync.WaitGroup{}
-	for conn := range h.iterateClients() {
-		wg.Add(1)
-		go func(conn net.Conn, message Message) {
-			defer wg.Done()
-			_, err := conn.Write([]byte(message.String()))
-			if err != nil {
-				deadConnections <- conn
-			}
-
+// broadcastMessage will send message to all clients that are members of message.Room, or only to the recipient
+// (and sender) of a private message
+func (h *Handler) broadcastMessage(message Message) {
+	var members []net.Conn
+	if message.Recipient != "" {
+		recipient := h.findClient(message.Recipient)
+		if recipient == nil {
 			h.logger.WithFields(logrus.Fields{
-				"message":  message.Message,
-				"receiver": h.getClientName(conn),
-				"sender":   message.Sender,
-			}).Debug("sent message")
-		}(conn, message)
+				"recipient": message.Recipient,
+				"sender":    message.Sender,
+			}).Warn("recipient of private message is not online")
+			return
+		}
+		message.Recipient = h.getClientName(recipient)
+		members = append(members, recipient)
+
+		// echo the message back to the sender, unless it was sent by an HTTP client using a connected client's name
+		if sender := h.findClient(message.Sender); sender != nil && sender != recipient && message.Source != SourceHTTP {
+			members = append(members, sender)
+		}
+	} else {
+		members = h.roomMembers(message.Room)
+	}
+
+	// delivering only queues the message for each client, so a slow client can't hold up the others. Clients that
+	// can't keep up are disconnected by their writer goroutine.
+	for _, conn := range members {
+		err := h.deliver(conn, message)
+		h.logger.WithFields(logrus.Fields{
+			"error":    err,
+			"message":  message.Message,
+			"receiver": h.getClientName(conn),
+			"room":     message.Room,
+			"sender":   message.Sender,
+		}).Debug("queued message")
 	}
 
-	wg.Wait()
 	h.logger.WithFields(logrus.Fields{
 		"message":    message.Message,
-		"numClients": h.numClients(),
+		"numClients": len(members),
+		"recipient":  message.Recipient,
+		"room":       message.Room,
 		"sender":     message.Sender,
-	}).Info("sent message to all clients")
+	}).Info("sent message to all clients in room")
+}
+
+// Connect will register conn as a guest named name, which is connected through a transport (source) other than the
+// TCP listener. Messages for the client are encoded using encode and written to conn. The caller is responsible for
+// passing the client's input to Input or Send and for calling Disconnect once the client is gone. If an error is
+// returned (e.g. ErrNickInUse, ErrNickReserved, ErrAccountRequired or a *BannedError) the client was not connected.
+func (h *Handler) Connect(conn net.Conn, name string, source string, encode Encoder) error {
+	return h.connect(conn, name, "", source, encode)
+}
+
+// ConnectAccount is the same as Connect, but the client is logged into the account named name. The caller must have
+// verified the client's credentials using Authenticate.
+func (h *Handler) ConnectAccount(conn net.Conn, name string, source string, encode Encoder) error {
+	return h.connect(conn, name, name, source, encode)
+}
+
+// connect will register conn as a client that is logged into account ("" for guests) and start its session
+func (h *Handler) connect(conn net.Conn, name string, account string, source string, encode Encoder) error {
+	if err := ValidateNick(name); err != nil {
+		return err
+	} else if err := h.addClient(conn, name, account, source, encode); err != nil {
+		return err
+	} else if err := h.startSession(conn); err != nil {
+		h.Disconnect(conn)
+		return err
+	}
+	return nil
 }
 
-// deleteClient will delete the specified key from c.clients
+// deleteClient will delete the specified key from c.clients and stop its writer goroutine
 func (h *Handler) deleteClient(key net.Conn) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
+	if val, ok := h.clients[key]; ok {
+		val.queue.close(true)
+	}
 	delete(h.clients, key)
 }
 
+// deliver will encode message for the client conn and queue it for writing to conn. Connections that don't belong to
+// a client (yet) are written to directly.
+func (h *Handler) deliver(conn net.Conn, message Message) error {
+	h.mutex.RLock()
+	encode := Encoder(TextEncoder)
+	var q *outQueue
+	if val, ok := h.clients[conn]; ok {
+		if val.color {
+			name := val.name
+			encode = func(m Message) []byte {
+				return []byte(RenderColor(m, name))
+			}
+		} else if val.encode != nil {
+			encode = val.encode
+		}
+		q = val.queue
+	}
+	h.mutex.RUnlock()
+
+	b := encode(message)
+	if len(b) == 0 {
+		// the encoder chose not to display the message to this client
+		return nil
+	} else if q != nil {
+		return h.enqueue(conn, q, b)
+	}
+	_, err := conn.Write(b)
+	return err
+}
+
+// Disconnect will remove the client conn that was registered using Connect and close conn
+func (h *Handler) Disconnect(conn net.Conn) {
+	h.deadConnections <- conn
+}
+
+// findClient will return the connection of the client named name (compared with nameKey) or nil if there is none
+func (h *Handler) findClient(name string) net.Conn {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.lookupClient(name)
+}
+
+// lookupClient is the same as findClient, but requires the caller to hold h.mutex
+func (h *Handler) lookupClient(name string) net.Conn {
+	for conn, c := range h.clients {
+		if nameKey(c.name) == nameKey(name) {
+			return conn
+		}
+	}
+	return nil
+}
+
+// IsOnline will return true if a client named name (case-insensitive) is currently connected
+func (h *Handler) IsOnline(name string) bool {
+	return h.findClient(name) != nil
+}
+
 // getClientName will retrieve the name corresponding to specifed client within c.clients or "" if client doesn't exist
 func (h *Handler) getClientName(client net.Conn) string {
 	h.mutex.RLock()
@@ -177,59 +489,272 @@ func (h *Handler) getClientName(client net.Conn) string {
 	if !ok {
 		return ""
 	}
-	return val
+	return val.name
+}
+
+// getClientQuitMessage will retrieve the message that the specified client provided to /quit
+func (h *Handler) getClientQuitMessage(client net.Conn) string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	val, ok := h.clients[client]
+	if !ok {
+		return ""
+	}
+	return val.quit
+}
+
+// getClientSource will retrieve the transport that the specified client is connected through
+func (h *Handler) getClientSource(client net.Conn) string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	val, ok := h.clients[client]
+	if !ok {
+		return ""
+	}
+	return val.source
+}
+
+// getClientRoom will retrieve the current room of the specified client or "" if client doesn't exist
+func (h *Handler) getClientRoom(client net.Conn) string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	val, ok := h.clients[client]
+	if !ok {
+		return ""
+	}
+	return val.room
+}
+
+// getClientRooms will retrieve the sorted names of all rooms that the specified client is a member of
+func (h *Handler) getClientRooms(client net.Conn) []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	val, ok := h.clients[client]
+	if !ok {
+		return nil
+	}
+
+	rooms := make([]string, 0, len(val.rooms))
+	for r := range val.rooms {
+		rooms = append(rooms, r)
+	}
+	sort.Strings(rooms)
+	return rooms
 }
 
 // handleConnect will add conn into c and setup a reader to allow conn to send messages (broadcast to clients)
 func (h *Handler) handleConnect(conn net.Conn, messages chan Message, deadConnections chan net.Conn) {
-	name := randomdata.SillyName()
-	_, err := conn.Write([]byte(fmt.Sprintf("Enter your name (default: %v)\r\n", name)))
-	if err != nil {
+	tlsConn, _ := conn.(*tls.Conn)
+	telnet := newTelnetConn(conn)
+	conn = telnet
+
+	// the name timeout starts when the client connects, so that a client that never completes the TLS handshake or
+	// the telnet negotiation can't hold on to its connection
+	if h.NameTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(h.NameTimeout))
+	}
+
+	// banned networks and clients over the connection limits are turned away before they are prompted for anything
+	if err := h.Admit(conn); err != nil {
+		h.logger.WithFields(logrus.Fields{
+			"address.remote": conn.RemoteAddr(),
+			"error":          err,
+		}).Warn("rejected connection over the connection limit")
+		conn.Write([]byte(err.Error() + "\r\n"))
 		deadConnections <- conn
 		return
 	}
-
-	reader := bufio.NewReader(conn)
-	incoming, err := reader.ReadString('\n')
-	if err != nil {
+	defer h.Release(conn)
+	if err := h.CheckBan("", "", remoteIP(conn)); err != nil {
+		h.logger.WithField("address.remote", conn.RemoteAddr()).Warn("rejected banned connection")
+		conn.Write([]byte(err.Error() + "\r\n"))
 		deadConnections <- conn
 		return
 	}
+	if tlsConn != nil {
+		if err := tlsConn.Handshake(); err != nil {
+			h.logger.WithFields(logrus.Fields{
+				"address.remote": conn.RemoteAddr(),
+				"error":          err,
+			}).Debug("tls handshake failed")
+			deadConnections <- conn
+			return
+		}
+	}
+	if h.Telnet {
+		// clients that switch to character mode get a line editor, which keeps the input line intact below the
+		// incoming messages
+		if err := telnet.negotiate(); err != nil {
+			deadConnections <- conn
+			return
+		}
+		if err := telnet.settle(negotiationTimeout); err != nil {
+			deadConnections <- conn
+			return
+		}
+		if telnet.Terminal().CharacterMode {
+			telnet.startEditor(h.completeNick)
+		}
+	}
+	conn.SetWriteDeadline(time.Time{})
+	if h.NameTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(h.NameTimeout))
+	}
 
-	incoming = strings.Replace(incoming, "\n", "", -1)
-	incoming = strings.Replace(incoming, "\r", "", -1)
-	if incoming != "" {
-		name = incoming
+	reader := bufio.NewReader(conn)
+	readLine := func(secret bool) (string, error) {
+		if telnet.editor == nil {
+			return ReadLimitedLine(reader, h.MaxLineLength)
+		}
+		var line string
+		var err error
+		if secret {
+			// passwords are neither echoed nor added to the input history
+			line, err = telnet.editor.ReadPassword(editorPrompt)
+		} else {
+			line, err = telnet.editor.ReadLine()
+			line = telnet.secret.Reveal(line)
+		}
+		if err == terminal.ErrPasteIndicator {
+			err = nil
+		}
+		return line, err
+	}
+	prompt := func(text string, secret bool) (string, error) {
+		if _, err := conn.Write([]byte(text + "\r\n")); err != nil {
+			return "", err
+		}
+		incoming, err := readLine(secret)
+		if isTimeout(err) {
+			h.logger.WithField("address.remote", conn.RemoteAddr()).Warn("client didn't choose a name in time")
+			conn.Write([]byte("Timed out waiting for your name\r\n"))
+			return "", err
+		} else if err == ErrLineTooLong {
+			h.LineTooLong(conn)
+			return "", err
+		} else if err != nil {
+			return "", err
+		}
+		incoming = strings.Replace(incoming, "\n", "", -1)
+		incoming = strings.Replace(incoming, "\r", "", -1)
+		return strings.TrimSpace(incoming), nil
+	}
+	promptPassword := func(text string) (string, error) {
+		return prompt(text, true)
 	}
-	h.addClient(conn, name)
 
-	h.logger.WithFields(logrus.Fields{
-		"address.local": conn.LocalAddr(),
-		"address.remote": conn.RemoteAddr(),
-		"name": name,
-	}).Info("client connected")
+	var name string
+	for failures := 0; name == ""; {
+		defaultName := randomdata.SillyName()
+		text := fmt.Sprintf("Enter your name (default: %v)", defaultName)
+		if h.AccountsOnly {
+			text = "Enter your name"
+		}
+		incoming, err := prompt(text, false)
+		if err != nil {
+			deadConnections <- conn
+			return
+		}
+		if incoming == "" && h.AccountsOnly {
+			continue
+		} else if incoming == "" {
+			incoming = defaultName
+		}
 
-	_, err = conn.Write([]byte(fmt.Sprintf("Welcome to telchat %v\r\n", name)))
-	if err != nil {
+		// re-prompt the client until it has chosen a valid name that is not used by anyone else, and has logged into
+		// the account of the name if it is registered
+		var account, reply string
+		if err := ValidateNick(incoming); err != nil {
+			reply = err.Error()
+		} else if h.IsRegistered(incoming) {
+			password, err := promptPassword(fmt.Sprintf("The name %s is registered, enter your password", incoming))
+			if err != nil {
+				deadConnections <- conn
+				return
+			}
+			if err := h.Authenticate(incoming, password); err != nil {
+				h.logger.WithFields(logrus.Fields{
+					"address.remote": conn.RemoteAddr(),
+					"name":           incoming,
+				}).Warn("failed login")
+				if failures++; failures >= MaxLoginAttempts {
+					conn.Write([]byte("Too many failed logins\r\n"))
+					deadConnections <- conn
+					return
+				}
+				reply = "Invalid password"
+			} else {
+				account = incoming
+			}
+		} else if h.AccountsOnly {
+			// new users register their name by choosing a password
+			password, err := promptPassword(fmt.Sprintf("The name %s is not registered yet. Choose a password (at least %d characters) to register it", incoming, MinPasswordLength))
+			if err != nil {
+				deadConnections <- conn
+				return
+			}
+			repeated, err := promptPassword("Repeat the password")
+			if err != nil {
+				deadConnections <- conn
+				return
+			}
+			if password != repeated {
+				reply = "The passwords don't match"
+			} else if err := h.Register(incoming, password); err != nil {
+				reply = err.Error()
+			} else {
+				account = incoming
+			}
+		}
+
+		if reply == "" {
+			if err := h.addClient(conn, incoming, account, SourceTCP, TextEncoder); err == ErrNickInUse {
+				reply = fmt.Sprintf("The name %s is already in use, please choose another name", incoming)
+			} else if err != nil {
+				reply = err.Error()
+			} else {
+				name = incoming
+				break
+			}
+		}
+		if _, err := conn.Write([]byte(reply + "\r\n")); err != nil {
+			deadConnections <- conn
+			return
+		}
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	if err := h.startSession(conn); err != nil {
 		deadConnections <- conn
 		return
 	}
-
-	go func() {
-		messages <- Message{"Joined\r\n", name}
-	}()
+	if h.Telnet && h.PingInterval > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go h.heartbeat(conn, telnet, stop)
+	}
 
 	for {
-		m, err := reader.ReadString('\n')
-		if err != nil {
+		if h.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(h.IdleTimeout))
+		}
+		m, err := readLine(false)
+		if err == ErrLineTooLong {
+			h.LineTooLong(conn)
+			continue
+		} else if isTimeout(err) {
+			// the writer goroutine closes conn after the notice was written, which ends the loop
+			h.logger.WithFields(logrus.Fields{
+				"address.remote": conn.RemoteAddr(),
+				"name":           h.getClientName(conn),
+			}).Info("disconnecting idle client")
+			h.Notify(conn, fmt.Sprintf("Disconnected after %v without activity", h.IdleTimeout))
+			h.Quit(conn, "Idle timeout")
+			continue
+		} else if err != nil {
 			break
 		}
-
-		h.logger.WithFields(logrus.Fields{
-			"message": m,
-			"sender":  name,
-		}).Info("received message via tcp")
-		messages <- Message{m, name}
+		h.Input(conn, m)
 	}
 
 	deadConnections <- conn
@@ -243,30 +768,454 @@ func (h *Handler) handleDisconnect(conn net.Conn, messages chan Message) {
 		"name":           h.getClientName(conn),
 	}).Info("client disconnected")
 
+	conn.Close()
 	n := h.getClientName(conn)
-	messages <- Message{"Disconnected", n}
+	rooms := h.getClientRooms(conn)
+	q := h.getClientQuitMessage(conn)
 	h.deleteClient(conn)
+	for _, r := range rooms {
+		messages <- Message{Kind: KindQuit, Message: q, Room: r, Sender: n}
+	}
 }
 
-// iterateClients will send each key contained in c.clients to a returned channel
-func (h *Handler) iterateClients() <-chan net.Conn {
-	i := make(chan net.Conn)
+// Input will handle a line of input from the client conn. Lines starting with '/' are executed as commands, anything
+// else is sent as chat text to the client's current room. A leading "//" is used to send chat text that starts with
+// a '/'.
+func (h *Handler) Input(conn net.Conn, line string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.TrimSpace(line) == "" || h.throttle(conn) {
+		return
+	} else if h.MaxLineLength > 0 && len(line) > h.MaxLineLength {
+		h.LineTooLong(conn)
+		return
+	} else if strings.HasPrefix(line, "/") && !strings.HasPrefix(line, "//") {
+		h.executeCommand(conn, line)
+		return
+	}
 
-	go func() {
-		defer func() {
-			h.mutex.RUnlock()
-			close(i)
-		}()
+	line = strings.TrimPrefix(line, "/")
+	name := h.getClientName(conn)
+	if err := h.CheckMute(name); err != nil {
+		h.Notify(conn, err.Error())
+		return
+	} else if err := h.CheckText(line); err != nil {
+		h.Notify(conn, err.Error())
+		return
+	}
+	room := h.getClientRoom(conn)
+	source := h.getClientSource(conn)
+	h.logger.WithFields(logrus.Fields{
+		"message": line,
+		"room":    room,
+		"sender":  name,
+	}).Info("received message via " + source)
+	h.messages <- Message{Message: line, Room: room, Sender: name, Source: source}
+}
+
+// Join will add the client conn to room and make it the client's current room. The recent history of room is replayed
+// to the client and the other members of room are notified, unless the client was already a member of room.
+func (h *Handler) Join(conn net.Conn, room string) error {
+	room, err := NormalizeRoom(room)
+	if err != nil {
+		return err
+	}
+
+	if h.joinRoom(conn, room) {
+		h.messages <- Message{Kind: KindJoin, Room: room, Sender: h.getClientName(conn)}
+	}
+	return nil
+}
+
+// joinRoom will make room the current room of client. If client was not already a member of room the recent messages
+// of room are replayed to client and true is returned. No message can be broadcast to room in the meantime, so the
+// replayed messages are neither repeated nor overtaken by new ones.
+func (h *Handler) joinRoom(client net.Conn, room string) (joined bool) {
+	// The history is loaded before h.sequencer is taken, so that reading it from h.Store doesn't hold up every other
+	// message. Only the messages that arrive in the meantime are loaded while holding h.sequencer.
+	var backlog []Message
+	if h.HistorySize > 0 && !h.isMember(client, room) {
+		backlog = h.history(Query{Limit: h.HistorySize, Room: room})
+	}
+
+	h.sequencer.Lock()
+	defer h.sequencer.Unlock()
+
+	h.mutex.Lock()
+	val, ok := h.clients[client]
+	if !ok {
+		h.mutex.Unlock()
+		return false
+	}
 
-		h.mutex.RLock()
-		for k := range h.clients {
-			h.mutex.RUnlock()
-			i <- k
-			h.mutex.RLock()
+	val.room = room
+	if val.rooms[room] {
+		h.mutex.Unlock()
+		return false
+	}
+	val.rooms[room] = true
+	h.mutex.Unlock()
+
+	if h.HistorySize > 0 {
+		q := Query{Limit: h.HistorySize, Room: room}
+		if len(backlog) > 0 {
+			q.After = backlog[len(backlog)-1].ID
+		}
+		backlog = append(backlog, h.history(q)...)
+		if len(backlog) > h.HistorySize {
+			backlog = backlog[len(backlog)-h.HistorySize:]
 		}
+		h.replayMessages(client, backlog)
+	}
+	return true
+}
+
+// isMember reports whether client is a member of room
+func (h *Handler) isMember(client net.Conn, room string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	val, ok := h.clients[client]
+	return ok && val.rooms[room]
+}
+
+// history will return the messages of h.Store that match q. Errors are logged.
+func (h *Handler) history(q Query) []Message {
+	messages, err := h.Store.Query(q)
+	if err != nil {
+		h.logger.WithFields(logrus.Fields{
+			"error": err,
+			"room":  q.Room,
+		}).Error("error loading room history")
+	}
+	return messages
+}
+
+// Part will remove the client conn from room and return the room that the client is now talking in. A client that
+// leaves its last room is placed back into DefaultRoom.
+func (h *Handler) Part(conn net.Conn, room string) (current string, err error) {
+	room, err = NormalizeRoom(room)
+	if err != nil {
+		return "", err
+	}
+
+	current, rejoined, ok := h.partRoom(conn, room)
+	if !ok {
+		return "", fmt.Errorf("You are not in %s", room)
+	}
+	name := h.getClientName(conn)
+	h.messages <- Message{Kind: KindPart, Room: room, Sender: name}
+	if rejoined {
+		h.messages <- Message{Kind: KindJoin, Room: current, Sender: name}
+	}
+	return current, nil
+}
+
+// partRoom will remove client from room and return the room that client is now talking in. A client that leaves
+// its last room is placed back into DefaultRoom, which is indicated by rejoined. ok is false if client was not a
+// member of room.
+func (h *Handler) partRoom(client net.Conn, room string) (current string, rejoined bool, ok bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	val, found := h.clients[client]
+	if !found || !val.rooms[room] {
+		return "", false, false
+	}
+
+	delete(val.rooms, room)
+	if val.room == room {
+		val.room = ""
+		if val.rooms[DefaultRoom] {
+			val.room = DefaultRoom
+		} else {
+			for r := range val.rooms {
+				if val.room == "" || r < val.room {
+					val.room = r
+				}
+			}
+		}
+	}
+	if val.room == "" {
+		val.room = DefaultRoom
+		val.rooms[DefaultRoom] = true
+		rejoined = true
+	}
+	return val.room, rejoined, true
+}
+
+// Rename will change the name of the client conn and notify the members of all rooms that the client is in.
+// ErrNickInUse is returned if another client is already using name, ErrNickReserved if name belongs to an account
+// that the client isn't logged into and a *BannedError if name is banned.
+func (h *Handler) Rename(conn net.Conn, name string) error {
+	if err := ValidateNick(name); err != nil {
+		return err
+	}
+
+	old := h.getClientName(conn)
+	if name == old {
+		return nil
+	} else if err := h.checkName(name, h.getClientAccount(conn)); err != nil {
+		return err
+	} else if err := h.CheckBan(name, h.getClientAccount(conn), remoteIP(conn)); err != nil {
+		return err
+	} else if err := h.renameClient(conn, name); err != nil {
+		return err
+	}
+	for _, r := range h.getClientRooms(conn) {
+		h.messages <- Message{Kind: KindNick, Message: name, Room: r, Sender: old}
+	}
+	return nil
+}
+
+// renameClient will change the name of the specified client. ErrNickInUse is returned if another client is already
+// using name.
+func (h *Handler) renameClient(client net.Conn, name string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if conn := h.lookupClient(name); conn != nil && conn != client {
+		return ErrNickInUse
+	}
+	if val, ok := h.clients[client]; ok {
+		// a muted client stays muted under its new name
+		if until, muted := h.mutes[nameKey(val.name)]; muted {
+			delete(h.mutes, nameKey(val.name))
+			h.mutes[nameKey(name)] = until
+		}
+		val.name = name
+	}
+	return nil
+}
+
+// Notify will send text to the client conn as a notice from the server
+func (h *Handler) Notify(conn net.Conn, text string) error {
+	return h.deliver(conn, Message{Kind: KindSystem, Message: text, Time: time.Now()})
+}
+
+// Quit will disconnect the client conn once the messages queued for it have been written. The optional message is
+// displayed to the members of the client's rooms.
+func (h *Handler) Quit(conn net.Conn, message string) error {
+	if message != "" {
+		h.setClientQuitMessage(conn, message)
+	}
+
+	h.mutex.RLock()
+	val, ok := h.clients[conn]
+	h.mutex.RUnlock()
+	if ok {
+		// the writer goroutine closes conn after it has written everything that is queued
+		val.queue.close(false)
+		return nil
+	}
+	return conn.Close()
+}
+
+// replayMessages will write messages to conn, each displayed with the time it was originally received
+func (h *Handler) replayMessages(conn net.Conn, messages []Message) {
+	for _, m := range messages {
+		m.Replay = true
+		if err := h.deliver(conn, m); err != nil {
+			h.logger.WithField("error", err).Debug("error replaying message")
+			return
+		}
+	}
+}
+
+// startSession will welcome the newly registered client conn and place it into DefaultRoom
+func (h *Handler) startSession(conn net.Conn) error {
+	name := h.getClientName(conn)
+	fields := logrus.Fields{
+		"address.local": conn.LocalAddr(),
+		"address.remote": conn.RemoteAddr(),
+		"name": name,
+		"source": h.getClientSource(conn),
+	}
+	if t, ok := h.Terminal(conn); ok {
+		fields["terminal"] = fmt.Sprintf("%+v", t)
+	}
+	h.logger.WithFields(fields).Info("client connected")
+
+	if err := h.Notify(conn, fmt.Sprintf("Welcome to telchat %v", name)); err != nil {
+		return err
+	}
+
+	h.joinRoom(conn, DefaultRoom)
+	go func() {
+		h.messages <- Message{Kind: KindJoin, Room: DefaultRoom, Sender: name}
 	}()
+	return nil
+}
 
-	return i
+// roomMembers will return the connections of all clients that are members of room
+func (h *Handler) roomMembers(room string) []net.Conn {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	var members []net.Conn
+	for conn, c := range h.clients {
+		if c.rooms[room] {
+			members = append(members, conn)
+		}
+	}
+	return members
+}
+
+// Members will return the sorted names of all clients that are members of room
+func (h *Handler) Members(room string) []string {
+	var names []string
+	for _, conn := range h.roomMembers(room) {
+		if name := h.getClientName(conn); name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Rooms will return the sorted names of all rooms that have at least one member
+func (h *Handler) Rooms() []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	set := make(map[string]bool)
+	for _, c := range h.clients {
+		for r := range c.rooms {
+			set[r] = true
+		}
+	}
+
+	rooms := make([]string, 0, len(set))
+	for r := range set {
+		rooms = append(rooms, r)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Send will send m on behalf of the client conn. The sender and source of m are always those of the client, so a
+// client can't impersonate anyone. m is sent to the client's current room, unless m.Recipient (a private message) or
+// m.Room (which the client must be a member of) is set.
+func (h *Handler) Send(conn net.Conn, m Message) error {
+	name := h.getClientName(conn)
+	if name == "" {
+		return errors.New("not connected")
+	} else if h.throttle(conn) {
+		return errors.New("You are sending messages too fast")
+	} else if err := h.CheckMute(name); err != nil {
+		return err
+	}
+
+	if err := ValidateMeta(m.Meta); err != nil {
+		return err
+	} else if err := h.CheckLength(m.Message); err != nil {
+		return err
+	} else if err := h.CheckText(m.Message); err != nil {
+		return err
+	}
+	m = Message{Action: m.Action, Message: m.Message, Meta: m.Meta, Recipient: m.Recipient, Room: m.Room, Sender: name, Source: h.getClientSource(conn)}
+	if m.Recipient != "" {
+		recipient := h.findClient(m.Recipient)
+		if recipient == nil {
+			return fmt.Errorf("%s is not online", m.Recipient)
+		}
+		m.Recipient = h.getClientName(recipient)
+		m.Room = ""
+	} else if m.Room == "" {
+		m.Room = h.getClientRoom(conn)
+	} else {
+		room, err := NormalizeRoom(m.Room)
+		if err != nil {
+			return err
+		}
+		m.Room = room
+
+		isMember := false
+		for _, r := range h.getClientRooms(conn) {
+			isMember = isMember || r == room
+		}
+		if !isMember {
+			return fmt.Errorf("You are not in %s", room)
+		}
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"message":   m.Message,
+		"recipient": m.Recipient,
+		"room":      m.Room,
+		"sender":    m.Sender,
+	}).Info("received message via " + m.Source)
+	h.messages <- m
+	return nil
+}
+
+// SetTopic will change the topic of room, which the client conn must be a member of. An empty topic clears the topic.
+func (h *Handler) SetTopic(conn net.Conn, room string, topic string) error {
+	room, err := NormalizeRoom(room)
+	if err != nil {
+		return err
+	}
+	if err := h.CheckText(topic); err != nil {
+		return err
+	}
+	topic = strings.TrimSpace(h.sanitize(topic))
+	if utf8.RuneCountInString(topic) > MaxTopicLength {
+		return fmt.Errorf("topics can't be longer than %d characters", MaxTopicLength)
+	}
+
+	isMember := false
+	for _, r := range h.getClientRooms(conn) {
+		isMember = isMember || r == room
+	}
+	if !isMember {
+		return fmt.Errorf("You are not in %s", room)
+	} else if err := h.CheckMute(h.getClientName(conn)); err != nil {
+		return err
+	}
+
+	h.mutex.Lock()
+	if topic == "" {
+		delete(h.topics, room)
+	} else {
+		h.topics[room] = topic
+	}
+	h.mutex.Unlock()
+
+	h.messages <- Message{Kind: KindTopic, Message: topic, Room: room, Sender: h.getClientName(conn)}
+	return nil
+}
+
+// setClientQuitMessage will store the message that the specified client provided to /quit
+func (h *Handler) setClientQuitMessage(client net.Conn, message string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if val, ok := h.clients[client]; ok {
+		val.quit = message
+	}
+}
+
+// SetColor will turn the rendering of messages using ANSI colors on or off for the client conn. Only clients that are
+// connected through a terminal (telnet and SSH) support colors.
+func (h *Handler) SetColor(conn net.Conn, on bool) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	val, ok := h.clients[conn]
+	if !ok {
+		return errors.New("not connected")
+	} else if val.source != SourceTCP && val.source != SourceSSH {
+		return ErrNoColor
+	}
+	val.color = on
+	return nil
+}
+
+// Color reports whether messages are rendered using ANSI colors for the client conn
+func (h *Handler) Color(conn net.Conn) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	val, ok := h.clients[conn]
+	return ok && val.color
+}
+
+// Topic will return the topic of room or "" if room doesn't have a topic
+func (h *Handler) Topic(room string) string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.topics[room]
 }
 
 // numClients will return the number of keys within h.clients
@@ -279,4 +1228,43 @@ func (h *Handler) numClients() int {
 // Messages will return a reference to a channel that all client messages are sent on
 func (h *Handler) Messages() chan Message {
 	return h.messages
-}
\ No newline at end of file
+}
+
+// NormalizeRoom will convert name into the canonical form of a room name (lower case without a leading '#'). An
+// error is returned if name is not a valid room name.
+func NormalizeRoom(name string) (string, error) {
+	room := strings.ToLower(strings.TrimPrefix(name, "#"))
+	if room == "" || len(room) > 32 {
+		return "", fmt.Errorf("invalid room name %q: must be between 1 and 32 characters", name)
+	}
+	for _, r := range room {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return "", fmt.Errorf("invalid room name %q: only letters, numbers, '-' and '_' are allowed", name)
+		}
+	}
+	return room, nil
+}
+
+// ValidateNick will return an error if name can't be used as a nickname. Nicknames must not be longer than
+// MaxNickLength, start or end with a space, or contain control characters. The characters ()/ are reserved for
+// tagging the senders of messages received via HTTP, e.g. "ci (via http)", and " for quoting names in commands.
+func ValidateNick(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("invalid name: a name is required")
+	} else if len([]rune(name)) > MaxNickLength {
+		return fmt.Errorf("invalid name %q: must not be longer than %d characters", name, MaxNickLength)
+	} else if strings.TrimSpace(name) != name {
+		return fmt.Errorf("invalid name %q: must not start or end with a space", name)
+	} else if ContainsControl(name) {
+		return fmt.Errorf("invalid name %q: must not contain control characters", name)
+	} else if strings.ContainsAny(name, `()/"`) {
+		return fmt.Errorf(`invalid name %q: the characters ()/" are not allowed`, name)
+	}
+	return nil
+}
+
+// nameKey returns the key that identifies the name of a client. Names are case-insensitive, and a space is the same
+// as an underscore because IRC clients see the spaces in names as underscores.
+func nameKey(name string) string {
+	return strings.ToLower(strings.Replace(name, " ", "_", -1))
+}
@@ -8,14 +8,78 @@ import (
 	"bufio"
 	"regexp"
 	"time"
+	"strconv"
+	"strings"
 )
 
-func TestMessage_String(t *testing.T) {
-	m := Message{"test", "name"}
-	s := m.String()
-	e := fmt.Sprintf("%v[0-9]{2} %s: %s", time.Now().Format("15:04:"), m.Sender, m.Message)
-	if matched, _ :=regexp.MatchString(e, s); !matched {
-		t.Errorf("actual output (%#v) does not match expected pattern (%#v)", s, e)
+func TestRender(t *testing.T) {
+	now := time.Now()
+	testCases := map[string]struct {
+		m Message
+		e string
+	}{
+		"chat": {Message{Kind: KindChat, Message: "test", Room: DefaultRoom, Sender: "name", Time: now}, "%s name: test\r\n"},
+		"other room": {Message{Kind: KindChat, Message: "test", Room: "ops", Sender: "name", Time: now}, "%s [ops] name: test\r\n"},
+		"action": {Message{Action: true, Kind: KindAction, Message: "waves", Room: DefaultRoom, Sender: "name", Time: now}, "%s * name waves\r\n"},
+		"private": {Message{Kind: KindPrivate, Message: "psst", Recipient: "bob", Sender: "name", Time: now}, "%s name -> bob: psst\r\n"},
+		"join": {Message{Kind: KindJoin, Room: DefaultRoom, Sender: "name", Time: now}, "%s name: Joined\r\n"},
+		"http": {Message{Kind: KindChat, Message: "test", Room: DefaultRoom, Sender: "ci", Source: SourceHTTP, Time: now}, "%s ci (via http): test\r\n"},
+		"system": {Message{Kind: KindSystem, Message: "Welcome", Time: now}, "Welcome\r\n"},
+	}
+	for k, v := range testCases {
+		e := v.e
+		if strings.Contains(e, "%s") {
+			e = fmt.Sprintf(e, now.Format("15:04:05"))
+		}
+		if s := Render(v.m); s != e {
+			t.Errorf("%s: expected output (%#v) differed from actual output (%#v)", k, e, s)
+		}
+	}
+}
+
+func TestRenderColor(t *testing.T) {
+	now := time.Now()
+	ts := ansiDim + now.Format("15:04:05") + ansiReset
+	alice := NickColor("alice") + "alice" + ansiReset
+	bob := NickColor("bob") + "bob" + ansiReset
+	testCases := map[string]struct {
+		m Message
+		e string
+	}{
+		"chat": {Message{Kind: KindChat, Message: "test", Room: DefaultRoom, Sender: "alice", Time: now}, ts + " " + alice + ": test\r\n"},
+		"own message": {Message{Kind: KindChat, Message: "test", Room: DefaultRoom, Sender: "Bob", Time: now}, ts + " " + NickColor("Bob") + "Bob" + ansiReset + ": " + ansiBold + "test" + ansiReset + "\r\n"},
+		"mention": {Message{Kind: KindChat, Message: "hi BOB, bobby", Room: DefaultRoom, Sender: "alice", Time: now}, ts + " " + alice + ": hi " + ansiReverse + "BOB" + ansiReset + ", bobby\r\n"},
+		"private": {Message{Kind: KindPrivate, Message: "psst", Recipient: "bob", Sender: "alice", Time: now}, ts + " " + alice + " -> " + bob + ": psst\r\n"},
+		"join": {Message{Kind: KindJoin, Room: DefaultRoom, Sender: "alice", Time: now}, ts + " " + alice + ": " + ansiDim + "Joined" + ansiReset + "\r\n"},
+		"system": {Message{Kind: KindSystem, Message: "Welcome", Time: now}, ansiDim + "Welcome" + ansiReset + "\r\n"},
+	}
+	for k, v := range testCases {
+		if s := RenderColor(v.m, "bob"); s != v.e {
+			t.Errorf("%s: expected output (%#v) differed from actual output (%#v)", k, v.e, s)
+		}
+	}
+
+	if NickColor("Alice") != NickColor("alice") {
+		t.Errorf("expected the color of a nickname to ignore case")
+	}
+}
+
+func TestSupportsColor(t *testing.T) {
+	testCases := map[string]struct {
+		term string
+		e    bool
+	}{
+		"xterm": {"XTERM-256COLOR", true},
+		"screen": {"screen", true},
+		"color": {"wsvt25-color", true},
+		"vt100": {"VT100", false},
+		"dumb": {"dumb", false},
+		"unknown": {"", false},
+	}
+	for k, v := range testCases {
+		if a := SupportsColor(v.term); a != v.e {
+			t.Errorf("%s: expected color support (%v) differed from actual color support (%v)", k, v.e, a)
+		}
 	}
 }
 
@@ -55,13 +119,15 @@ func TestHandler_Start(t *testing.T) {
 	// wait until h.Start() has completed or experienced an error
 	select {
 	case <-done:
-		go func() {
+		func() {
+			defer h.Stop()
+
 			name := "test name"
 			name2 := "test name2"
 			message := "test message"
 			message2 := "test message2"
 
-			conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", address, port))
+			conn, err := net.Dial("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
 			if err != nil {
 				t.Fatal(err)
 			} else if conn != nil {
@@ -73,7 +139,7 @@ func TestHandler_Start(t *testing.T) {
 			incoming, _ := reader.ReadString('\n')
 
 			// Submit a name
-			if _, err := fmt.Fprintf(conn, fmt.Sprintf("%s\r\n", name)); err != nil {
+			if _, err := fmt.Fprintf(conn, "%s\r\n", name); err != nil {
 				t.Fatal(err)
 			}
 
@@ -92,7 +158,7 @@ func TestHandler_Start(t *testing.T) {
 			}
 
 			// Connect a 2nd client
-			conn2, err := net.Dial("tcp", fmt.Sprintf("%s:%d", address, port))
+			conn2, err := net.Dial("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -102,7 +168,7 @@ func TestHandler_Start(t *testing.T) {
 			incoming, _ = reader2.ReadString('\n')
 
 			// Submit a name for conn2
-			if _, err := fmt.Fprintf(conn2, fmt.Sprintf("%s\r\n", name2)); err != nil {
+			if _, err := fmt.Fprintf(conn2, "%s\r\n", name2); err != nil {
 				t.Fatal(err)
 			}
 
@@ -114,7 +180,7 @@ func TestHandler_Start(t *testing.T) {
 			}
 
 			// Submit a message
-			if _, err := fmt.Fprintf(conn, fmt.Sprintf("%s\r\n", message)); err != nil {
+			if _, err := fmt.Fprintf(conn, "%s\r\n", message); err != nil {
 				t.Fatal(err)
 			}
 
@@ -126,7 +192,7 @@ func TestHandler_Start(t *testing.T) {
 			}
 
 			// Submit a message as conn2
-			if _, err := fmt.Fprintf(conn2, fmt.Sprintf("%s\r\n", message2)); err != nil {
+			if _, err := fmt.Fprintf(conn2, "%s\r\n", message2); err != nil {
 				t.Fatal(err)
 			}
 
@@ -144,8 +210,6 @@ func TestHandler_Start(t *testing.T) {
 			if m, _ := regexp.MatchString(e, incoming); !m {
 				t.Errorf("did not receive expected message.\n\tExpected: %#v\n\tActual: %#v", e, incoming)
 			}
-
-			h.Stop()
 		}()
 	case <-eCh:
 	}
@@ -189,7 +253,7 @@ func TestHandler_Stop(t *testing.T) {
 		}
 
 		dialer := net.Dialer{Timeout: time.Duration(2 * time.Second)}
-		conn, err := dialer.Dial("tcp", fmt.Sprintf("%s:%d", address, port))
+		conn, err := dialer.Dial("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
 		if err == nil {
 			t.Errorf("connected via TCP to %s:%d after h.Stop() should have stopped the TCP listener", address, port)
 		} else if conn != nil {
@@ -207,4 +271,253 @@ func TestHandler_Messages(t *testing.T) {
 	if m == nil {
 		t.Errorf("failed to obtain Messages channel")
 	}
-}
\ No newline at end of file
+}
+func TestHandler_Rooms(t *testing.T) {
+	address := ""
+	port := 6004
+	h := startHandler(t, address, port)
+	defer h.Stop()
+
+	alice, aliceReader := connectClient(t, address, port, "alice")
+	defer alice.Close()
+	bob, bobReader := connectClient(t, address, port, "bob")
+	defer bob.Close()
+
+	// alice sees bob joining the lobby
+	expectLines(t, aliceReader, ".*bob: Joined\r\n")
+
+	// alice joins ops and is told that she is now talking there
+	fmt.Fprintf(alice, "/join #OPS\r\n")
+	expectLines(t, aliceReader, ".*\\[ops\\] alice: Joined\r\n", "Now talking in ops\r\n")
+
+	// a message sent to ops reaches alice, but not bob who is only in the lobby
+	fmt.Fprintf(alice, "hello ops\r\n")
+	expectLines(t, aliceReader, ".*\\[ops\\] alice: hello ops\r\n")
+	fmt.Fprintf(bob, "hello lobby\r\n")
+	expectLines(t, bobReader, "[0-9:]+ bob: hello lobby\r\n")
+	expectLines(t, aliceReader, "[0-9:]+ bob: hello lobby\r\n")
+
+	// /rooms lists every room with its member count
+	fmt.Fprintf(alice, "/rooms\r\n")
+	expectLines(t, aliceReader, "Rooms:\r\n", "\\+ lobby \\(2\\)\r\n", "\\* ops \\(1\\)\r\n")
+
+	// parting ops puts alice back in the lobby
+	fmt.Fprintf(alice, "/part\r\n")
+	expectLines(t, aliceReader, "Left ops, now talking in lobby\r\n")
+	fmt.Fprintf(alice, "back again\r\n")
+	expectLines(t, bobReader, "[0-9:]+ alice: back again\r\n")
+
+	fmt.Fprintf(alice, "/part ops\r\n")
+	expectLines(t, aliceReader, ".*alice: back again\r\n", "You are not in ops\r\n")
+}
+
+func TestNormalizeRoom(t *testing.T) {
+	testCases := map[string]struct {
+		name  string
+		eRoom string
+		eErr  bool
+	}{
+		"plain":        {"ops", "ops", false},
+		"irc style":    {"#Dev", "dev", false},
+		"empty":        {"#", "", true},
+		"invalid char": {"on call", "", true},
+		"too long":     {"abcdefghijklmnopqrstuvwxyz0123456789", "", true},
+	}
+
+	for k, v := range testCases {
+		room, err := NormalizeRoom(v.name)
+		if (err != nil) != v.eErr {
+			t.Errorf("%s: expected error (%v) differed from actual error (%v)", k, v.eErr, err)
+		}
+		if room != v.eRoom {
+			t.Errorf("%s: expected room (%s) differed from actual room (%s)", k, v.eRoom, room)
+		}
+	}
+}
+
+// startHandler will start a new Handler listening on address:port and wait until it is accepting connections. Each
+// of configure is called with the Handler before it is started.
+func startHandler(t *testing.T, address string, port int, configure ...func(h *Handler)) *Handler {
+	logger, _ := test.NewNullLogger()
+	h := New(address, port, logger)
+	for _, c := range configure {
+		c(h)
+	}
+
+	done := make(chan struct{})
+	h.startDone = func() {
+		close(done)
+	}
+	eCh := make(chan error, 1)
+	go func() {
+		eCh <- h.Start()
+	}()
+
+	select {
+	case <-done:
+	case err := <-eCh:
+		t.Fatalf("failed to start TCP listener at %s:%d -> %s", address, port, err)
+	}
+	return h
+}
+
+// connectClient will connect to address:port as name and consume all lines up to the client's own "Joined" message
+func connectClient(t *testing.T, address string, port int, name string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// Extract entry message: Enter your name (default: Toothclover)
+	expectLines(t, reader, "Enter your name.*\r\n")
+	if _, err := fmt.Fprintf(conn, "%s\r\n", name); err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, reader, fmt.Sprintf("Welcome to telchat %s\r\n", name))
+	expectLines(t, reader, fmt.Sprintf(".*%s: Joined\r\n", name))
+	return conn, reader
+}
+
+// expectLines will read len(patterns) lines from reader and ensure that each line matches one of patterns. The
+// order of the lines is not enforced because replies to commands can race with broadcasted messages.
+func expectLines(t *testing.T, reader *bufio.Reader, patterns ...string) {
+	t.Helper()
+	remaining := append([]string(nil), patterns...)
+	for range patterns {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read line while expecting %#v -> %s", remaining, err)
+		}
+
+		matched := -1
+		for i, p := range remaining {
+			if m, _ := regexp.MatchString("^"+p+"$", line); m {
+				matched = i
+				break
+			}
+		}
+		if matched < 0 {
+			t.Fatalf("did not receive expected message.\n\tExpected one of: %#v\n\tActual: %#v", remaining, line)
+		}
+		remaining = append(remaining[:matched], remaining[matched+1:]...)
+	}
+}
+
+func TestHandler_UniqueNicks(t *testing.T) {
+	address := ""
+	port := 6008
+	h := startHandler(t, address, port)
+	defer h.Stop()
+
+	alice, aliceReader := connectClient(t, address, port, "alice")
+	defer alice.Close()
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// names are unique regardless of case, and invalid names are rejected, so the client is prompted again
+	expectLines(t, reader, "Enter your name.*\r\n")
+	fmt.Fprintf(conn, "ALICE\r\n")
+	expectLines(t, reader, "The name ALICE is already in use, please choose another name\r\n", "Enter your name.*\r\n")
+	fmt.Fprintf(conn, "bob (via http)\r\n")
+	expectLines(t, reader, "invalid name \"bob \\(via http\\)\": .*\r\n", "Enter your name.*\r\n")
+	fmt.Fprintf(conn, "bob\r\n")
+	expectLines(t, reader, "Welcome to telchat bob\r\n", ".*bob: Joined\r\n")
+	expectLines(t, aliceReader, ".*bob: Joined\r\n")
+
+	fmt.Fprintf(conn, "/nick Alice\r\n")
+	expectLines(t, reader, "The name Alice is already in use\r\n")
+
+	// private messages are addressed case-insensitively
+	fmt.Fprintf(conn, "/msg ALICE hi\r\n")
+	expectLines(t, reader, "[0-9:]+ bob -> alice: hi\r\n")
+	expectLines(t, aliceReader, "[0-9:]+ bob -> alice: hi\r\n")
+
+	// messages received via HTTP are tagged
+	h.Messages() <- Message{Message: "build passed", Sender: "ci", Source: SourceHTTP}
+	expectLines(t, aliceReader, "[0-9:]+ ci \\(via http\\): build passed\r\n")
+}
+
+func TestValidateNick(t *testing.T) {
+	testCases := map[string]struct {
+		name string
+		eErr bool
+	}{
+		"simple":      {"alice", false},
+		"irc chars":   {"[alice]_-^{|}", false},
+		"unicode":     {"zoë", false},
+		"space":       {"alice smith", false},
+		"empty":       {"", true},
+		"blank":       {"  ", true},
+		"padded":      {" alice", true},
+		"parentheses": {"bob(via", true},
+		"slash":       {"ci/http", true},
+		"quote":       {`"alice`, true},
+		"control":     {"al\x1bice", true},
+		"too long":    {"abcdefghijklmnopqrstuvwxyz0123456789", true},
+	}
+
+	for k, v := range testCases {
+		err := ValidateNick(v.name)
+		if (err != nil) != v.eErr {
+			t.Errorf("%s: expected error (%v) differed from actual error (%v)", k, v.eErr, err)
+		}
+	}
+}
+
+func TestHandler_HistoryReplay(t *testing.T) {
+	address := ""
+	port := 6010
+	h := startHandler(t, address, port, func(h *Handler) {
+		h.HistorySize = 2
+	})
+	defer h.Stop()
+
+	alice, aliceReader := connectClient(t, address, port, "alice")
+	defer alice.Close()
+	var sent []string
+	for _, m := range []string{"one", "two", "three"} {
+		fmt.Fprintf(alice, "%s\r\n", m)
+		line, _ := aliceReader.ReadString('\n')
+		sent = append(sent, line)
+	}
+
+	// bob is shown the last 2 messages of the lobby right after the welcome message
+	time.Sleep(1 * time.Second)
+	bob, err := net.Dial("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	bob.SetDeadline(time.Now().Add(5 * time.Second))
+	bobReader := bufio.NewReader(bob)
+	expectLines(t, bobReader, "Enter your name.*\r\n")
+	fmt.Fprintf(bob, "bob\r\n")
+	expectLines(t, bobReader, "Welcome to telchat bob\r\n")
+
+	// replayed messages keep the time they were originally sent at
+	for _, e := range sent[1:] {
+		line, _ := bobReader.ReadString('\n')
+		if line != e {
+			t.Errorf("did not receive expected replayed message.\n\tExpected: %#v\n\tActual: %#v", e, line)
+		}
+	}
+	expectLines(t, bobReader, ".*bob: Joined\r\n")
+	expectLines(t, aliceReader, ".*bob: Joined\r\n")
+
+	// private messages are not part of the history, and joining a room replays the history of that room
+	fmt.Fprintf(alice, "/msg bob secret\r\n")
+	expectLines(t, bobReader, ".*alice -> bob: secret\r\n")
+	fmt.Fprintf(alice, "/join ops\r\n")
+	fmt.Fprintf(alice, "ops only\r\n")
+	expectLines(t, aliceReader, ".*alice -> bob: secret\r\n", ".*\\[ops\\] alice: Joined\r\n", "Now talking in ops\r\n", ".*\\[ops\\] alice: ops only\r\n")
+	fmt.Fprintf(bob, "/join ops\r\n")
+	expectLines(t, bobReader, ".*\\[ops\\] alice: Joined\r\n", ".*\\[ops\\] alice: ops only\r\n", ".*\\[ops\\] bob: Joined\r\n", "Now talking in ops\r\n")
+}
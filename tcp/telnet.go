@@ -0,0 +1,361 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Telnet commands and the options that are negotiated, see RFC 854 (telnet), RFC 857 (ECHO), RFC 858 (SGA),
+// RFC 860 (TIMING-MARK), RFC 1073 (NAWS) and RFC 1091 (TTYPE)
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetEcho  = 1
+	telnetSGA   = 3
+	telnetTM    = 6
+	telnetTTYPE = 24
+	telnetNAWS  = 31
+
+	ttypeIS   = 0
+	ttypeSEND = 1
+)
+
+// maxSubnegotiation is the maximum length of the parameters of a subnegotiation, longer parameters are truncated
+const maxSubnegotiation = 256
+
+// states of the telnet input parser
+const (
+	stateData = iota
+	stateIAC
+	stateCommand // waiting for the option of WILL, WONT, DO or DONT
+	stateSB      // waiting for the option of a subnegotiation
+	stateSBData
+	stateSBIAC
+)
+
+// Terminal describes what was negotiated with a telnet client
+type Terminal struct {
+	CharacterMode bool   // the server echoes the input, which the client sends as it is typed (ECHO and SGA)
+	Height        int    // the number of rows of the client's window (NAWS), 0 if unknown
+	Type          string // the terminal type of the client (TTYPE), e.g. "XTERM-256COLOR"
+	Width         int    // the number of columns of the client's window (NAWS), 0 if unknown
+}
+
+// telnetConn is the telnet codec of a TCP client. It strips telnet commands from the input, answers option
+// negotiations and escapes the output. In character mode the input line is edited by a line editor (see
+// startEditor), which keeps the line intact while messages are written to the client.
+type telnetConn struct {
+	net.Conn
+	buf       []byte
+	command   byte
+	editor    *terminal.Terminal // nil in line mode
+	enabled   map[byte]bool      // the options that are in effect, on the server's side for ECHO and SGA
+	mutex     sync.Mutex         // guards enabled, peer, received, requested and terminal
+	peer      bool               // the client sent a telnet command, so it speaks telnet
+	pending   []byte             // input that was decoded but not returned by Read yet
+	received  time.Time          // the last time anything was received from the client
+	requested map[byte]bool      // the options that the server asked for and that the client didn't answer yet
+	sb        []byte
+	secret    SecretInput // hides the passwords typed into editor
+	state     int
+	terminal  Terminal
+	writeMu   sync.Mutex
+}
+
+// newTelnetConn will wrap conn in a telnet codec
+func newTelnetConn(conn net.Conn) *telnetConn {
+	return &telnetConn{Conn: conn, buf: make([]byte, 1024), enabled: make(map[byte]bool), requested: make(map[byte]bool)}
+}
+
+// negotiate will ask the client to switch to character mode and to report its window size and terminal type
+func (c *telnetConn) negotiate() error {
+	c.mutex.Lock()
+	for _, opt := range []byte{telnetEcho, telnetSGA, telnetNAWS, telnetTTYPE} {
+		c.requested[opt] = true
+	}
+	c.mutex.Unlock()
+	return c.writeRaw([]byte{
+		telnetIAC, telnetWILL, telnetEcho,
+		telnetIAC, telnetWILL, telnetSGA,
+		telnetIAC, telnetDO, telnetNAWS,
+		telnetIAC, telnetDO, telnetTTYPE,
+	})
+}
+
+// Terminal returns the current state of the negotiation with the client
+func (c *telnetConn) Terminal() Terminal {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := c.terminal
+	t.CharacterMode = c.enabled[telnetEcho] && c.enabled[telnetSGA]
+	return t
+}
+
+// probe will ask the client to answer with a timing mark. Every telnet client answers, either with WILL or WONT,
+// without displaying anything.
+func (c *telnetConn) probe() error {
+	return c.writeRaw([]byte{telnetIAC, telnetDO, telnetTM})
+}
+
+// lastReceived returns the last time that anything was received from the client, and whether the client speaks
+// telnet and thus answers probes
+func (c *telnetConn) lastReceived() (t time.Time, peer bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.received, c.peer
+}
+
+// TerminalType implements TerminalTyper
+func (c *telnetConn) TerminalType() string {
+	return c.Terminal().Type
+}
+
+// settle will wait up to timeout for the client to answer the negotiation started by negotiate. Data that is sent by
+// the client in the meantime is kept for Read.
+func (c *telnetConn) settle(timeout time.Duration) error {
+	defer c.Conn.SetReadDeadline(time.Time{})
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		c.mutex.Lock()
+		answered := len(c.requested) == 0
+		c.mutex.Unlock()
+		if answered {
+			return nil
+		}
+
+		n, err := c.Conn.Read(c.buf)
+		if n > 0 {
+			if err := c.decode(c.buf[:n]); err != nil {
+				return err
+			}
+		}
+		if isTimeout(err) {
+			// clients that don't speak telnet never answer
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Read implements net.Conn. Only the data sent by the client is returned, telnet commands are handled by c.
+func (c *telnetConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		n, err := c.Conn.Read(c.buf)
+		if n > 0 {
+			if werr := c.decode(c.buf[:n]); werr != nil && err == nil {
+				err = werr
+			}
+		}
+		if err != nil && len(c.pending) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write implements net.Conn. Bytes that would be mistaken for telnet commands are escaped. In character mode the
+// line editor clears the line that is being typed, writes b above it and then restores the line.
+func (c *telnetConn) Write(b []byte) (int, error) {
+	if c.editor == nil {
+		return c.write(b)
+	}
+
+	// the editor translates line endings itself
+	if _, err := c.editor.Write(bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// write will escape b and write it to the client
+func (c *telnetConn) write(b []byte) (int, error) {
+	escaped := b
+	if bytes.IndexByte(b, telnetIAC) >= 0 {
+		escaped = bytes.Replace(b, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC}, -1)
+	}
+	if err := c.writeRaw(escaped); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeRaw will write b to the client as is
+func (c *telnetConn) writeRaw(b []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(b)
+	return err
+}
+
+// decode will process the bytes in that were read from the client, appending the data to c.pending. Replies to the
+// client are written immediately.
+func (c *telnetConn) decode(in []byte) error {
+	c.mutex.Lock()
+	c.received = time.Now()
+	c.mutex.Unlock()
+
+	var reply []byte
+	for _, b := range in {
+		switch c.state {
+		case stateIAC:
+			switch b {
+			case telnetIAC:
+				// an escaped 255 is data, but it is never part of valid UTF-8 text
+				c.state = stateData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				c.command, c.state = b, stateCommand
+			case telnetSB:
+				c.state = stateSB
+			default:
+				// commands such as NOP, AYT or GA are ignored
+				c.state = stateData
+			}
+		case stateCommand:
+			reply = append(reply, c.option(c.command, b)...)
+			c.state = stateData
+		case stateSB:
+			c.command, c.sb, c.state = b, c.sb[:0], stateSBData
+		case stateSBData:
+			if b == telnetIAC {
+				c.state = stateSBIAC
+			} else if len(c.sb) < maxSubnegotiation {
+				c.sb = append(c.sb, b)
+			}
+		case stateSBIAC:
+			if b == telnetSE {
+				c.subnegotiation(c.command, c.sb)
+				c.state = stateData
+			} else {
+				if b == telnetIAC && len(c.sb) < maxSubnegotiation {
+					c.sb = append(c.sb, b)
+				}
+				c.state = stateSBData
+			}
+		default:
+			if b == telnetIAC {
+				c.state = stateIAC
+				continue
+			}
+			c.input(b)
+		}
+	}
+	if len(reply) == 0 {
+		return nil
+	}
+	return c.writeRaw(reply)
+}
+
+// option will process the negotiation command cmd for opt and return the reply to the client
+func (c *telnetConn) option(cmd byte, opt byte) []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.peer = true
+	if opt == telnetTM && (cmd == telnetWILL || cmd == telnetWONT) {
+		// the answer to a probe, see probe
+		return nil
+	}
+	requested := c.requested[opt]
+	delete(c.requested, opt)
+
+	var local bool // ECHO and SGA are provided by the server, NAWS and TTYPE by the client
+	switch opt {
+	case telnetEcho, telnetSGA:
+		local = true
+	case telnetNAWS, telnetTTYPE:
+	default:
+		// unsupported options are refused, unless they are being disabled
+		if cmd == telnetWILL {
+			return []byte{telnetIAC, telnetDONT, opt}
+		} else if cmd == telnetDO {
+			return []byte{telnetIAC, telnetWONT, opt}
+		}
+		return nil
+	}
+
+	var reply []byte
+	switch {
+	case cmd == telnetDO && local, cmd == telnetWILL && !local:
+		if c.enabled[opt] {
+			return nil
+		}
+		c.enabled[opt] = true
+		if !requested {
+			if local {
+				reply = []byte{telnetIAC, telnetWILL, opt}
+			} else {
+				reply = []byte{telnetIAC, telnetDO, opt}
+			}
+		}
+		if opt == telnetTTYPE {
+			reply = append(reply, telnetIAC, telnetSB, telnetTTYPE, ttypeSEND, telnetIAC, telnetSE)
+		}
+	case cmd == telnetDONT && local, cmd == telnetWONT && !local:
+		if !c.enabled[opt] {
+			return nil
+		}
+		c.enabled[opt] = false
+		if !requested {
+			if local {
+				reply = []byte{telnetIAC, telnetWONT, opt}
+			} else {
+				reply = []byte{telnetIAC, telnetDONT, opt}
+			}
+		}
+	case local:
+		// the client offered to provide ECHO or SGA itself, the server provides them
+		if cmd == telnetWILL {
+			reply = []byte{telnetIAC, telnetDONT, opt}
+		}
+	default:
+		// the client asked the server to provide NAWS or TTYPE, which only clients provide
+		if cmd == telnetDO {
+			reply = []byte{telnetIAC, telnetWONT, opt}
+		}
+	}
+	return reply
+}
+
+// subnegotiation will process the parameters data that the client sent for opt
+func (c *telnetConn) subnegotiation(opt byte, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch {
+	case opt == telnetNAWS && len(data) == 4:
+		c.terminal.Width = int(binary.BigEndian.Uint16(data))
+		c.terminal.Height = int(binary.BigEndian.Uint16(data[2:]))
+		if c.editor != nil && c.terminal.Width > 0 && c.terminal.Height > 0 {
+			c.editor.SetSize(c.terminal.Width, c.terminal.Height)
+		}
+	case opt == telnetTTYPE && len(data) > 1 && data[0] == ttypeIS:
+		c.terminal.Type = string(data[1:])
+	}
+}
+
+// input will process the data byte b. NUL bytes, which telnet clients send after a carriage return, are dropped.
+func (c *telnetConn) input(b byte) {
+	if b != 0 {
+		c.pending = append(c.pending, b)
+	}
+}
+
+// Terminal returns what was negotiated with the telnet client conn. ok is false if conn isn't a telnet client.
+func (h *Handler) Terminal(conn net.Conn) (t Terminal, ok bool) {
+	if c, ok := conn.(*telnetConn); ok {
+		return c.Terminal(), true
+	}
+	return Terminal{}, false
+}
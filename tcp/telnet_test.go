@@ -0,0 +1,152 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// recordConn is a net.Conn that records everything written to it
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+func TestTelnetConn_decode(t *testing.T) {
+	characterMode := []byte{telnetIAC, telnetDO, telnetEcho, telnetIAC, telnetDO, telnetSGA}
+	testCases := map[string]struct {
+		negotiate bool
+		in        []byte
+		eData     string
+		eReply    []byte
+		eTerminal Terminal
+	}{
+		"line mode":           {false, []byte("hi\r\n"), "hi\r\n", nil, Terminal{}},
+		"commands stripped":   {false, []byte{'h', telnetIAC, 241, 'i', telnetIAC, telnetIAC, '\r', 0}, "hi\r", nil, Terminal{}},
+		"unsupported option":  {false, []byte{telnetIAC, telnetWILL, 5, telnetIAC, telnetDO, 5}, "", []byte{telnetIAC, telnetDONT, 5, telnetIAC, telnetWONT, 5}, Terminal{}},
+		"unrequested echo":    {false, []byte{telnetIAC, telnetDO, telnetEcho}, "", []byte{telnetIAC, telnetWILL, telnetEcho}, Terminal{}},
+		"client echo refused": {false, []byte{telnetIAC, telnetWILL, telnetEcho}, "", []byte{telnetIAC, telnetDONT, telnetEcho}, Terminal{}},
+		"naws":                {true, []byte{telnetIAC, telnetWILL, telnetNAWS, telnetIAC, telnetSB, telnetNAWS, 0, 80, 0, 24, telnetIAC, telnetSE}, "", nil, Terminal{Height: 24, Width: 80}},
+		"escaped naws":        {true, []byte{telnetIAC, telnetSB, telnetNAWS, 1, telnetIAC, telnetIAC, 0, 50, telnetIAC, telnetSE}, "", nil, Terminal{Height: 50, Width: 511}},
+		"ttype":               {true, append([]byte{telnetIAC, telnetWILL, telnetTTYPE, telnetIAC, telnetSB, telnetTTYPE, ttypeIS}, []byte("XTERM\xff\xf0")...), "", []byte{telnetIAC, telnetSB, telnetTTYPE, ttypeSEND, telnetIAC, telnetSE}, Terminal{Type: "XTERM"}},
+		"character mode":      {true, append(characterMode, []byte("ab\x7fc\x1b[A\r\x00")...), "ab\x7fc\x1b[A\r", nil, Terminal{CharacterMode: true}},
+		"probe answered":      {false, []byte{telnetIAC, telnetWILL, telnetTM, telnetIAC, telnetWONT, telnetTM}, "", nil, Terminal{}},
+		"refused":             {true, []byte{telnetIAC, telnetDONT, telnetEcho, telnetIAC, telnetWONT, telnetNAWS}, "", nil, Terminal{}},
+	}
+	for k, v := range testCases {
+		conn := &recordConn{}
+		c := newTelnetConn(conn)
+		if v.negotiate {
+			c.negotiate()
+			conn.written.Reset()
+		}
+		if err := c.decode(v.in); err != nil {
+			t.Errorf("%s: failed to decode input -> %s", k, err)
+		}
+		if string(c.pending) != v.eData {
+			t.Errorf("%s: expected data (%q) differed from actual data (%q)", k, v.eData, c.pending)
+		}
+		if !bytes.Equal(conn.written.Bytes(), v.eReply) {
+			t.Errorf("%s: expected reply (%v) differed from actual reply (%v)", k, v.eReply, conn.written.Bytes())
+		}
+		if term := c.Terminal(); term != v.eTerminal {
+			t.Errorf("%s: expected terminal (%+v) differed from actual terminal (%+v)", k, v.eTerminal, term)
+		}
+	}
+}
+
+func TestTelnetConn_Write(t *testing.T) {
+	conn := &recordConn{}
+	c := newTelnetConn(conn)
+	if n, err := c.Write([]byte{'a', telnetIAC, 'b'}); n != 3 || err != nil {
+		t.Errorf("failed to write -> %d, %v", n, err)
+	}
+	if e := []byte{'a', telnetIAC, telnetIAC, 'b'}; !bytes.Equal(conn.written.Bytes(), e) {
+		t.Errorf("expected output (%v) differed from actual output (%v)", e, conn.written.Bytes())
+	}
+}
+
+func TestHandler_Telnet(t *testing.T) {
+	address := ""
+	port := 6044
+	h := startHandler(t, address, port, func(h *Handler) {
+		h.Telnet = true
+	})
+	defer h.Stop()
+
+	conn, reader := dialTelnet(t, address, port, "XTERM-256COLOR")
+	defer conn.Close()
+
+	// in character mode the name is echoed by the line editor as it is typed, and the terminal type enables colors
+	fmt.Fprint(conn, "bobb\x7f\r\x00")
+	readUntil(t, reader, ansiDim+"Welcome to telchat bob"+ansiReset+"\r\n")
+	readUntil(t, reader, NickColor("bob")+"bob"+ansiReset+": "+ansiDim+"Joined"+ansiReset+"\r\n")
+
+	term, ok := h.Terminal(h.findClient("bob"))
+	if e := (Terminal{CharacterMode: true, Height: 40, Type: "XTERM-256COLOR", Width: 120}); !ok || term != e {
+		t.Errorf("expected terminal (%+v) differed from actual terminal (%+v)", e, term)
+	}
+	fmt.Fprint(conn, "/color off\r")
+	readUntil(t, reader, "Colors are off\r\n")
+	fmt.Fprint(conn, "hi\r")
+	readUntil(t, reader, " bob: hi\r\n")
+}
+
+// dialTelnet will connect to the handler listening on address:port as a telnet client that switches to character
+// mode, reporting a window of 120x40 and the terminal type termType. The name prompt is consumed.
+func dialTelnet(t *testing.T, address string, port int, termType string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// the server offers character mode and asks for the window size and terminal type
+	negotiation := make([]byte, 12)
+	if _, err := io.ReadFull(reader, negotiation); err != nil {
+		t.Fatal(err)
+	}
+	e := []byte{telnetIAC, telnetWILL, telnetEcho, telnetIAC, telnetWILL, telnetSGA, telnetIAC, telnetDO, telnetNAWS, telnetIAC, telnetDO, telnetTTYPE}
+	if !bytes.Equal(negotiation, e) {
+		t.Errorf("expected negotiation (%v) differed from actual negotiation (%v)", e, negotiation)
+	}
+
+	conn.Write([]byte{
+		telnetIAC, telnetDO, telnetEcho, telnetIAC, telnetDO, telnetSGA,
+		telnetIAC, telnetWILL, telnetNAWS, telnetIAC, telnetSB, telnetNAWS, 0, 120, 0, 40, telnetIAC, telnetSE,
+		telnetIAC, telnetWILL, telnetTTYPE,
+	})
+	sendType := make([]byte, 6)
+	if _, err := io.ReadFull(reader, sendType); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append(append([]byte{telnetIAC, telnetSB, telnetTTYPE, ttypeIS}, termType...), telnetIAC, telnetSE))
+	readUntil(t, reader, "Enter your name")
+	readUntil(t, reader, editorPrompt)
+	return conn, reader
+}
+
+// readUntil will read from reader until the output ends with s, and return the output
+func readUntil(t *testing.T, reader *bufio.Reader, s string) string {
+	t.Helper()
+	var out []byte
+	for !bytes.HasSuffix(out, []byte(s)) {
+		b, err := reader.ReadByte()
+		if err != nil {
+			t.Fatalf("failed to read while expecting %q, got %q -> %s", s, out, err)
+		}
+		out = append(out, b)
+	}
+	return string(out)
+}
@@ -1,21 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	"strings"
 	"path/filepath"
 	"github.com/sirupsen/logrus"
 	"github.com/oklog/run"
 	"github.com/jwenz723/telchat/http"
+	"github.com/jwenz723/telchat/irc"
+	"github.com/jwenz723/telchat/sshd"
 	"github.com/jwenz723/telchat/tcp"
+	"golang.org/x/crypto/ssh/terminal"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 // Source of inspiration for a TCP chat app: https://github.com/kljensen/golang-chat
 func main() {
 	configFile := kingpin.Flag("config", "path to yaml config file").Default("config.yml").String()
+	createAccount := kingpin.Flag("create-account", "create (or reset the password of) the account with this name using a password read from stdin, then exit. The accounts listed in Admins must be created this way").String()
 	kingpin.Parse()
 
 	config, err := NewConfig(*configFile)
@@ -34,9 +41,87 @@ func main() {
 		}
 	}()
 
-	tcpHandler := tcp.New(config.TCPAddress, config.TCPPort, logger)
-	httpHandler := http.New(config.HTTPAddress, config.HTTPPort, tcpHandler.Messages(), logger)
+	store, err := NewStore(config)
+	if err != nil {
+		logger.Fatalf("error opening message store -> %v\n", err)
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			logger.Errorf("error closing message store -> %v\n", err)
+		}
+	}()
 
+	users, err := NewUserStore(config)
+	if err != nil {
+		logger.Fatalf("error opening user store -> %v\n", err)
+	}
+	defer func() {
+		if err := users.Close(); err != nil {
+			logger.Errorf("error closing user store -> %v\n", err)
+		}
+	}()
+
+	bans, err := tcp.OpenBanList(config.BanFile)
+	if err != nil {
+		logger.Fatalf("error loading ban list -> %v\n", err)
+	}
+
+	tokens, err := NewTokenStore(config)
+	if err != nil {
+		logger.Fatalf("error loading API tokens -> %v\n", err)
+	}
+
+	tlsConfig, tlsReloader, err := NewTLSConfig(config)
+	if err != nil {
+		logger.Fatalf("error configuring TLS -> %v\n", err)
+	}
+
+	tcpHandler := tcp.New(config.TCPAddress, config.TCPPort, logger)
+	tcpHandler.AccountsOnly = config.AccountsOnly
+	tcpHandler.Admins = config.Admins
+	tcpHandler.Bans = bans
+	tcpHandler.FloodControl = tcp.FloodControl{
+		Limit:        tcp.RateLimit{Burst: config.FloodBurst, Rate: config.FloodRate},
+		MuteDuration: config.FloodMuteDuration,
+		Mutes:        config.FloodMutes,
+		Warnings:     config.FloodWarnings,
+	}
+	tcpHandler.HistorySize = config.HistorySize
+	tcpHandler.IdleTimeout = config.IdleTimeout
+	tcpHandler.KeepAlive = config.TCPKeepAlive
+	tcpHandler.MaxConnections = config.MaxConnections
+	tcpHandler.MaxConnectionsPerIP = config.MaxConnectionsPerIP
+	tcpHandler.MaxLineLength = config.MaxLineLength
+	tcpHandler.NameTimeout = config.NameTimeout
+	tcpHandler.NickLength = config.MaxNickLength
+	tcpHandler.OverflowPolicy = config.QueueOverflow
+	tcpHandler.PingInterval = config.PingInterval
+	tcpHandler.PingTimeout = config.PingTimeout
+	tcpHandler.QueueSize = config.QueueSize
+	tcpHandler.SanitizePolicy = config.SanitizePolicy
+	tcpHandler.Store = store
+	tcpHandler.Telnet = !config.TCPRaw
+	tcpHandler.TLSConfig = tlsConfig
+	tcpHandler.Users = users
+	tcpHandler.WriteTimeout = config.WriteTimeout
+	if *createAccount != "" {
+		fmt.Fprintf(os.Stderr, "Password for %s: ", *createAccount)
+		password, err := readPassword()
+		if err != nil {
+			logger.Fatalf("error reading password -> %v\n", err)
+		} else if err := tcpHandler.CreateAccount(*createAccount, password); err != nil {
+			logger.Fatalf("error creating account -> %v\n", err)
+		}
+		fmt.Printf("Created account %s\n", *createAccount)
+		return
+	}
+	httpHandler := http.New(config.HTTPAddress, config.HTTPPort, tcpHandler, logger)
+	if config.HTTPRateLimit > 0 {
+		httpHandler.RateLimiter = tcp.NewRateLimiter(tcp.RateLimit{Burst: config.HTTPRateBurst, Rate: config.HTTPRateLimit})
+	}
+	httpHandler.RequireTokens = config.HTTPRequireTokens
+	httpHandler.TLSConfig = tlsConfig
+	httpHandler.Tokens = tokens
 
 	// using a run.Group to handle automatic stopping of all components of the application in
 	// the event that one of the components experiences an error.
@@ -70,11 +155,106 @@ func main() {
 		)
 	}
 
+	if config.SSHPort != 0 {
+		// SSH listener - accepts chat sessions via ssh
+		hostKey, err := sshd.LoadHostKey(config.SSHHostKeyFile)
+		if err != nil {
+			logger.Fatalf("error loading SSH host key -> %v\n", err)
+		}
+		sshHandler := sshd.New(config.SSHAddress, config.SSHPort, tcpHandler, logger)
+		sshHandler.AuthorizedKeysFile = config.SSHAuthorizedKeysFile
+		sshHandler.HostKey = hostKey
+		sshHandler.PasswordAuth = config.SSHPasswordAuth
+		g.Add(
+			func() error {
+				if err := sshHandler.Start(); err != nil {
+					return fmt.Errorf("error starting ssh listener: %s", err)
+				}
+				return nil
+			},
+			func(err error) {
+				sshHandler.Stop()
+			},
+		)
+	}
+	if config.IRCPort != 0 {
+		// IRC listener - accepts connections from IRC clients
+		ircHandler := irc.New(config.IRCAddress, config.IRCPort, tcpHandler, logger)
+		ircHandler.TLSConfig = tlsConfig
+		g.Add(
+			func() error {
+				if err := ircHandler.Start(); err != nil {
+					return fmt.Errorf("error starting irc listener: %s", err)
+				}
+				return nil
+			},
+			func(err error) {
+				ircHandler.Stop()
+			},
+		)
+	}
+	if tlsReloader != nil {
+		// SIGHUP reloader - rotates the TLS certificates without dropping connections
+		hup := make(chan os.Signal, 1)
+		stop := make(chan struct{})
+		g.Add(
+			func() error {
+				signal.Notify(hup, syscall.SIGHUP)
+				for {
+					select {
+					case <-hup:
+						if err := tlsReloader.Reload(); err != nil {
+							logger.WithField("error", err).Error("error reloading TLS certificates, the previous certificates remain in use")
+						} else {
+							logger.Info("reloaded TLS certificates")
+						}
+					case <-stop:
+						return nil
+					}
+				}
+			},
+			func(err error) {
+				signal.Stop(hup)
+				close(stop)
+			},
+		)
+	}
+
 	if err := g.Run(); err != nil {
 		logger.Fatal(err)
 	}
 }
 
+// NewStore will create the message store selected by config
+func NewStore(config *Config) (tcp.Store, error) {
+	if config.StoreType == StoreTypeLog {
+		return tcp.OpenLogStore(config.StoreDirectory, config.StoreSegmentSize)
+	}
+	return tcp.NewMemoryStore(config.StoreMemoryLimit), nil
+}
+
+// NewTokenStore will load the API tokens issued through the HTTP listener and add the tokens defined in config
+func NewTokenStore(config *Config) (*http.TokenStore, error) {
+	tokens, err := http.OpenTokenStore(config.HTTPTokensFile)
+	if err != nil {
+		return nil, err
+	}
+	for i, t := range config.HTTPTokens {
+		if err := tokens.Add(t.Token, t.Sender, t.Scopes); err != nil {
+			return nil, fmt.Errorf("invalid token %d in HTTPTokens: %s", i+1, err)
+		}
+	}
+	return tokens, nil
+}
+
+// NewUserStore will create the user store selected by config
+func NewUserStore(config *Config) (tcp.UserStore, error) {
+	if config.UserStoreType == UserStoreTypeFile {
+		return tcp.OpenFileUserStore(config.UserStoreFile)
+	}
+	return tcp.NewMemoryUserStore(), nil
+}
+
 // InitLogging is used to initialize all properties of the logrus logging library.
 func InitLogging(logDirectory string, logLevel string, jsonOutput bool) (logger *logrus.Logger, teardown func() error, err error) {
 	logger = logrus.New()
@@ -130,4 +310,19 @@ func InitLogging(logDirectory string, logLevel string, jsonOutput bool) (logger
 	}
 
 	return logger, teardown, nil
-}
\ No newline at end of file
+}
+
+// readPassword will read a line from stdin, without echoing it if stdin is a terminal
+func readPassword() (string, error) {
+	if fd := int(os.Stdin.Fd()); terminal.IsTerminal(fd) {
+		password, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -10,6 +10,7 @@ import (
 	"regexp"
 	"io/ioutil"
 	"reflect"
+	"github.com/jwenz723/telchat/tcp"
 )
 
 var LogDirectory string
@@ -143,4 +144,26 @@ func TestInitLogging(t *testing.T) {
 			}
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestNewStore(t *testing.T) {
+	memory, err := NewStore(&Config{StoreType: StoreTypeMemory, StoreMemoryLimit: 10})
+	if err != nil {
+		t.Errorf("NewStore failed to create memory store -> %s", err)
+	} else if _, ok := memory.(*tcp.MemoryStore); !ok {
+		t.Errorf("NewStore returned %T for StoreType %s", memory, StoreTypeMemory)
+	}
+
+	dir := filepath.Join(LogDirectory, "store")
+	log, err := NewStore(&Config{StoreType: StoreTypeLog, StoreDirectory: dir})
+	if err != nil {
+		t.Fatalf("NewStore failed to create log store -> %s", err)
+	} else if _, ok := log.(*tcp.LogStore); !ok {
+		t.Errorf("NewStore returned %T for StoreType %s", log, StoreTypeLog)
+	}
+	log.Close()
+
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("NewStore did not create StoreDirectory %s -> %s", dir, err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// TLS versions that can be selected with Config.TLSMinVersion
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSReloader holds the certificate (and optional client CAs) used by the TLS listeners. Reload re-reads them from disk,
+// which only affects new connections, so that certificates can be rotated without dropping any clients.
+type TLSReloader struct {
+	base         *tls.Config // the settings shared by every connection, without certificates
+	certFile     string
+	clientCAFile string
+	config       *tls.Config // base along with the most recently loaded certificates
+	keyFile      string
+	mutex        sync.RWMutex
+}
+
+// NewTLSConfig will create the tls.Config used by the TCP and HTTP listeners from the TLS settings of config. nil is
+// returned if TLS is not enabled.
+func NewTLSConfig(config *Config) (*tls.Config, *TLSReloader, error) {
+	if config.TLSCertFile == "" {
+		return nil, nil, nil
+	}
+
+	r := &TLSReloader{
+		base:         &tls.Config{MinVersion: tlsVersions[config.TLSMinVersion]},
+		certFile:     config.TLSCertFile,
+		clientCAFile: config.TLSClientCAFile,
+		keyFile:      config.TLSKeyFile,
+	}
+	if r.clientCAFile != "" {
+		r.base.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if err := r.Reload(); err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: r.base.MinVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mutex.RLock()
+			defer r.mutex.RUnlock()
+			return r.config, nil
+		},
+	}
+	return tlsConfig, r, nil
+}
+
+// Reload will read the certificate, key and client CAs from disk. The previous certificates remain in use if an error
+// is returned.
+func (r *TLSReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %s", err)
+	}
+
+	config := r.base.Clone()
+	config.Certificates = []tls.Certificate{cert}
+	if r.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("error loading TLS client CAs: %s", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("error loading TLS client CAs: no certificates found in %s", r.clientCAFile)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.config = config
+	return nil
+}
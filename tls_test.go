@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwenz723/telchat/tcp"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	if c, r, err := NewTLSConfig(&Config{}); c != nil || r != nil || err != nil {
+		t.Errorf("expected TLS to be disabled without a certificate, got %v, %v, %v", c, r, err)
+	}
+
+	dir := filepath.Join(LogDirectory, "tls")
+	os.MkdirAll(dir, 0777)
+	defer os.RemoveAll(dir)
+	config := &Config{
+		TLSCertFile:   filepath.Join(dir, "cert.pem"),
+		TLSKeyFile:    filepath.Join(dir, "key.pem"),
+		TLSMinVersion: "1.2",
+	}
+
+	ca, caKey := writeCertificate(t, config.TLSCertFile, config.TLSKeyFile, 1, nil, nil)
+	tlsConfig, reloader, err := NewTLSConfig(config)
+	if err != nil {
+		t.Fatalf("NewTLSConfig failed -> %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	if serial, err := handshake(tlsConfig, &tls.Config{RootCAs: pool, ServerName: "localhost"}); err != nil || serial != 1 {
+		t.Errorf("expected certificate 1 to be served, got %d -> %v", serial, err)
+	}
+
+	// a reload only affects new connections
+	writeCertificate(t, config.TLSCertFile, config.TLSKeyFile, 2, ca, caKey)
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload failed -> %s", err)
+	}
+	if serial, err := handshake(tlsConfig, &tls.Config{RootCAs: pool, ServerName: "localhost"}); err != nil || serial != 2 {
+		t.Errorf("expected certificate 2 to be served after a reload, got %d -> %v", serial, err)
+	}
+
+	// the previous certificate remains in use when a reload fails
+	ioutil.WriteFile(config.TLSKeyFile, []byte("garbage"), 0600)
+	if err := reloader.Reload(); err == nil {
+		t.Errorf("expected Reload to fail with an invalid key")
+	}
+	if serial, err := handshake(tlsConfig, &tls.Config{RootCAs: pool, ServerName: "localhost"}); err != nil || serial != 2 {
+		t.Errorf("expected certificate 2 to still be served after a failed reload, got %d -> %v", serial, err)
+	}
+}
+
+func TestNewTLSConfig_ClientCA(t *testing.T) {
+	dir := filepath.Join(LogDirectory, "mtls")
+	os.MkdirAll(dir, 0777)
+	defer os.RemoveAll(dir)
+	config := &Config{
+		TLSCertFile:     filepath.Join(dir, "cert.pem"),
+		TLSClientCAFile: filepath.Join(dir, "cert.pem"),
+		TLSKeyFile:      filepath.Join(dir, "key.pem"),
+		TLSMinVersion:   "1.2",
+	}
+
+	// the server certificate doubles as the client CA
+	ca, caKey := writeCertificate(t, config.TLSCertFile, config.TLSKeyFile, 1, nil, nil)
+	tlsConfig, _, err := NewTLSConfig(config)
+	if err != nil {
+		t.Fatalf("NewTLSConfig failed -> %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	if _, err := handshake(tlsConfig, &tls.Config{RootCAs: pool, ServerName: "localhost"}); err == nil {
+		t.Errorf("expected a client without a certificate to be rejected")
+	}
+
+	clientCert, clientKey := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	writeCertificate(t, clientCert, clientKey, 3, ca, caKey)
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(tlsConfig, &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool, ServerName: "localhost"}); err != nil {
+		t.Errorf("expected a client with a certificate signed by the client CA to be accepted -> %s", err)
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := filepath.Join(LogDirectory, "listener")
+	os.MkdirAll(dir, 0777)
+	defer os.RemoveAll(dir)
+	config := &Config{
+		TLSCertFile:   filepath.Join(dir, "cert.pem"),
+		TLSKeyFile:    filepath.Join(dir, "key.pem"),
+		TLSMinVersion: "1.2",
+	}
+	ca, _ := writeCertificate(t, config.TLSCertFile, config.TLSKeyFile, 1, nil, nil)
+	tlsConfig, _, err := NewTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger, _ := test.NewNullLogger()
+	h := tcp.New("", 6018, logger)
+	h.MaxConnectionsPerIP = 1
+	h.NameTimeout = 300 * time.Millisecond
+	h.Telnet = true
+	h.TLSConfig = tlsConfig
+	go h.Start()
+	<-h.Listening()
+	defer h.Stop()
+
+	// a client that never starts the TLS handshake is disconnected after NameTimeout, which frees its connection
+	silent, err := net.Dial("tcp", net.JoinHostPort("localhost", "6018"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	silent.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := silent.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("expected a client without a TLS handshake to be disconnected, got %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	var line string
+	for i := 0; i < 10; i++ {
+		// the connection of the silent client is released right after it is closed
+		conn, err := tls.Dial("tcp", net.JoinHostPort("localhost", "6018"), &tls.Config{RootCAs: pool, ServerName: "localhost"})
+		if err != nil {
+			t.Fatalf("failed to connect to TLS listener -> %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if line, err = bufio.NewReader(conn).ReadString('\n'); err == nil && strings.Contains(line, "Enter your name ") {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !strings.Contains(line, "Enter your name ") {
+		t.Errorf("expected the name prompt over TLS, got %q", line)
+	}
+}
+
+// isTimeout reports whether err was caused by a deadline
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// writeCertificate will write a certificate for localhost with the specified serial number and its key as PEM files.
+// The certificate is self-signed (and can sign other certificates) unless a parent is provided.
+func writeCertificate(t *testing.T, certFile, keyFile string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// handshake will perform a TLS handshake between server and client and return the serial number of the certificate
+// presented by the server
+func handshake(server, client *tls.Config) (int64, error) {
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		conn := tls.Server(s, server)
+		err := conn.Handshake()
+		if err == nil {
+			// TLS 1.3 clients only learn that their certificate was rejected when reading from the connection
+			conn.Write([]byte("ok"))
+		}
+		errCh <- err
+		s.Close()
+	}()
+
+	conn := tls.Client(c, client)
+	if err := conn.Handshake(); err != nil {
+		return 0, err
+	}
+	if _, err := conn.Read(make([]byte, 2)); err != nil {
+		return 0, err
+	}
+	if err := <-errCh; err != nil {
+		return 0, err
+	}
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}